@@ -2,8 +2,10 @@ package config
 
 import (
 	"fmt"
+	"math"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -11,12 +13,286 @@ import (
 	"github.com/spf13/viper"
 )
 
+// CelRule is a named CEL expression from the config file.
+type CelRule struct {
+	Name       string `mapstructure:"name"`
+	Expression string `mapstructure:"expression"`
+}
+
+// CelAnnotation is a CEL expression whose (string) result is added to
+// audit events as an annotation with the provided key.
+type CelAnnotation struct {
+	Key        string `mapstructure:"key"`
+	Expression string `mapstructure:"expression"`
+}
+
+// RetryConfig controls how often and how quickly a failed batch is
+// retried by an output.
+type RetryConfig struct {
+	MaxAttempts    int           `mapstructure:"max_attempts"`
+	InitialBackoff time.Duration `mapstructure:"initial_backoff"`
+	MaxBackoff     time.Duration `mapstructure:"max_backoff"`
+}
+
+// RateLimitConfig limits how many events and bytes of json per second an
+// output sends, allowing bursts of up to burst_events events and
+// burst_bytes bytes. Zero rates are not limited.
+type RateLimitConfig struct {
+	EventsPerSecond float64 `mapstructure:"events_per_second"`
+	BytesPerSecond  float64 `mapstructure:"bytes_per_second"`
+	BurstEvents     int     `mapstructure:"burst_events"`
+	BurstBytes      int     `mapstructure:"burst_bytes"`
+}
+
+// CircuitBreakerConfig stops an output from sending batches after
+// failure_threshold consecutive failures. After open_timeout, a single
+// batch is sent to probe whether the output recovered. While the breaker
+// is open, events are written to a spool in spool_dir (if set), and sent
+// once the output recovered. A failure threshold of 0 disables the
+// breaker.
+type CircuitBreakerConfig struct {
+	FailureThreshold int           `mapstructure:"failure_threshold"`
+	OpenTimeout      time.Duration `mapstructure:"open_timeout"`
+	SpoolDir         string        `mapstructure:"spool_dir"`
+	SpoolMaxSizeMB   int           `mapstructure:"spool_max_size_mb"`
+}
+
+// ProxyConfig sets the http proxy of an output. Requests to hosts in
+// no_proxy (like the NO_PROXY environment variable: host names, domains
+// with a leading dot, IP addresses or CIDR ranges) are not proxied.
+// Without a url, the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+// variables are used.
+type ProxyConfig struct {
+	URL      string   `mapstructure:"url"`
+	Username string   `mapstructure:"username"`
+	Password string   `mapstructure:"password"`
+	NoProxy  []string `mapstructure:"no_proxy"`
+}
+
+// HTTPConfig controls the connections of outputs sending events over
+// http(s). Zero values use the defaults. ReadTimeout only limits waiting
+// for the response headers, Timeout the whole request.
+type HTTPConfig struct {
+	Proxy               ProxyConfig   `mapstructure:"proxy"`
+	Timeout             time.Duration `mapstructure:"timeout"`
+	ConnectTimeout      time.Duration `mapstructure:"connect_timeout"`
+	ReadTimeout         time.Duration `mapstructure:"read_timeout"`
+	KeepAlive           time.Duration `mapstructure:"keep_alive"`
+	DisableKeepAlives   bool          `mapstructure:"disable_keep_alives"`
+	MaxIdleConns        int           `mapstructure:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `mapstructure:"max_idle_conns_per_host"`
+	IdleConnTimeout     time.Duration `mapstructure:"idle_conn_timeout"`
+}
+
+// TLSConfig controls the tls settings used to connect to an output.
+type TLSConfig struct {
+	Enabled            bool   `mapstructure:"enabled"`
+	CAFile             string `mapstructure:"ca_file"`
+	CertFile           string `mapstructure:"cert_file"`
+	KeyFile            string `mapstructure:"key_file"`
+	ServerName         string `mapstructure:"server_name"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+	MinVersion         string `mapstructure:"min_version"`
+}
+
+// AuthConfig controls how webhook outputs authenticate to the receiver.
+type AuthConfig struct {
+	BearerToken          string        `mapstructure:"bearer_token"`
+	BearerTokenFile      string        `mapstructure:"bearer_token_file"`
+	TokenRefreshInterval time.Duration `mapstructure:"token_refresh_interval"`
+	Username             string        `mapstructure:"username"`
+	Password             string        `mapstructure:"password"`
+	HMACSecret           string        `mapstructure:"hmac_secret"`
+	HMACSignatureHeader  string        `mapstructure:"hmac_signature_header"`
+	HMACTimestampHeader  string        `mapstructure:"hmac_timestamp_header"`
+}
+
+// SASLConfig controls the SASL authentication of kafka outputs.
+type SASLConfig struct {
+	Mechanism string `mapstructure:"mechanism"`
+	User      string `mapstructure:"user"`
+	Password  string `mapstructure:"password"`
+}
+
+// KafkaConfig holds the settings of kafka outputs.
+type KafkaConfig struct {
+	Brokers     []string   `mapstructure:"brokers"`
+	Topic       string     `mapstructure:"topic"`
+	Key         string     `mapstructure:"key"`
+	Acks        string     `mapstructure:"acks"`
+	Compression string     `mapstructure:"compression"`
+	Version     string     `mapstructure:"version"`
+	TLS         TLSConfig  `mapstructure:"tls"`
+	SASL        SASLConfig `mapstructure:"sasl"`
+}
+
+// SplunkConfig holds the settings of splunk HTTP Event Collector outputs.
+type SplunkConfig struct {
+	Token           string        `mapstructure:"token"`
+	Index           string        `mapstructure:"index"`
+	Host            string        `mapstructure:"host"`
+	Source          string        `mapstructure:"source"`
+	Sourcetype      string        `mapstructure:"sourcetype"`
+	Ack             bool          `mapstructure:"ack"`
+	Channel         string        `mapstructure:"channel"`
+	AckTimeout      time.Duration `mapstructure:"ack_timeout"`
+	AckPollInterval time.Duration `mapstructure:"ack_poll_interval"`
+}
+
+// ElasticsearchConfig holds the settings of elasticsearch/opensearch
+// outputs.
+type ElasticsearchConfig struct {
+	Index        string `mapstructure:"index"`
+	Username     string `mapstructure:"username"`
+	Password     string `mapstructure:"password"`
+	APIKey       string `mapstructure:"api_key"`
+	TemplateName string `mapstructure:"template_name"`
+	TemplateFile string `mapstructure:"template_file"`
+}
+
+// LokiConfig holds the settings of loki outputs.
+type LokiConfig struct {
+	Labels   map[string]string `mapstructure:"labels"`
+	TenantID string            `mapstructure:"tenant_id"`
+	Username string            `mapstructure:"username"`
+	Password string            `mapstructure:"password"`
+}
+
+// OTLPConfig holds the settings of OpenTelemetry (OTLP) log outputs.
+type OTLPConfig struct {
+	Protocol           string            `mapstructure:"protocol"`
+	Insecure           bool              `mapstructure:"insecure"`
+	Timeout            time.Duration     `mapstructure:"timeout"`
+	ResourceAttributes map[string]string `mapstructure:"resource_attributes"`
+}
+
+// SyslogConfig holds the settings of syslog outputs.
+type SyslogConfig struct {
+	Format   string    `mapstructure:"format"`
+	Facility string    `mapstructure:"facility"`
+	Hostname string    `mapstructure:"hostname"`
+	AppName  string    `mapstructure:"app_name"`
+	TLS      TLSConfig `mapstructure:"tls"`
+}
+
+// ArchiveConfig holds the settings of archive outputs, which upload
+// audit events to an object storage bucket.
+type ArchiveConfig struct {
+	Provider        string        `mapstructure:"provider"`
+	Bucket          string        `mapstructure:"bucket"`
+	Prefix          string        `mapstructure:"prefix"`
+	Region          string        `mapstructure:"region"`
+	AccessKeyID     string        `mapstructure:"access_key_id"`
+	SecretAccessKey string        `mapstructure:"secret_access_key"`
+	Format          string        `mapstructure:"format"`
+	StagingDir      string        `mapstructure:"staging_dir"`
+	MaxFileSizeMB   int           `mapstructure:"max_file_size_mb"`
+	FlushInterval   time.Duration `mapstructure:"flush_interval"`
+	UploadAttempts  int           `mapstructure:"upload_attempts"`
+
+	// Also archive the raw log entries the audit events were converted
+	// from, below raw/ in the bucket prefix.
+	RawEntries bool `mapstructure:"raw_entries"`
+}
+
+// PubSubConfig holds the settings of Google Cloud Pub/Sub outputs. The
+// project defaults to the project the logs are read from.
+type PubSubConfig struct {
+	Project     string `mapstructure:"project"`
+	Topic       string `mapstructure:"topic"`
+	OrderingKey string `mapstructure:"ordering_key"`
+}
+
+// CloudEventsConfig controls how webhook outputs with the cloudevents
+// encoding send events.
+type CloudEventsConfig struct {
+	Mode string `mapstructure:"mode"`
+	Type string `mapstructure:"type"`
+}
+
+// OutputConfig describes one destination for converted audit events.
+type OutputConfig struct {
+	Name      string            `mapstructure:"name"`
+	Type      string            `mapstructure:"type"`
+	Url       string            `mapstructure:"url"`
+	BatchSize int               `mapstructure:"batch_size"`
+	Headers   map[string]string `mapstructure:"headers"`
+	Retry     RetryConfig       `mapstructure:"retry"`
+	Filter    string            `mapstructure:"filter"`
+
+	// Batches are also limited to this many bytes of json, and sent once
+	// the oldest event in them waited for max_linger. Zero disables
+	// either limit.
+	MaxBatchBytes int           `mapstructure:"max_batch_bytes"`
+	MaxLinger     time.Duration `mapstructure:"max_linger"`
+
+	// Batches are sent by this many workers, each with a queue of
+	// queue_size batches (default 10). With ordering "object", events of
+	// the same object are always sent by the same worker, in order. With
+	// ordering "global", all events are sent in order by a single worker.
+	Workers   int    `mapstructure:"workers"`
+	QueueSize int    `mapstructure:"queue_size"`
+	Ordering  string `mapstructure:"ordering"`
+
+	RateLimit RateLimitConfig `mapstructure:"rate_limit"`
+
+	CircuitBreaker CircuitBreakerConfig `mapstructure:"circuit_breaker"`
+
+	// The tls and connection settings of outputs sending events over
+	// http(s).
+	TLS  TLSConfig  `mapstructure:"tls"`
+	HTTP HTTPConfig `mapstructure:"http"`
+
+	Auth AuthConfig `mapstructure:"auth"`
+
+	// The compression of request bodies of webhook outputs: none, gzip
+	// or zstd. Bodies smaller than the threshold (in bytes) are not
+	// compressed.
+	Compression          string `mapstructure:"compression"`
+	CompressionThreshold int    `mapstructure:"compression_threshold"`
+
+	// The encoding of webhook outputs: json (an array of audit events) or
+	// cloudevents.
+	Encoding    string            `mapstructure:"encoding"`
+	CloudEvents CloudEventsConfig `mapstructure:"cloudevents"`
+
+	// The response status codes http outputs treat as success. Any 2xx
+	// status if empty. With partial_failures, successful webhook
+	// responses listing per-event errors only fail those events.
+	SuccessCodes    []int `mapstructure:"success_codes"`
+	PartialFailures bool  `mapstructure:"partial_failures"`
+
+	// When a required output fails to deliver events, the poller does
+	// not advance past them and reads them again on the next poll.
+	// Defaults to true for kafka outputs and false otherwise.
+	Required *bool `mapstructure:"required"`
+
+	// Events the output rejected permanently (e.g. with a 400 response)
+	// are not read again. They are appended to this file as json lines
+	// if it is set, and only logged otherwise.
+	RejectedFile string `mapstructure:"rejected_file"`
+
+	Kafka         KafkaConfig         `mapstructure:"kafka"`
+	Splunk        SplunkConfig        `mapstructure:"splunk"`
+	Elasticsearch ElasticsearchConfig `mapstructure:"elasticsearch"`
+	Loki          LokiConfig          `mapstructure:"loki"`
+	OTLP          OTLPConfig          `mapstructure:"otlp"`
+	Syslog        SyslogConfig        `mapstructure:"syslog"`
+	Archive       ArchiveConfig       `mapstructure:"archive"`
+	PubSub        PubSubConfig        `mapstructure:"pubsub"`
+}
+
 type Config struct {
 	Url                           string
 	ProjectId                     string
 	ClusterName                   string
 	OutfileName                   string
 	LogfileName                   string
+	RotateMaxSizeMB               int
+	RotateInterval                time.Duration
+	RotateMaxBackups              int
+	RotateMaxAge                  time.Duration
+	RotateCompress                bool
 	PollInterval                  time.Duration
 	LagInterval                   time.Duration
 	MaxAuditEventsBatch           int
@@ -24,6 +300,17 @@ type Config struct {
 	ApiPort                       int
 	LogLevel                      string
 	SupressObjectConversionErrors bool
+	LogNames                      []string
+	GKEClusterEvents              bool
+	ExtraFilters                  []string
+	CelExcludes                   []CelRule
+	CelAnnotations                []CelAnnotation
+	RulesEnabled                  bool
+	RulesFile                     string
+	RulesMinPriority              string
+	AlertsOutfileName             string
+	AlertsUrl                     string
+	Outputs                       []OutputConfig
 	vcfg                          *viper.Viper
 }
 
@@ -36,6 +323,11 @@ func New(configDir string, commandLine *pflag.FlagSet) (*Config, error) {
 	vcfg.SetDefault("cluster", "")
 	vcfg.SetDefault("outfile", "")
 	vcfg.SetDefault("logfile", "")
+	vcfg.SetDefault("rotate.max_size_mb", 100)
+	vcfg.SetDefault("rotate.interval", "0s")
+	vcfg.SetDefault("rotate.max_backups", 5)
+	vcfg.SetDefault("rotate.max_age", "0s")
+	vcfg.SetDefault("rotate.compress", true)
 	vcfg.SetDefault("poll_interval", "5s")
 	vcfg.SetDefault("lag_interval", "30s")
 	vcfg.SetDefault("max-audit-events-batch", 100)
@@ -43,6 +335,14 @@ func New(configDir string, commandLine *pflag.FlagSet) (*Config, error) {
 	vcfg.SetDefault("api.port", 8182)
 	vcfg.SetDefault("log_level", "info")
 	vcfg.SetDefault("supress_object_conversion_errors", true)
+	vcfg.SetDefault("log_names", []string{"activity"})
+	vcfg.SetDefault("gke_cluster_events", false)
+	vcfg.SetDefault("extra_filters", []string{})
+	vcfg.SetDefault("rules.enabled", false)
+	vcfg.SetDefault("rules.file", "/opt/swb/rules/swb_rules.yaml")
+	vcfg.SetDefault("rules.min_priority", "debug")
+	vcfg.SetDefault("rules.alerts.outfile", "-")
+	vcfg.SetDefault("rules.alerts.url", "")
 
 	c := &Config{
 		vcfg: vcfg,
@@ -61,18 +361,25 @@ func New(configDir string, commandLine *pflag.FlagSet) (*Config, error) {
 		}
 	}
 
-	c.UpdateValues()
+	if err := c.UpdateValues(); err != nil {
+		return nil, err
+	}
 	c.LogSettings()
 
 	return c, nil
 }
 
-func (c *Config) UpdateValues() {
+func (c *Config) UpdateValues() error {
 	c.Url = c.vcfg.GetString("url")
 	c.ProjectId = c.vcfg.GetString("project")
 	c.ClusterName = c.vcfg.GetString("cluster")
 	c.OutfileName = c.vcfg.GetString("outfile")
 	c.LogfileName = c.vcfg.GetString("logfile")
+	c.RotateMaxSizeMB = c.vcfg.GetInt("rotate.max_size_mb")
+	c.RotateInterval, _ = time.ParseDuration(c.vcfg.GetString("rotate.interval"))
+	c.RotateMaxBackups = c.vcfg.GetInt("rotate.max_backups")
+	c.RotateMaxAge, _ = time.ParseDuration(c.vcfg.GetString("rotate.max_age"))
+	c.RotateCompress = c.vcfg.GetBool("rotate.compress")
 	c.PollInterval, _ = time.ParseDuration(c.vcfg.GetString("poll_interval"))
 	c.LagInterval, _ = time.ParseDuration(c.vcfg.GetString("lag_interval"))
 	c.MaxAuditEventsBatch = c.vcfg.GetInt("max-audit-events-batch")
@@ -80,6 +387,234 @@ func (c *Config) UpdateValues() {
 	c.ApiPort = c.vcfg.GetInt("api.port")
 	c.LogLevel = c.vcfg.GetString("log_level")
 	c.SupressObjectConversionErrors = c.vcfg.GetBool("supress_object_conversion_errors")
+	c.LogNames = c.vcfg.GetStringSlice("log_names")
+	c.GKEClusterEvents = c.vcfg.GetBool("gke_cluster_events")
+	c.ExtraFilters = c.vcfg.GetStringSlice("extra_filters")
+
+	c.RulesEnabled = c.vcfg.GetBool("rules.enabled")
+	c.RulesFile = c.vcfg.GetString("rules.file")
+	c.RulesMinPriority = c.vcfg.GetString("rules.min_priority")
+	c.AlertsOutfileName = c.vcfg.GetString("rules.alerts.outfile")
+	c.AlertsUrl = c.vcfg.GetString("rules.alerts.url")
+
+	c.CelExcludes = nil
+	if err := c.vcfg.UnmarshalKey("cel.exclude", &c.CelExcludes); err != nil {
+		return fmt.Errorf("Could not parse cel.exclude: %v", err)
+	}
+
+	c.CelAnnotations = nil
+	if err := c.vcfg.UnmarshalKey("cel.annotations", &c.CelAnnotations); err != nil {
+		return fmt.Errorf("Could not parse cel.annotations: %v", err)
+	}
+
+	c.Outputs = nil
+	if err := c.vcfg.UnmarshalKey("outputs", &c.Outputs); err != nil {
+		return fmt.Errorf("Could not parse outputs: %v", err)
+	}
+
+	// Without any outputs, send events to the url like earlier versions.
+	if len(c.Outputs) == 0 {
+		c.Outputs = []OutputConfig{
+			{
+				Name:      "default",
+				Url:       c.Url,
+				BatchSize: c.MaxAuditEventsBatch,
+			},
+		}
+	}
+
+	names := map[string]bool{}
+	for i := range c.Outputs {
+		output := &c.Outputs[i]
+
+		if output.Name == "" {
+			output.Name = fmt.Sprintf("output-%d", i)
+		}
+		if names[output.Name] {
+			return fmt.Errorf("Output name %s is used more than once", output.Name)
+		}
+		names[output.Name] = true
+
+		if output.Type == "" {
+			output.Type = "webhook"
+		}
+		if output.BatchSize <= 0 {
+			output.BatchSize = c.MaxAuditEventsBatch
+		}
+		if output.Workers <= 0 {
+			output.Workers = 1
+		}
+		if output.QueueSize <= 0 {
+			output.QueueSize = 10
+		}
+		if output.Ordering == "" {
+			output.Ordering = "object"
+		}
+		if output.RateLimit.EventsPerSecond > 0 && output.RateLimit.BurstEvents <= 0 {
+			output.RateLimit.BurstEvents = int(math.Ceil(output.RateLimit.EventsPerSecond))
+		}
+		if output.RateLimit.BytesPerSecond > 0 && output.RateLimit.BurstBytes <= 0 {
+			output.RateLimit.BurstBytes = int(math.Ceil(output.RateLimit.BytesPerSecond))
+		}
+		if output.CircuitBreaker.FailureThreshold > 0 {
+			if output.CircuitBreaker.OpenTimeout <= 0 {
+				output.CircuitBreaker.OpenTimeout = 30 * time.Second
+			}
+			if output.CircuitBreaker.SpoolMaxSizeMB <= 0 {
+				output.CircuitBreaker.SpoolMaxSizeMB = 100
+			}
+		}
+		if output.Retry.MaxAttempts <= 0 {
+			output.Retry.MaxAttempts = 1
+		}
+		if output.Retry.InitialBackoff <= 0 {
+			output.Retry.InitialBackoff = 1 * time.Second
+		}
+		if output.Retry.MaxBackoff <= 0 {
+			output.Retry.MaxBackoff = 30 * time.Second
+		}
+		if output.Type == "webhook" {
+			if output.Encoding == "" {
+				output.Encoding = "json"
+			}
+			if output.Compression == "" {
+				output.Compression = "none"
+			}
+			if output.CompressionThreshold <= 0 {
+				output.CompressionThreshold = 1024
+			}
+			if output.Auth.TokenRefreshInterval <= 0 {
+				output.Auth.TokenRefreshInterval = 1 * time.Minute
+			}
+			if output.Auth.HMACSignatureHeader == "" {
+				output.Auth.HMACSignatureHeader = "X-Swb-Signature"
+			}
+			if output.Auth.HMACTimestampHeader == "" {
+				output.Auth.HMACTimestampHeader = "X-Swb-Timestamp"
+			}
+			if output.Encoding == "cloudevents" {
+				if output.CloudEvents.Mode == "" {
+					output.CloudEvents.Mode = "structured"
+				}
+				if output.CloudEvents.Type == "" {
+					output.CloudEvents.Type = "io.k8s.audit.event"
+				}
+			}
+		}
+		if output.Required == nil {
+			required := output.Type == "kafka"
+			output.Required = &required
+		}
+
+		// Kafka and syslog outputs have their own tls settings, rather
+		// than silently connecting without the ones in tls.
+		if (output.Type == "kafka" || output.Type == "syslog") && output.TLS != (TLSConfig{}) {
+			return fmt.Errorf("Output %s can't use tls, %s outputs use %s.tls instead", output.Name, output.Type, output.Type)
+		}
+
+		if output.Type == "kafka" {
+			if output.Kafka.Topic == "" {
+				output.Kafka.Topic = "k8s-audit"
+			}
+			if output.Kafka.Key == "" {
+				output.Kafka.Key = "namespace"
+			}
+			if output.Kafka.Acks == "" {
+				output.Kafka.Acks = "all"
+			}
+			if output.Kafka.Compression == "" {
+				output.Kafka.Compression = "none"
+			}
+		}
+
+		if output.Type == "splunk" {
+			if output.Splunk.Source == "" {
+				output.Splunk.Source = "stackdriver-webhook-bridge"
+			}
+			if output.Splunk.Sourcetype == "" {
+				output.Splunk.Sourcetype = "kube:apiserver-audit"
+			}
+			if output.Splunk.AckTimeout <= 0 {
+				output.Splunk.AckTimeout = 30 * time.Second
+			}
+			if output.Splunk.AckPollInterval <= 0 {
+				output.Splunk.AckPollInterval = 1 * time.Second
+			}
+		}
+
+		if output.Type == "elasticsearch" {
+			if output.Elasticsearch.Index == "" {
+				output.Elasticsearch.Index = `k8s-audit-{{ .Time.Format "2006.01.02" }}`
+			}
+			if output.Elasticsearch.TemplateName == "" {
+				output.Elasticsearch.TemplateName = "k8s-audit"
+			}
+		}
+
+		if output.Type == "otlp" {
+			if output.OTLP.Protocol == "" {
+				output.OTLP.Protocol = "http/protobuf"
+			}
+			if output.OTLP.Timeout <= 0 {
+				output.OTLP.Timeout = 10 * time.Second
+			}
+		}
+
+		if output.Type == "syslog" {
+			if output.Syslog.Format == "" {
+				output.Syslog.Format = "rfc5424"
+			}
+			if output.Syslog.Facility == "" {
+				output.Syslog.Facility = "local0"
+			}
+			if output.Syslog.AppName == "" {
+				output.Syslog.AppName = "stackdriver-webhook-bridge"
+			}
+		}
+
+		if output.Type == "archive" {
+			if output.Archive.Provider == "" {
+				output.Archive.Provider = "s3"
+			}
+			if output.Archive.Region == "" {
+				output.Archive.Region = "us-east-1"
+			}
+			if output.Archive.Format == "" {
+				output.Archive.Format = "jsonl"
+			}
+			if output.Archive.StagingDir == "" {
+				output.Archive.StagingDir = "/tmp/swb-archive"
+			}
+			if output.Archive.MaxFileSizeMB <= 0 {
+				output.Archive.MaxFileSizeMB = 64
+			}
+			if output.Archive.FlushInterval <= 0 {
+				output.Archive.FlushInterval = 5 * time.Minute
+			}
+			if output.Archive.UploadAttempts <= 0 {
+				output.Archive.UploadAttempts = 3
+			}
+		}
+
+		if output.Type == "pubsub" {
+			if output.PubSub.Topic == "" {
+				output.PubSub.Topic = "k8s-audit"
+			}
+			if output.PubSub.OrderingKey == "" {
+				output.PubSub.OrderingKey = "cluster"
+			}
+		}
+
+		if output.Type == "loki" && len(output.Loki.Labels) == 0 {
+			output.Loki.Labels = map[string]string{
+				"job":       "stackdriver-webhook-bridge",
+				"cluster":   "{{ .Cluster }}",
+				"namespace": "{{ .Namespace }}",
+			}
+		}
+	}
+
+	return nil
 }
 
 func (c *Config) LoadFile(configDir string) error {
@@ -104,14 +639,85 @@ func (c *Config) LoadFile(configDir string) error {
 		}
 	}
 
-	c.UpdateValues()
+	return c.UpdateValues()
+}
 
-	return nil
+// The names of settings and http headers whose values are not logged.
+var secretSettings = map[string]bool{
+	"password":          true,
+	"token":             true,
+	"bearer_token":      true,
+	"hmac_secret":       true,
+	"api_key":           true,
+	"secret_access_key": true,
 }
 
+var secretHeaders = []string{"auth", "token", "key", "secret", "password"}
+
+const redacted = "<redacted>"
+
+// LogSettings logs the current configuration, without the values of
+// secret settings.
 func (c *Config) LogSettings() {
 	log.Info("Current Configuration:")
 	for _, key := range c.vcfg.AllKeys() {
-		log.Infof(" %s: %v", key, c.vcfg.Get(key))
+		log.Infof(" %s: %v", key, redact(key, c.vcfg.Get(key)))
+	}
+}
+
+// redact returns the value of the setting with the provided key, with the
+// values of secret settings replaced, including those nested in maps and
+// lists like the outputs.
+func redact(key string, val interface{}) interface{} {
+
+	name := strings.ToLower(key[strings.LastIndex(key, ".")+1:])
+	if secretSettings[name] && val != "" {
+		return redacted
 	}
+
+	switch v := val.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = redactEntry(name, k, e)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[interface{}]interface{}, len(v))
+		for k, e := range v {
+			m[k] = redactEntry(name, fmt.Sprint(k), e)
+		}
+		return m
+	case map[string]string:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = redactEntry(name, k, e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = redact(key, e)
+		}
+		return l
+	}
+
+	return val
+}
+
+// redactEntry redacts an entry of the map of a setting, which are http
+// headers for the headers setting.
+func redactEntry(name string, key string, val interface{}) interface{} {
+
+	if name == "headers" {
+		lower := strings.ToLower(key)
+		for _, secret := range secretHeaders {
+			if strings.Contains(lower, secret) {
+				return redacted
+			}
+		}
+		return val
+	}
+
+	return redact(key, val)
 }
@@ -1,9 +1,14 @@
 package config_test
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	log "github.com/sirupsen/logrus"
 	pflag "github.com/spf13/pflag"
 
 	"github.com/stretchr/testify/assert"
@@ -21,11 +26,49 @@ func TestDefaultConfig(t *testing.T) {
 	assert.Equal(t, "", cfg.ClusterName)
 	assert.Equal(t, "", cfg.OutfileName)
 	assert.Equal(t, "", cfg.LogfileName)
+	assert.Equal(t, 100, cfg.RotateMaxSizeMB)
+	assert.Equal(t, time.Duration(0), cfg.RotateInterval)
+	assert.Equal(t, 5, cfg.RotateMaxBackups)
+	assert.Equal(t, time.Duration(0), cfg.RotateMaxAge)
+	assert.Equal(t, true, cfg.RotateCompress)
 	assert.Equal(t, 5*time.Second, cfg.PollInterval)
 	assert.Equal(t, 30*time.Second, cfg.LagInterval)
 	assert.Equal(t, 100, cfg.MaxAuditEventsBatch)
 	assert.Equal(t, "info", cfg.LogLevel)
 	assert.Equal(t, true, cfg.SupressObjectConversionErrors)
+	assert.Equal(t, []string{"activity"}, cfg.LogNames)
+	assert.Equal(t, false, cfg.GKEClusterEvents)
+	assert.Empty(t, cfg.ExtraFilters)
+	assert.Equal(t, false, cfg.RulesEnabled)
+	assert.Equal(t, "/opt/swb/rules/swb_rules.yaml", cfg.RulesFile)
+	assert.Equal(t, "debug", cfg.RulesMinPriority)
+	assert.Equal(t, "-", cfg.AlertsOutfileName)
+	assert.Equal(t, "", cfg.AlertsUrl)
+	assert.Equal(t, []config.OutputConfig{
+		{
+			Name:      "default",
+			Type:      "webhook",
+			Encoding:  "json",
+			Url:       "http://sysdig-agent.sysdig-agent.svc.cluster.local:7765/k8s_audit",
+			BatchSize: 100,
+			Workers:   1,
+			QueueSize: 10,
+			Ordering:  "object",
+			Retry: config.RetryConfig{
+				MaxAttempts:    1,
+				InitialBackoff: 1 * time.Second,
+				MaxBackoff:     30 * time.Second,
+			},
+			Required:             boolPtr(false),
+			Compression:          "none",
+			CompressionThreshold: 1024,
+			Auth: config.AuthConfig{
+				TokenRefreshInterval: 1 * time.Minute,
+				HMACSignatureHeader:  "X-Swb-Signature",
+				HMACTimestampHeader:  "X-Swb-Timestamp",
+			},
+		},
+	}, cfg.Outputs)
 }
 
 func TestConfigCommandLineArgsAllArgs(t *testing.T) {
@@ -116,10 +159,325 @@ func TestConfigFilePrecedence(t *testing.T) {
 	assert.Equal(t, "my-file-cluster", cfg.ClusterName)
 	assert.Equal(t, "my-file-outfile", cfg.OutfileName)
 	assert.Equal(t, "my-file-logfile", cfg.LogfileName)
+	assert.Equal(t, 50, cfg.RotateMaxSizeMB)
+	assert.Equal(t, 1*time.Hour, cfg.RotateInterval)
+	assert.Equal(t, 24, cfg.RotateMaxBackups)
+	assert.Equal(t, 72*time.Hour, cfg.RotateMaxAge)
+	assert.Equal(t, false, cfg.RotateCompress)
 	assert.Equal(t, 21*time.Second, cfg.PollInterval)
 	assert.Equal(t, 48*time.Second, cfg.LagInterval)
 	assert.Equal(t, 100, cfg.MaxAuditEventsBatch)
 	assert.Equal(t, "warning", cfg.LogLevel)
+	assert.Equal(t, []string{`NOT protoPayload.methodName:"leases"`}, cfg.ExtraFilters)
+	assert.Equal(t, []config.CelRule{{Name: "kube-system-reads", Expression: `event.verb in ["get", "list"]`}}, cfg.CelExcludes)
+	assert.Equal(t, []config.CelAnnotation{{Key: "swb.sysdig.com/namespace", Expression: "event.objectRef.namespace"}}, cfg.CelAnnotations)
+	assert.Equal(t, []config.OutputConfig{
+		{
+			Name:      "sysdig-agent",
+			Type:      "webhook",
+			Encoding:  "json",
+			Url:       "my-file-output-url",
+			BatchSize: 100,
+			Workers:   1,
+			QueueSize: 10,
+			Ordering:  "object",
+			Retry: config.RetryConfig{
+				MaxAttempts:    1,
+				InitialBackoff: 1 * time.Second,
+				MaxBackoff:     30 * time.Second,
+			},
+			Required:             boolPtr(false),
+			Compression:          "none",
+			CompressionThreshold: 1024,
+			Auth: config.AuthConfig{
+				TokenRefreshInterval: 1 * time.Minute,
+				HMACSignatureHeader:  "X-Swb-Signature",
+				HMACTimestampHeader:  "X-Swb-Timestamp",
+			},
+		},
+		{
+			Name:      "staging-falco",
+			Type:      "webhook",
+			Encoding:  "json",
+			Url:       "my-file-staging-url",
+			BatchSize: 10,
+			Workers:   1,
+			QueueSize: 10,
+			Ordering:  "object",
+			Headers:   map[string]string{"X-Environment": "staging", "Authorization": "Bearer my-header-token"},
+			Retry: config.RetryConfig{
+				MaxAttempts:    3,
+				InitialBackoff: 2 * time.Second,
+				MaxBackoff:     30 * time.Second,
+			},
+			RateLimit: config.RateLimitConfig{
+				EventsPerSecond: 50,
+				BurstEvents:     50,
+			},
+			CircuitBreaker: config.CircuitBreakerConfig{
+				FailureThreshold: 5,
+				OpenTimeout:      30 * time.Second,
+				SpoolDir:         "/var/spool/swb",
+				SpoolMaxSizeMB:   100,
+			},
+			Filter:               `event.objectRef.namespace == "staging"`,
+			Required:             boolPtr(false),
+			Compression:          "none",
+			CompressionThreshold: 1024,
+			Auth: config.AuthConfig{
+				TokenRefreshInterval: 1 * time.Minute,
+				HMACSignatureHeader:  "X-Swb-Signature",
+				HMACTimestampHeader:  "X-Swb-Timestamp",
+			},
+		},
+		{
+			Name:      "audit-kafka",
+			Type:      "kafka",
+			BatchSize: 100,
+			Workers:   1,
+			QueueSize: 10,
+			Ordering:  "object",
+			Retry: config.RetryConfig{
+				MaxAttempts:    1,
+				InitialBackoff: 1 * time.Second,
+				MaxBackoff:     30 * time.Second,
+			},
+			Required: boolPtr(true),
+			Kafka: config.KafkaConfig{
+				Brokers:     []string{"kafka-0:9092", "kafka-1:9092"},
+				Topic:       "k8s-audit-{{ .Cluster }}",
+				Key:         "namespace",
+				Acks:        "all",
+				Compression: "zstd",
+				Version:     "2.1.0",
+				TLS: config.TLSConfig{
+					Enabled: true,
+					CAFile:  "/etc/kafka/ca.crt",
+				},
+				SASL: config.SASLConfig{
+					Mechanism: "SCRAM-SHA-512",
+					User:      "swb",
+					Password:  "secret",
+				},
+			},
+		},
+		{
+			Name:      "audit-splunk",
+			Type:      "splunk",
+			Url:       "https://splunk:8088",
+			BatchSize: 100,
+			Workers:   1,
+			QueueSize: 10,
+			Ordering:  "object",
+			Retry: config.RetryConfig{
+				MaxAttempts:    1,
+				InitialBackoff: 1 * time.Second,
+				MaxBackoff:     30 * time.Second,
+			},
+			Required: boolPtr(false),
+			Splunk: config.SplunkConfig{
+				Token:           "my-token",
+				Index:           "k8s",
+				Source:          "stackdriver-webhook-bridge",
+				Sourcetype:      "kube:apiserver-audit",
+				Ack:             true,
+				AckTimeout:      30 * time.Second,
+				AckPollInterval: 1 * time.Second,
+			},
+		},
+		{
+			Name:      "audit-elasticsearch",
+			Type:      "elasticsearch",
+			Url:       "https://elasticsearch:9200",
+			BatchSize: 100,
+			Workers:   1,
+			QueueSize: 10,
+			Ordering:  "object",
+			Retry: config.RetryConfig{
+				MaxAttempts:    1,
+				InitialBackoff: 1 * time.Second,
+				MaxBackoff:     30 * time.Second,
+			},
+			Required: boolPtr(false),
+			Elasticsearch: config.ElasticsearchConfig{
+				Index:        `k8s-audit-{{ .Time.Format "2006.01.02" }}`,
+				Username:     "elastic",
+				Password:     "changeme",
+				TemplateName: "k8s-audit",
+			},
+		},
+		{
+			Name:      "audit-loki",
+			Type:      "loki",
+			Url:       "http://loki:3100",
+			BatchSize: 100,
+			Workers:   1,
+			QueueSize: 10,
+			Ordering:  "object",
+			Retry: config.RetryConfig{
+				MaxAttempts:    1,
+				InitialBackoff: 1 * time.Second,
+				MaxBackoff:     30 * time.Second,
+			},
+			Required: boolPtr(false),
+			Loki: config.LokiConfig{
+				Labels: map[string]string{
+					"job":       "stackdriver-webhook-bridge",
+					"cluster":   "{{ .Cluster }}",
+					"namespace": "{{ .Namespace }}",
+				},
+			},
+		},
+		{
+			Name:      "audit-otlp",
+			Type:      "otlp",
+			Url:       "otel-collector:4317",
+			BatchSize: 100,
+			Workers:   1,
+			QueueSize: 10,
+			Ordering:  "object",
+			Retry: config.RetryConfig{
+				MaxAttempts:    1,
+				InitialBackoff: 1 * time.Second,
+				MaxBackoff:     30 * time.Second,
+			},
+			Required: boolPtr(false),
+			OTLP: config.OTLPConfig{
+				Protocol:           "grpc",
+				Insecure:           true,
+				Timeout:            10 * time.Second,
+				ResourceAttributes: map[string]string{"deployment.environment": "production"},
+			},
+		},
+		{
+			Name:      "knative-broker",
+			Type:      "webhook",
+			Url:       "http://broker-ingress.knative-eventing.svc.cluster.local/default/default",
+			BatchSize: 100,
+			Workers:   1,
+			QueueSize: 10,
+			Ordering:  "object",
+			Retry: config.RetryConfig{
+				MaxAttempts:    1,
+				InitialBackoff: 1 * time.Second,
+				MaxBackoff:     30 * time.Second,
+			},
+			Required:             boolPtr(false),
+			Compression:          "none",
+			CompressionThreshold: 1024,
+			Auth: config.AuthConfig{
+				TokenRefreshInterval: 1 * time.Minute,
+				HMACSignatureHeader:  "X-Swb-Signature",
+				HMACTimestampHeader:  "X-Swb-Timestamp",
+			},
+			Encoding: "cloudevents",
+			CloudEvents: config.CloudEventsConfig{
+				Mode: "binary",
+				Type: "io.k8s.audit.event",
+			},
+		},
+		{
+			Name:      "audit-syslog",
+			Type:      "syslog",
+			Url:       "tls://syslog:6514",
+			BatchSize: 100,
+			Workers:   1,
+			QueueSize: 10,
+			Ordering:  "object",
+			Retry: config.RetryConfig{
+				MaxAttempts:    1,
+				InitialBackoff: 1 * time.Second,
+				MaxBackoff:     30 * time.Second,
+			},
+			Required: boolPtr(false),
+			Syslog: config.SyslogConfig{
+				Format:   "cef",
+				Facility: "local0",
+				AppName:  "stackdriver-webhook-bridge",
+			},
+		},
+		{
+			Name:      "audit-archive",
+			Type:      "archive",
+			BatchSize: 100,
+			Workers:   1,
+			QueueSize: 10,
+			Ordering:  "object",
+			Retry: config.RetryConfig{
+				MaxAttempts:    1,
+				InitialBackoff: 1 * time.Second,
+				MaxBackoff:     30 * time.Second,
+			},
+			Required: boolPtr(false),
+			Archive: config.ArchiveConfig{
+				Provider:       "s3",
+				Bucket:         "my-audit-archive",
+				Prefix:         "k8s-audit/",
+				Region:         "us-east-1",
+				Format:         "jsonl",
+				StagingDir:     "/tmp/swb-archive",
+				MaxFileSizeMB:  64,
+				FlushInterval:  5 * time.Minute,
+				UploadAttempts: 3,
+			},
+		},
+		{
+			Name:      "audit-pubsub",
+			Type:      "pubsub",
+			BatchSize: 100,
+			Workers:   1,
+			QueueSize: 10,
+			Ordering:  "object",
+			Retry: config.RetryConfig{
+				MaxAttempts:    1,
+				InitialBackoff: 1 * time.Second,
+				MaxBackoff:     30 * time.Second,
+			},
+			Required: boolPtr(false),
+			PubSub: config.PubSubConfig{
+				Project:     "my-pubsub-project",
+				Topic:       "k8s-audit",
+				OrderingKey: "cluster",
+			},
+		},
+	}, cfg.Outputs)
+}
+
+func TestLogSettingsRedactsSecrets(t *testing.T) {
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	cfg, err := config.New("./test", nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, cfg)
+
+	logged := buf.String()
+	assert.Contains(t, logged, "<redacted>")
+	assert.Contains(t, logged, "X-Environment:staging")
+	for _, secret := range []string{"password:secret", "my-token", "changeme", "my-header-token"} {
+		assert.NotContains(t, logged, secret)
+	}
+}
+
+func TestConfigUnusedTLS(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "swb-config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, outputType := range []string{"kafka", "syslog"} {
+		content := "outputs:\n" +
+			"  - name: audit-" + outputType + "\n" +
+			"    type: " + outputType + "\n" +
+			"    tls:\n" +
+			"      ca_file: /etc/swb/ca.crt\n"
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "swb-config.yaml"), []byte(content), 0644))
+
+		_, err = config.New(dir, nil)
+		assert.NotNil(t, err, outputType)
+	}
 }
 
 func TestConfigFileNoFile(t *testing.T) {
@@ -177,3 +535,7 @@ func TestConfigCmdlinePrecedence(t *testing.T) {
 	assert.Equal(t, 100, cfg.MaxAuditEventsBatch)
 	assert.Equal(t, "warning", cfg.LogLevel)
 }
+
+func boolPtr(b bool) *bool {
+	return &b
+}
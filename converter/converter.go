@@ -22,6 +22,43 @@ import (
 
 const ObjectReferenceErrorPrefix = "Could not create ObjectReference from resource name"
 
+// The short names of the k8s audit logs written to stackdriver. The full
+// log name is projects/<project>/logs/cloudaudit.googleapis.com%2F<name>.
+const (
+	ActivityLog    = "activity"
+	DataAccessLog  = "data_access"
+	SystemEventLog = "system_event"
+)
+
+var AuditLogNames = []string{ActivityLog, DataAccessLog, SystemEventLog}
+
+// IsAuditLogName returns true if the provided short name is one of
+// AuditLogNames.
+func IsAuditLogName(name string) bool {
+	for _, n := range AuditLogNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditLogName returns the short name of the audit log (activity,
+// data_access, system_event) from the full log name of a log entry, or
+// "" if the entry is not from an audit log.
+func AuditLogName(logName string) string {
+	// The log name is url-encoded in filters, but not always in log entries
+	logName = strings.Replace(logName, "%2F", "/", -1)
+
+	prefix := "cloudaudit.googleapis.com/"
+	idx := strings.LastIndex(logName, prefix)
+	if idx < 0 {
+		return ""
+	}
+
+	return logName[idx+len(prefix):]
+}
+
 func ConvertLogEntrytoAuditEvent(logEntry *logging.Entry, auditPayload *audit.AuditLog) (*auditv1.Event, error) {
 
 	m := &jsonpb.Marshaler{}
@@ -121,6 +158,23 @@ func ConvertLogEntrytoAuditEvent(logEntry *logging.Entry, auditPayload *audit.Au
 		stage = "ResponseComplete"
 	}
 
+	// Entries from the data_access and system_event logs generally only
+	// contain metadata about the request, so report them with the
+	// Metadata level when there is no request or response.
+	logName := AuditLogName(logEntry.LogName)
+	if logName != "" && logName != ActivityLog &&
+		auditPayload.GetRequest() == nil && auditPayload.GetResponse() == nil {
+		level = "Metadata"
+	}
+
+	// System events are not initiated by a user, so there may be no
+	// authentication info or caller ip.
+	callerIp := auditPayload.GetRequestMetadata().GetCallerIp()
+	sourceIPs := []string{callerIp}
+	if callerIp == "" && logName == SystemEventLog {
+		sourceIPs = nil
+	}
+
 	auditEvent := &auditv1.Event{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Event",
@@ -133,10 +187,10 @@ func ConvertLogEntrytoAuditEvent(logEntry *logging.Entry, auditPayload *audit.Au
 		RequestURI: auditPayload.ResourceName,
 		Verb:       verb,
 		User: authv1.UserInfo{
-			Username: auditPayload.AuthenticationInfo.PrincipalEmail,
+			Username: auditPayload.GetAuthenticationInfo().GetPrincipalEmail(),
 		},
-		SourceIPs:                []string{auditPayload.RequestMetadata.CallerIp},
-		UserAgent:                auditPayload.RequestMetadata.CallerSuppliedUserAgent,
+		SourceIPs:                sourceIPs,
+		UserAgent:                auditPayload.GetRequestMetadata().GetCallerSuppliedUserAgent(),
 		ResponseStatus:           status,
 		RequestReceivedTimestamp: timestampMicro,
 		StageTimestamp:           timestampMicro,
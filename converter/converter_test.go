@@ -52,9 +52,9 @@ func TestConversions(t *testing.T) {
 		}
 
 		t.Logf("Log Event: %+v", &entry)
-		t.Logf("Audit Payload: %+v", auditPayload)
+		t.Logf("Audit Payload: %+v", &auditPayload)
 
-		actualAuditEvent, err := converter.ConvertLogEntrytoAuditEvent(entry.Entry, &auditPayload)
+		actualAuditEvent, err := converter.ConvertLogEntry(entry.Entry, &auditPayload)
 		if err != nil {
 			t.Fatalf("Could not convert log entry to audit object: %v", err)
 		}
@@ -87,3 +87,10 @@ func TestConversions(t *testing.T) {
 	}
 
 }
+
+func TestAuditLogName(t *testing.T) {
+	assert.Equal(t, "activity", converter.AuditLogName("projects/my-project/logs/cloudaudit.googleapis.com/activity"))
+	assert.Equal(t, "data_access", converter.AuditLogName("projects/my-project/logs/cloudaudit.googleapis.com%2Fdata_access"))
+	assert.Equal(t, "system_event", converter.AuditLogName("projects/my-project/logs/cloudaudit.googleapis.com%2Fsystem_event"))
+	assert.Equal(t, "", converter.AuditLogName("projects/my-project/logs/stdout"))
+}
@@ -0,0 +1,254 @@
+package converter
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"cloud.google.com/go/logging"
+	"github.com/golang/protobuf/jsonpb"
+	"google.golang.org/genproto/googleapis/cloud/audit"
+	"google.golang.org/grpc/codes"
+
+	authv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	K8sClusterResourceType = "k8s_cluster"
+	GKEClusterResourceType = "gke_cluster"
+
+	// The api group used in the object reference of audit events created
+	// from gke_cluster log entries.
+	GKEClusterAPIGroup = "container.googleapis.com"
+
+	// The annotation containing the full method name of a gke_cluster log
+	// entry, e.g. google.container.v1.ClusterManager.SetLegacyAbac
+	GKEMethodNameAnnotation = "container.googleapis.com/method-name"
+
+	// The annotation containing the location (zone or region) of the
+	// cluster.
+	GKELocationAnnotation = "container.googleapis.com/location"
+)
+
+// ConvertLogEntry converts a k8s_cluster or gke_cluster log entry to an
+// audit event, depending on the resource type of the entry.
+func ConvertLogEntry(logEntry *logging.Entry, auditPayload *audit.AuditLog) (*auditv1.Event, error) {
+	if logEntry.Resource != nil && logEntry.Resource.Type == GKEClusterResourceType {
+		return ConvertGKEClusterLogEntryToAuditEvent(logEntry, auditPayload)
+	}
+
+	return ConvertLogEntrytoAuditEvent(logEntry, auditPayload)
+}
+
+// ConvertGKEClusterLogEntryToAuditEvent creates a synthetic audit event
+// from a gke_cluster log entry (cluster and node pool operations performed
+// through container.googleapis.com):
+//
+//   - The object reference has the api group container.googleapis.com, the
+//     version from the method name, and resource clusters or nodePools.
+//   - Create/Delete/Get/List/Update methods become the corresponding verbs.
+//     All other methods (e.g. SetLegacyAbac) become the verb update with a
+//     subresource named after the method (e.g. setLegacyAbac).
+//   - The response status is derived from the status of the log entry.
+func ConvertGKEClusterLogEntryToAuditEvent(logEntry *logging.Entry, auditPayload *audit.AuditLog) (*auditv1.Event, error) {
+
+	m := &jsonpb.Marshaler{}
+
+	log.Debugf("In ConvertGKEClusterLogEntryToAuditEvent()")
+	log.Tracef("Will try to convert: logEntry=%+v, auditPayload=%+v\n", logEntry, auditPayload)
+
+	// e.g. google.container.v1.ClusterManager.SetLegacyAbac
+	methodNameParts := strings.Split(auditPayload.MethodName, ".")
+	if len(methodNameParts) < 2 {
+		return nil, fmt.Errorf("Could not parse method name %s", auditPayload.MethodName)
+	}
+
+	method := methodNameParts[len(methodNameParts)-1]
+
+	apiVersion := ""
+	if len(methodNameParts) >= 4 {
+		apiVersion = methodNameParts[len(methodNameParts)-3]
+	}
+
+	// e.g. projects/<project>/zones/<zone>/clusters/<cluster>/nodePools/<pool>
+	resourceNameParts := strings.Split(auditPayload.ResourceName, "/")
+
+	var location string
+	objectRef := &auditv1.ObjectReference{
+		APIGroup:   GKEClusterAPIGroup,
+		APIVersion: apiVersion,
+	}
+
+	for i := 0; i+1 < len(resourceNameParts); i += 2 {
+		switch resourceNameParts[i] {
+		case "zones", "locations":
+			location = resourceNameParts[i+1]
+		case "clusters", "nodePools":
+			objectRef.Resource = resourceNameParts[i]
+			objectRef.Name = resourceNameParts[i+1]
+		}
+	}
+
+	if objectRef.Resource == "" {
+		return nil, fmt.Errorf("%s %s", ObjectReferenceErrorPrefix, auditPayload.ResourceName)
+	}
+
+	verb := "update"
+	for _, prefix := range []string{"Create", "Delete", "Get", "List", "Update"} {
+		if strings.HasPrefix(method, prefix) {
+			verb = strings.ToLower(prefix)
+			break
+		}
+	}
+
+	if verb == "update" && !strings.HasPrefix(method, "Update") {
+		objectRef.Subresource = lowerFirst(method)
+	}
+
+	// Long running operations are logged twice, once when they start and
+	// once when they complete.
+	stage := auditv1.Stage("ResponseComplete")
+	if logEntry.Operation != nil && !logEntry.Operation.Last {
+		stage = "ResponseStarted"
+	}
+
+	level := auditv1.Level("Metadata")
+	if auditPayload.GetRequest() != nil || auditPayload.GetResponse() != nil {
+		level = "RequestResponse"
+	}
+
+	annotations := map[string]string{}
+	for key, val := range logEntry.Labels {
+		annotations[key] = val
+	}
+	annotations[GKEMethodNameAnnotation] = auditPayload.MethodName
+	if location != "" {
+		annotations[GKELocationAnnotation] = location
+	}
+
+	timestampMicro := metav1.NewMicroTime(logEntry.Timestamp)
+
+	auditEvent := &auditv1.Event{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Event",
+			APIVersion: "audit.k8s.io/v1beta1",
+		},
+		Level:      level,
+		AuditID:    types.UID(logEntry.InsertID),
+		ObjectRef:  objectRef,
+		Stage:      stage,
+		RequestURI: auditPayload.ResourceName,
+		Verb:       verb,
+		User: authv1.UserInfo{
+			Username: auditPayload.GetAuthenticationInfo().GetPrincipalEmail(),
+		},
+		SourceIPs:                []string{auditPayload.GetRequestMetadata().GetCallerIp()},
+		UserAgent:                auditPayload.GetRequestMetadata().GetCallerSuppliedUserAgent(),
+		ResponseStatus:           gkeResponseStatus(auditPayload, verb),
+		RequestReceivedTimestamp: timestampMicro,
+		StageTimestamp:           timestampMicro,
+		Annotations:              annotations,
+	}
+
+	if auditPayload.GetRequest() != nil {
+		var request runtime.Unknown
+
+		requestJSON, err := m.MarshalToString(auditPayload.GetRequest())
+		if err != nil {
+			return nil, fmt.Errorf("Could not convert protobuf request to json")
+		}
+
+		err = request.UnmarshalJSON([]byte(requestJSON))
+		if err != nil {
+			return nil, fmt.Errorf("Could not serialize protobuf request json")
+		}
+
+		auditEvent.RequestObject = &request
+	}
+
+	if auditPayload.GetResponse() != nil {
+		var response runtime.Unknown
+
+		responseJSON, err := m.MarshalToString(auditPayload.GetResponse())
+		if err != nil {
+			return nil, fmt.Errorf("Could not convert protobuf response to json")
+		}
+
+		err = response.UnmarshalJSON([]byte(responseJSON))
+		if err != nil {
+			return nil, fmt.Errorf("Could not serialize protobuf response json")
+		}
+
+		auditEvent.ResponseObject = &response
+	}
+
+	return auditEvent, nil
+}
+
+// gkeResponseStatus maps the (grpc) status of a gke_cluster log entry to
+// a http-style status.
+func gkeResponseStatus(auditPayload *audit.AuditLog, verb string) *metav1.Status {
+
+	code := codes.Code(auditPayload.GetStatus().GetCode())
+
+	if code == codes.OK {
+		if verb == "create" {
+			return &metav1.Status{
+				Status:  "Created (inferred)",
+				Code:    201,
+				Message: "Created (inferred)",
+			}
+		}
+
+		return &metav1.Status{
+			Status:  "OK (inferred)",
+			Code:    200,
+			Message: "OK (inferred)",
+		}
+	}
+
+	httpCodes := map[codes.Code]int32{
+		codes.Canceled:           499,
+		codes.InvalidArgument:    400,
+		codes.DeadlineExceeded:   504,
+		codes.NotFound:           404,
+		codes.AlreadyExists:      409,
+		codes.PermissionDenied:   403,
+		codes.ResourceExhausted:  429,
+		codes.FailedPrecondition: 400,
+		codes.Aborted:            409,
+		codes.OutOfRange:         400,
+		codes.Unimplemented:      501,
+		codes.Unavailable:        503,
+		codes.Unauthenticated:    401,
+	}
+
+	httpCode, ok := httpCodes[code]
+	if !ok {
+		httpCode = 500
+	}
+
+	return &metav1.Status{
+		Status:  "Failure",
+		Code:    httpCode,
+		Reason:  metav1.StatusReason(code.String()),
+		Message: auditPayload.GetStatus().GetMessage(),
+	}
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+
+	r := []rune(s)
+	r[0] = unicode.ToLower(r[0])
+
+	return string(r)
+}
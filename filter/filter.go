@@ -0,0 +1,306 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"google.golang.org/genproto/googleapis/cloud/audit"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+)
+
+// Expressions can refer to the converted k8s audit event as "event" and
+// to the original stackdriver audit payload as "log". Both are exposed as
+// maps using their json field names (e.g. event.objectRef.namespace,
+// log.authenticationInfo.principalEmail).
+const (
+	EventVar = "event"
+	LogVar   = "log"
+)
+
+var variableDecls = []*exprpb.Decl{
+	decls.NewIdent(EventVar, decls.NewMapType(decls.String, decls.Dyn), nil),
+	decls.NewIdent(LogVar, decls.NewMapType(decls.String, decls.Dyn), nil),
+}
+
+// Expression is a compiled CEL expression.
+type Expression struct {
+	Name   string
+	Source string
+	prg    cel.Program
+}
+
+// Compile parses and type checks the provided expression, making sure
+// that it evaluates to the provided type (or to a dynamic value that
+// can only be checked at evaluation time).
+func Compile(name string, source string, resultType *exprpb.Type) (*Expression, error) {
+	return CompileWithDecls(name, source, resultType, variableDecls...)
+}
+
+// CompileWithDecls is like Compile, but the expression can refer to the
+// provided variables instead of "event" and "log".
+func CompileWithDecls(name string, source string, resultType *exprpb.Type, vars ...*exprpb.Decl) (*Expression, error) {
+	if source == "" {
+		return nil, fmt.Errorf("Expression %q is empty", name)
+	}
+
+	env, err := cel.NewEnv(cel.Declarations(vars...))
+	if err != nil {
+		return nil, fmt.Errorf("Could not create CEL environment: %v", err)
+	}
+
+	parsed, iss := env.Parse(source)
+	if iss != nil && iss.Err() != nil {
+		return nil, fmt.Errorf("Could not parse expression %q: %v", name, iss.Err())
+	}
+
+	checked, iss := env.Check(parsed)
+	if iss != nil && iss.Err() != nil {
+		return nil, fmt.Errorf("Could not check expression %q: %v", name, iss.Err())
+	}
+
+	if resultType != nil &&
+		!typeEqual(checked.ResultType(), resultType) &&
+		!typeEqual(checked.ResultType(), decls.Dyn) {
+		return nil, fmt.Errorf("Expression %q must evaluate to %v, not %v", name, resultType, checked.ResultType())
+	}
+
+	prg, err := env.Program(checked)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create program for expression %q: %v", name, err)
+	}
+
+	return &Expression{
+		Name:   name,
+		Source: source,
+		prg:    prg,
+	}, nil
+}
+
+func typeEqual(a *exprpb.Type, b *exprpb.Type) bool {
+	return a.String() == b.String()
+}
+
+// Eval evaluates the expression against the provided variables.
+func (e *Expression) Eval(vars map[string]interface{}) (interface{}, error) {
+	val, _, err := e.prg.Eval(vars)
+	if err != nil {
+		return nil, fmt.Errorf("Could not evaluate expression %q: %v", e.Name, err)
+	}
+
+	return val.Value(), nil
+}
+
+// EvalBool evaluates an expression that should return a boolean.
+func (e *Expression) EvalBool(vars map[string]interface{}) (bool, error) {
+	val, err := e.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+
+	b, ok := val.(bool)
+	if !ok {
+		return false, fmt.Errorf("Expression %q returned %T, not bool", e.Name, val)
+	}
+
+	return b, nil
+}
+
+// EvalString evaluates an expression that should return a string.
+func (e *Expression) EvalString(vars map[string]interface{}) (string, error) {
+	val, err := e.Eval(vars)
+	if err != nil {
+		return "", err
+	}
+
+	s, ok := val.(string)
+	if !ok {
+		return "", fmt.Errorf("Expression %q returned %T, not string", e.Name, val)
+	}
+
+	return s, nil
+}
+
+// Variables returns the variables that expressions can refer to for
+// the provided audit event and (optional) audit payload.
+func Variables(auditEvent *auditv1.Event, auditPayload *audit.AuditLog) (map[string]interface{}, error) {
+
+	eventJSON, err := json.Marshal(auditEvent)
+	if err != nil {
+		return nil, fmt.Errorf("Could not serialize audit event: %v", err)
+	}
+
+	eventMap, err := ToMap(eventJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	logMap := map[string]interface{}{}
+
+	if auditPayload != nil {
+		m := &jsonpb.Marshaler{}
+		logJSON, err := m.MarshalToString(auditPayload)
+		if err != nil {
+			return nil, fmt.Errorf("Could not serialize audit payload: %v", err)
+		}
+
+		logMap, err = ToMap([]byte(logJSON))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return map[string]interface{}{
+		EventVar: eventMap,
+		LogVar:   logMap,
+	}, nil
+}
+
+// ToMap decodes a json object into a map. Integral numbers are decoded
+// as int64 instead of float64 so that expressions like
+// "event.responseStatus.code >= 400" work as expected.
+func ToMap(data []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		return nil, fmt.Errorf("Could not decode json object: %v", err)
+	}
+
+	return normalize(obj).(map[string]interface{}), nil
+}
+
+func normalize(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = normalize(elem)
+		}
+		return v
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = normalize(elem)
+		}
+		return v
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	default:
+		return v
+	}
+}
+
+type annotation struct {
+	key  string
+	expr *Expression
+}
+
+// Filter drops audit events matching any of the configured exclude
+// expressions and adds annotations to the remaining ones.
+type Filter struct {
+	excludes    []*Expression
+	annotations []annotation
+}
+
+func New(excludes []config.CelRule, annotations []config.CelAnnotation) (*Filter, error) {
+
+	f := &Filter{}
+
+	for i, rule := range excludes {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("exclude[%d]", i)
+		}
+
+		expr, err := Compile(name, rule.Expression, decls.Bool)
+		if err != nil {
+			return nil, err
+		}
+
+		f.excludes = append(f.excludes, expr)
+	}
+
+	for _, a := range annotations {
+		if a.Key == "" {
+			return nil, fmt.Errorf("Annotation with expression %q has no key", a.Expression)
+		}
+
+		expr, err := Compile(a.Key, a.Expression, decls.String)
+		if err != nil {
+			return nil, err
+		}
+
+		f.annotations = append(f.annotations, annotation{key: a.Key, expr: expr})
+	}
+
+	return f, nil
+}
+
+// Empty returns true if there are no expressions to evaluate.
+func (f *Filter) Empty() bool {
+	return len(f.excludes) == 0 && len(f.annotations) == 0
+}
+
+// Apply evaluates the filter against the audit event. It returns false
+// if the event should be dropped. Annotations are added to the event in
+// place. If an expression can not be evaluated, the event is kept and
+// the error is returned.
+func (f *Filter) Apply(auditEvent *auditv1.Event, auditPayload *audit.AuditLog) (bool, error) {
+
+	if f.Empty() {
+		return true, nil
+	}
+
+	vars, err := Variables(auditEvent, auditPayload)
+	if err != nil {
+		return true, err
+	}
+
+	var evalErr error
+
+	for _, expr := range f.excludes {
+		exclude, err := expr.EvalBool(vars)
+		if err != nil {
+			evalErr = err
+			continue
+		}
+		if exclude {
+			return false, nil
+		}
+	}
+
+	// The converter shares the log entry labels with the audit event,
+	// so don't modify them in place.
+	annotations := map[string]string{}
+	for key, val := range auditEvent.Annotations {
+		annotations[key] = val
+	}
+
+	for _, a := range f.annotations {
+		val, err := a.expr.EvalString(vars)
+		if err != nil {
+			evalErr = err
+			continue
+		}
+		if val == "" {
+			continue
+		}
+		annotations[a.key] = val
+	}
+
+	if len(annotations) > 0 {
+		auditEvent.Annotations = annotations
+	}
+
+	return true, evalErr
+}
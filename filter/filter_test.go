@@ -0,0 +1,133 @@
+package filter_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/filter"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/model"
+	"google.golang.org/genproto/googleapis/cloud/audit"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const testFilesDir = "../converter/test_files"
+
+func loadTestEvent(t *testing.T, name string) (*auditv1.Event, *audit.AuditLog) {
+
+	content, err := ioutil.ReadFile(path.Join(testFilesDir, "log_entries", name))
+	if err != nil {
+		t.Fatalf("Could not read log entry file %s: %v", name, err)
+	}
+
+	var entry model.SavedLoggingEntry
+	if err := json.Unmarshal(content, &entry); err != nil {
+		t.Fatalf("Could not decode log entry as json: %v", err)
+	}
+
+	var auditPayload audit.AuditLog
+	if err := jsonpb.UnmarshalString(entry.AuditPayload, &auditPayload); err != nil {
+		t.Fatalf("Could not decode audit payload: %v", err)
+	}
+
+	content, err = ioutil.ReadFile(path.Join(testFilesDir, "k8s_audit_events", name))
+	if err != nil {
+		t.Fatalf("Could not read audit event file %s: %v", name, err)
+	}
+
+	var auditEvent auditv1.Event
+	if err := json.Unmarshal(content, &auditEvent); err != nil {
+		t.Fatalf("Could not decode audit event as json: %v", err)
+	}
+
+	return &auditEvent, &auditPayload
+}
+
+func TestExclude(t *testing.T) {
+
+	f, err := filter.New([]config.CelRule{
+		{
+			Name:       "configmap-reads-and-deletes",
+			Expression: `event.verb in ["get", "list", "delete"] && event.objectRef.resource == "configmaps" && event.responseStatus.code < 400`,
+		},
+	}, nil)
+	assert.Nil(t, err)
+
+	deleteEvent, deletePayload := loadTestEvent(t, "delete_configmap.json")
+	keep, err := f.Apply(deleteEvent, deletePayload)
+	assert.Nil(t, err)
+	assert.False(t, keep)
+
+	createEvent, createPayload := loadTestEvent(t, "create_configmap.json")
+	keep, err = f.Apply(createEvent, createPayload)
+	assert.Nil(t, err)
+	assert.True(t, keep)
+}
+
+func TestExcludeAuditPayload(t *testing.T) {
+
+	f, err := filter.New([]config.CelRule{
+		{
+			Expression: `log.authenticationInfo.principalEmail.endsWith("@sysdig.com")`,
+		},
+	}, nil)
+	assert.Nil(t, err)
+
+	auditEvent, auditPayload := loadTestEvent(t, "create_configmap.json")
+	keep, err := f.Apply(auditEvent, auditPayload)
+	assert.Nil(t, err)
+	assert.False(t, keep)
+}
+
+func TestAnnotations(t *testing.T) {
+
+	f, err := filter.New(nil, []config.CelAnnotation{
+		{
+			Key:        "swb.sysdig.com/namespace",
+			Expression: `has(event.objectRef.namespace) ? event.objectRef.namespace : ""`,
+		},
+		{
+			Key:        "swb.sysdig.com/failed",
+			Expression: `event.responseStatus.code >= 400 ? "true" : ""`,
+		},
+	})
+	assert.Nil(t, err)
+
+	auditEvent, auditPayload := loadTestEvent(t, "create_configmap.json")
+	keep, err := f.Apply(auditEvent, auditPayload)
+	assert.Nil(t, err)
+	assert.True(t, keep)
+	assert.Equal(t, "default", auditEvent.Annotations["swb.sysdig.com/namespace"])
+	assert.Equal(t, "allow", auditEvent.Annotations["authorization.k8s.io/decision"])
+	assert.NotContains(t, auditEvent.Annotations, "swb.sysdig.com/failed")
+
+	auditEvent, auditPayload = loadTestEvent(t, "create_clusterrole.json")
+	_, err = f.Apply(auditEvent, auditPayload)
+	assert.Nil(t, err)
+	assert.NotContains(t, auditEvent.Annotations, "swb.sysdig.com/namespace")
+}
+
+func TestCompileErrors(t *testing.T) {
+
+	_, err := filter.New([]config.CelRule{{Name: "bad-syntax", Expression: `event.verb ==`}}, nil)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "bad-syntax")
+
+	_, err = filter.New([]config.CelRule{{Name: "unknown-var", Expression: `evt.verb == "get"`}}, nil)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unknown-var")
+
+	_, err = filter.New([]config.CelRule{{Name: "not-bool", Expression: `"get"`}}, nil)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "not-bool")
+
+	_, err = filter.New(nil, []config.CelAnnotation{{Key: "not-string", Expression: `1 + 1`}})
+	assert.NotNil(t, err)
+
+	_, err = filter.New(nil, []config.CelAnnotation{{Expression: `"no key"`}})
+	assert.NotNil(t, err)
+}
@@ -1,21 +1,30 @@
 module github.com/sysdiglabs/stackdriver-webhook-bridge
 
-go 1.13
+go 1.14
 
 require (
 	cloud.google.com/go/logging v1.0.0
+	github.com/Shopify/sarama v1.26.4
 	github.com/go-chi/chi v4.1.2+incompatible
 	github.com/gogo/protobuf v1.2.2-0.20190723190241-65acae22fc9d
-	github.com/golang/protobuf v1.3.2
+	github.com/golang/protobuf v1.5.2
+	github.com/google/cel-go v0.3.2
+	github.com/klauspost/compress v1.9.8
 	github.com/prometheus/client_golang v1.0.0
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.7.0
-	github.com/stretchr/testify v1.4.0
-	google.golang.org/api v0.13.0
-	google.golang.org/appengine v1.6.1
-	google.golang.org/genproto v0.0.0-20191108220845-16a3f7862a1a
-	gopkg.in/yaml.v2 v2.2.4
+	github.com/stretchr/testify v1.7.0
+	github.com/xdg/scram v0.0.0-20180814205039-7eeb5667e42c
+	go.opentelemetry.io/proto/otlp v0.19.0
+	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
+	golang.org/x/oauth2 v0.0.0-20211104180415-d3ed0bb246c8
+	google.golang.org/api v0.30.0
+	google.golang.org/appengine v1.6.6
+	google.golang.org/genproto v0.0.0-20211118181313-81c1377c94b1
+	google.golang.org/grpc v1.42.0
+	google.golang.org/protobuf v1.27.1
+	gopkg.in/yaml.v2 v2.2.8
 	k8s.io/api v0.17.0
 	k8s.io/apimachinery v0.17.0
 	k8s.io/apiserver v0.17.0
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
@@ -20,11 +21,19 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func StartHealthServer(port int) {
+func StartHealthServer(port int, pollr *poller.Poller) {
 	router := chi.NewRouter()
 	router.Get("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("ready"))
 	})
+	// The circuit breaker state of each output. Unavailable outputs don't
+	// make the bridge itself unhealthy, so this always returns 200.
+	router.Get("/health/outputs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"circuit_breakers": pollr.CircuitBreakerStates(),
+		})
+	})
 	hostPort := fmt.Sprintf(":%d", port)
 	log.Infof("Starting health server on %s...", hostPort)
 
@@ -84,8 +93,6 @@ func main() {
 		log.Fatalf("Could not create poller: %v", err)
 	}
 
-	defer pollr.Close()
-
 	curTime := time.Now().UTC().Add(-2 * cfg.LagInterval)
 
 	loopChan := make(chan string)
@@ -96,8 +103,19 @@ func main() {
 		loopChan <- "exit"
 	}()
 
+	// Reopen the log/audit event files on SIGHUP, for external log
+	// rotation.
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			log.Infof("Received SIGHUP, reopening files")
+			pollr.Reopen()
+		}
+	}()
+
 	go prometheus.ExposeMetricsEndpoint(cfg.PrometheusPort)
-	go StartHealthServer(cfg.ApiPort)
+	go StartHealthServer(cfg.ApiPort, pollr)
 
 	for {
 		curTime = pollr.PollLogsSendEvents(curTime)
@@ -113,6 +131,10 @@ func main() {
 		}
 	}
 
+	// Sends the events still queued in the outputs. os.Exit doesn't run
+	// deferred calls.
+	pollr.Close()
+
 	log.Infof("Done.")
 
 	os.Exit(0)
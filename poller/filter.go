@@ -0,0 +1,205 @@
+package poller
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"cloud.google.com/go/logging/logadmin"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/converter"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// validateFilterClause does some basic sanity checking of a user-supplied
+// Cloud Logging filter clause, so it can be safely combined with the
+// filter built by the bridge. The logging api does the actual parsing,
+// see validateFilter.
+func validateFilterClause(clause string) error {
+
+	if strings.TrimSpace(clause) == "" {
+		return fmt.Errorf("Filter clause is empty")
+	}
+
+	depth := 0
+	inQuote := false
+	var word strings.Builder
+
+	runes := []rune(clause)
+
+	// Words are field paths or unquoted values. Only a comparison of the
+	// top-level timestamp field is rejected, fields like
+	// protoPayload.request.timestamp are fine.
+	checkWord := func(next int) error {
+		if word.String() == "timestamp" && isComparison(runes, next) {
+			return fmt.Errorf("Filter clause %q may not compare timestamp, the bridge manages the time window itself", clause)
+		}
+		word.Reset()
+		return nil
+	}
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		if inQuote {
+			switch r {
+			case '\\':
+				i++
+			case '"':
+				inQuote = false
+			}
+			continue
+		}
+
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' {
+			word.WriteRune(r)
+			continue
+		}
+
+		if err := checkWord(i); err != nil {
+			return err
+		}
+
+		switch r {
+		case '"':
+			inQuote = true
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("Filter clause %q has unbalanced parentheses", clause)
+			}
+		}
+	}
+
+	if err := checkWord(len(runes)); err != nil {
+		return err
+	}
+
+	if inQuote {
+		return fmt.Errorf("Filter clause %q has an unterminated string", clause)
+	}
+
+	if depth != 0 {
+		return fmt.Errorf("Filter clause %q has unbalanced parentheses", clause)
+	}
+
+	return nil
+}
+
+// isComparison returns whether the clause continues with a comparison
+// operator at the provided index, ignoring whitespace.
+func isComparison(runes []rune, i int) bool {
+
+	for i < len(runes) && unicode.IsSpace(runes[i]) {
+		i++
+	}
+
+	return i < len(runes) && strings.ContainsRune("=!<>:", runes[i])
+}
+
+// buildFilter returns the Cloud Logging filter used to read the entries
+// of the provided audit logs and resource types for the cluster between
+// the provided times. Each extra clause is wrapped in parentheses so it
+// can only narrow the set of entries returned.
+func buildFilter(project string, cluster string, logNames []string, resourceTypes []string, extraClauses []string, start time.Time, end time.Time) string {
+
+	var fullLogNames []string
+	for _, logName := range logNames {
+		fullLogNames = append(fullLogNames, fmt.Sprintf("projects/%s/logs/cloudaudit.googleapis.com%%2F%s", project, logName))
+	}
+
+	filter := anyOf("logName", fullLogNames) + " AND " +
+		anyOf("resource.type", resourceTypes) + " AND " +
+		fmt.Sprintf("resource.labels.cluster_name=\"%s\"", cluster)
+
+	for _, clause := range extraClauses {
+		filter += fmt.Sprintf(" AND (%s)", clause)
+	}
+
+	filter += fmt.Sprintf(" AND timestamp >= \"%s\" AND timestamp <= \"%s\"",
+		start.Format(time.RFC3339), end.Format(time.RFC3339))
+
+	return filter
+}
+
+// anyOf returns a filter clause matching any of the provided values for
+// the field.
+func anyOf(field string, values []string) string {
+
+	var clauses []string
+	for _, value := range values {
+		clauses = append(clauses, fmt.Sprintf("%s=\"%s\"", field, value))
+	}
+
+	if len(clauses) == 1 {
+		return clauses[0]
+	}
+
+	return "(" + strings.Join(clauses, " OR ") + ")"
+}
+
+// resourceTypes returns the log entry resource types read by the bridge.
+func (p *Poller) resourceTypes() []string {
+
+	resourceTypes := []string{converter.K8sClusterResourceType}
+
+	if p.cfg.GKEClusterEvents {
+		resourceTypes = append(resourceTypes, converter.GKEClusterResourceType)
+	}
+
+	return resourceTypes
+}
+
+// validateFilter checks the configured log names and extra filter
+// clauses. The clauses are checked first locally and then by asking the
+// logging api to run a query with the complete filter over a small time
+// window.
+func (p *Poller) validateFilter() error {
+
+	if len(p.cfg.LogNames) == 0 {
+		return fmt.Errorf("No log names configured, must be one or more of %v", converter.AuditLogNames)
+	}
+
+	for _, logName := range p.cfg.LogNames {
+		if !converter.IsAuditLogName(logName) {
+			return fmt.Errorf("Unknown log name %q, must be one of %v", logName, converter.AuditLogNames)
+		}
+	}
+
+	for _, clause := range p.cfg.ExtraFilters {
+		if err := validateFilterClause(clause); err != nil {
+			return err
+		}
+	}
+
+	if len(p.cfg.ExtraFilters) == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	filter := buildFilter(p.project, p.cluster, p.cfg.LogNames, p.resourceTypes(), p.cfg.ExtraFilters, now.Add(-1*time.Minute), now)
+
+	it := p.client.Entries(p.ctx, logadmin.Filter(filter))
+	_, err := it.Next()
+
+	if err == nil || err == iterator.Done {
+		return nil
+	}
+
+	if status.Code(err) == codes.InvalidArgument {
+		return fmt.Errorf("Invalid extra filter clauses, filter=%s: %v", filter, err)
+	}
+
+	// Other errors (permissions, network, etc) will show up again when
+	// polling, so don't prevent startup.
+	log.Warnf("Could not validate extra filter clauses with logging api: %v", err)
+
+	return nil
+}
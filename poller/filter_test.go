@@ -0,0 +1,74 @@
+package poller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateFilterClause(t *testing.T) {
+
+	valid := []string{
+		`NOT protoPayload.methodName:"leases"`,
+		`protoPayload.authenticationInfo.principalEmail!="system:kube-scheduler"`,
+		`(protoPayload.methodName:"pods" OR protoPayload.methodName:"secrets")`,
+		`protoPayload.resourceName:"a (quoted) \"timestamp\""`,
+		`labels.my_timestamp="x"`,
+		`protoPayload.request.timestamp>="2020-01-01T00:00:00Z"`,
+		`jsonPayload.timestamp : "2020"`,
+		`protoPayload.methodName=timestamp`,
+	}
+
+	for _, clause := range valid {
+		assert.Nil(t, validateFilterClause(clause), clause)
+	}
+
+	invalid := []string{
+		``,
+		`   `,
+		`protoPayload.methodName:"leases") OR (logName:"other"`,
+		`(protoPayload.methodName:"leases"`,
+		`protoPayload.methodName:"leases`,
+		`timestamp >= "2020-01-01T00:00:00Z"`,
+		`NOT (timestamp<"2020-01-01T00:00:00Z")`,
+		`timestamp:"2020"`,
+		`timestamp != "2020-01-01T00:00:00Z"`,
+	}
+
+	for _, clause := range invalid {
+		assert.NotNil(t, validateFilterClause(clause), clause)
+	}
+}
+
+func TestBuildFilter(t *testing.T) {
+
+	start := time.Date(2020, 1, 9, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Minute)
+
+	assert.Equal(t,
+		`logName="projects/my-project/logs/cloudaudit.googleapis.com%2Factivity" AND `+
+			`resource.type="k8s_cluster" AND resource.labels.cluster_name="my-cluster" AND `+
+			`timestamp >= "2020-01-09T00:00:00Z" AND timestamp <= "2020-01-09T00:01:00Z"`,
+		buildFilter("my-project", "my-cluster", []string{"activity"}, []string{"k8s_cluster"}, nil, start, end))
+
+	assert.Equal(t,
+		`logName="projects/my-project/logs/cloudaudit.googleapis.com%2Factivity" AND `+
+			`resource.type="k8s_cluster" AND resource.labels.cluster_name="my-cluster" AND `+
+			`(NOT protoPayload.methodName:"leases") AND (a OR b) AND `+
+			`timestamp >= "2020-01-09T00:00:00Z" AND timestamp <= "2020-01-09T00:01:00Z"`,
+		buildFilter("my-project", "my-cluster", []string{"activity"}, []string{"k8s_cluster"}, []string{`NOT protoPayload.methodName:"leases"`, `a OR b`}, start, end))
+
+	assert.Equal(t,
+		`(logName="projects/my-project/logs/cloudaudit.googleapis.com%2Factivity" OR `+
+			`logName="projects/my-project/logs/cloudaudit.googleapis.com%2Fdata_access") AND `+
+			`resource.type="k8s_cluster" AND resource.labels.cluster_name="my-cluster" AND `+
+			`timestamp >= "2020-01-09T00:00:00Z" AND timestamp <= "2020-01-09T00:01:00Z"`,
+		buildFilter("my-project", "my-cluster", []string{"activity", "data_access"}, []string{"k8s_cluster"}, nil, start, end))
+
+	assert.Equal(t,
+		`logName="projects/my-project/logs/cloudaudit.googleapis.com%2Factivity" AND `+
+			`(resource.type="k8s_cluster" OR resource.type="gke_cluster") AND resource.labels.cluster_name="my-cluster" AND `+
+			`timestamp >= "2020-01-09T00:00:00Z" AND timestamp <= "2020-01-09T00:01:00Z"`,
+		buildFilter("my-project", "my-cluster", []string{"activity"}, []string{"k8s_cluster", "gke_cluster"}, nil, start, end))
+}
@@ -7,16 +7,21 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
 	"strings"
+	"sync"
 	"time"
 
+	"cloud.google.com/go/logging"
 	"cloud.google.com/go/logging/logadmin"
 
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
 	"github.com/sysdiglabs/stackdriver-webhook-bridge/converter"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/filter"
 	"github.com/sysdiglabs/stackdriver-webhook-bridge/model"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/rotate"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/rules"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/sink"
 	"google.golang.org/api/iterator"
 	"google.golang.org/genproto/googleapis/cloud/audit"
 	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
@@ -24,6 +29,10 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// The number of audit events whose alerts can wait to be sent before
+// further alerts are dropped.
+const alertQueueSize = 1000
+
 type Poller struct {
 	ctx            context.Context
 	client         *logadmin.Client
@@ -32,9 +41,23 @@ type Poller struct {
 	project        string
 	cluster        string
 	marshaler      *jsonpb.Marshaler
-	logfile        *os.File
-	outfile        *os.File
+	filter         *filter.Filter
+	rules          *rules.RuleSet
+	alertSink      *rules.AlertSink
+	alerts         chan []*rules.Alert
+	alertsDone     chan struct{}
+	outputs        []*sink.Output
+	rawOutputs     []*sink.Output
+	logfile        *rotate.File
+	outfile        *rotate.File
 	numFetchErrors uint64
+
+	// handled holds the insert ids of the log entries read since the last
+	// poll that was not rewound. A rewound poll reads them again, but only
+	// delivers them to the required outputs in retry, which failed to
+	// deliver some of them.
+	handled map[string]bool
+	retry   map[*sink.Output]bool
 }
 
 func NewPoller(ctx context.Context, cfg *config.Config) (*Poller, error) {
@@ -47,6 +70,37 @@ func NewPoller(ctx context.Context, cfg *config.Config) (*Poller, error) {
 	}
 
 	var err error
+
+	p.filter, err = filter.New(cfg.CelExcludes, cfg.CelAnnotations)
+	if err != nil {
+		return nil, fmt.Errorf("Could not compile CEL expressions: %v", err)
+	}
+
+	if cfg.RulesEnabled {
+		minPriority, err := rules.ParsePriority(cfg.RulesMinPriority)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse rules min priority: %v", err)
+		}
+
+		p.rules, err = rules.Load(cfg.RulesFile, minPriority)
+		if err != nil {
+			return nil, err
+		}
+
+		p.alertSink, err = rules.NewAlertSink(cfg.AlertsOutfileName, cfg.AlertsUrl)
+		if err != nil {
+			return nil, fmt.Errorf("Could not create alert sink: %v", err)
+		}
+
+		// Alerts are sent in the background, so a slow alerts url does
+		// not hold up polling.
+		p.alerts = make(chan []*rules.Alert, alertQueueSize)
+		p.alertsDone = make(chan struct{})
+		go p.sendAlerts()
+
+		log.Infof("Loaded %d rules from %s", len(p.rules.Rules), cfg.RulesFile)
+	}
+
 	if cfg.ProjectId != "" {
 		log.Infof("Using project id from config: %s", cfg.ProjectId)
 		p.project = cfg.ProjectId
@@ -83,17 +137,39 @@ func NewPoller(ctx context.Context, cfg *config.Config) (*Poller, error) {
 
 	if cfg.LogfileName != "" {
 		log.Infof("Will append log entries to: %s", cfg.LogfileName)
-		p.logfile, err = os.OpenFile(cfg.LogfileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		p.logfile, err = rotate.Open(cfg.LogfileName, rotateOptions(cfg))
 		if err != nil {
-			return nil, fmt.Errorf("Could not open %s for writing: %v", cfg.LogfileName, err)
+			return nil, err
 		}
 	}
 
 	if cfg.OutfileName != "" {
 		log.Infof("Will append audit events to: %s", cfg.OutfileName)
-		p.outfile, err = os.OpenFile(cfg.OutfileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		p.outfile, err = rotate.Open(cfg.OutfileName, rotateOptions(cfg))
 		if err != nil {
-			return nil, fmt.Errorf("Could not open %s for writing: %v", cfg.OutfileName, err)
+			return nil, err
+		}
+	}
+
+	source := sink.Source{
+		Project: p.project,
+		Cluster: p.cluster,
+	}
+
+	for _, outputCfg := range cfg.Outputs {
+		s, err := sink.New(outputCfg, source)
+		if err != nil {
+			return nil, fmt.Errorf("Could not create output %s: %v", outputCfg.Name, err)
+		}
+
+		output, err := sink.NewOutput(outputCfg, s)
+		if err != nil {
+			return nil, fmt.Errorf("Could not create output %s: %v", outputCfg.Name, err)
+		}
+
+		p.outputs = append(p.outputs, output)
+		if output.RawEntries() {
+			p.rawOutputs = append(p.rawOutputs, output)
 		}
 	}
 
@@ -102,8 +178,16 @@ func NewPoller(ctx context.Context, cfg *config.Config) (*Poller, error) {
 		return nil, fmt.Errorf("Could not create log reader: %v", err)
 	}
 
+	if err := p.validateFilter(); err != nil {
+		return nil, err
+	}
+
 	log.Infof("Will read events from project id: %s", p.project)
-	log.Infof("Will post events to webhook: %s", cfg.Url)
+	log.Infof("Will read events from audit logs: %v", cfg.LogNames)
+	log.Infof("Will read events for resource types: %v", p.resourceTypes())
+	for _, outputCfg := range cfg.Outputs {
+		log.Infof("Will send events to output %s: type=%s url=%s", outputCfg.Name, outputCfg.Type, outputCfg.Url)
+	}
 
 	return p, nil
 }
@@ -140,57 +224,127 @@ func (p *Poller) Close() {
 	if err := p.client.Close(); err != nil {
 		log.Errorf("Could not close log reader: %v", err)
 	}
+
+	if p.alertSink != nil {
+		close(p.alerts)
+		<-p.alertsDone
+		p.alertSink.Close()
+	}
+
+	for _, output := range p.outputs {
+		output.Close()
+	}
+
+	for _, file := range []*rotate.File{p.logfile, p.outfile} {
+		if file != nil {
+			if err := file.Close(); err != nil {
+				log.Errorf("Could not close file: %v", err)
+			}
+		}
+	}
 }
 
-func (p *Poller) sendAuditEventsBatch(auditEvents []*auditv1.Event) error {
+// Reopen reopens the log and audit event files, e.g. on SIGHUP after
+// they were moved away by logrotate.
+func (p *Poller) Reopen() {
 
-	auditEventsJSON, err := json.Marshal(auditEvents)
-	if err != nil {
-		return fmt.Errorf("Could not serialize audit events to JSON: %v", err)
+	for _, file := range []*rotate.File{p.logfile, p.outfile} {
+		if file != nil {
+			if err := file.Reopen(); err != nil {
+				log.Errorf("Could not reopen file: %v", err)
+			}
+		}
 	}
+}
 
-	req, err := http.NewRequest("POST", p.cfg.Url, bytes.NewBuffer(auditEventsJSON))
+// CircuitBreakerStates returns the state of the circuit breaker of each
+// output, by output name.
+func (p *Poller) CircuitBreakerStates() map[string]string {
 
-	if err != nil {
-		return fmt.Errorf("Could not construct http request to %s: %v", p.cfg.Url, err)
+	states := map[string]string{}
+	for _, output := range p.outputs {
+		states[output.Name] = output.CircuitBreakerState()
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	return states
+}
 
-	resp, err := p.httpClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("Could not POST audit events to %s: %v", p.cfg.Url, err)
+func rotateOptions(cfg *config.Config) rotate.Options {
+	return rotate.Options{
+		MaxSize:    int64(cfg.RotateMaxSizeMB) * 1024 * 1024,
+		Interval:   cfg.RotateInterval,
+		MaxBackups: cfg.RotateMaxBackups,
+		MaxAge:     cfg.RotateMaxAge,
+		Compress:   cfg.RotateCompress,
 	}
-	defer resp.Body.Close()
+}
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	log.Debugf("response from post: status=%s body=%s:", resp.Status, string(body))
+// deliver calls the provided function for the outputs. Required outputs
+// are called concurrently and waited for, since the poller must not
+// advance past events they could not deliver. Other outputs only queue
+// the events for their workers, so a slow or failing output does not hold
+// up the poller or the others, and report their results asynchronously
+// with a later call. It returns the required outputs that failed to
+// deliver some events.
+func (p *Poller) deliver(outputs []*sink.Output, f func(output *sink.Output) (int, int)) []*sink.Output {
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	totalSent, totalFailed := 0, 0
+	var failedOutputs []*sink.Output
+
+	record := func(output *sink.Output, sent int, failed int) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		totalSent += sent
+		totalFailed += failed
+		if failed > 0 && output.Required() {
+			log.Warnf("Required output %s could not deliver %d events", output.Name, failed)
+			failedOutputs = append(failedOutputs, output)
+		}
+	}
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("Non-200 response %s from POST of audit events: %s", resp.Status, string(body))
+	for _, output := range outputs {
+		if !output.Required() {
+			continue
+		}
+
+		wg.Add(1)
+		go func(output *sink.Output) {
+			defer wg.Done()
+
+			sent, failed := f(output)
+			record(output, sent, failed)
+		}(output)
+	}
+
+	for _, output := range outputs {
+		if !output.Required() {
+			sent, failed := f(output)
+			record(output, sent, failed)
+		}
 	}
-	log.Infof("Forwarded %d events", len(auditEvents))
 
-	return nil
+	wg.Wait()
+
+	promAuditEventOut.Add(float64(totalSent))
+	promAuditEventSendError.Add(float64(totalFailed))
+
+	return failedOutputs
 }
 
 func (p *Poller) PollLogsSendEvents(curTime time.Time) time.Time {
 
-	timeStr := curTime.Format(time.RFC3339)
+	startTime := curTime
+
 	lagTime := time.Now().UTC().Add(-1 * p.cfg.LagInterval)
-	lagStr := lagTime.Format(time.RFC3339)
-	filter := fmt.Sprintf("logName=\"projects/%s/logs/cloudaudit.googleapis.com%%2Factivity\" AND "+
-		"resource.type=\"k8s_cluster\" AND resource.labels.cluster_name=\"%s\" AND "+
-		"timestamp >= \"%s\" AND timestamp <= \"%s\"", p.project, p.cluster, timeStr, lagStr)
+	filter := buildFilter(p.project, p.cluster, p.cfg.LogNames, p.resourceTypes(), p.cfg.ExtraFilters, curTime, lagTime)
 
 	it := p.client.Entries(p.ctx, logadmin.Filter(filter))
 
 	log.Debugf("Fetching all logs between %v and %v, filter=%s...", curTime, lagTime, filter)
 
-	var entryStr []byte
-
-	var auditEvents []*auditv1.Event
-
 	for {
 		entry, err := it.Next()
 
@@ -227,102 +381,242 @@ func (p *Poller) PollLogsSendEvents(curTime time.Time) time.Time {
 			continue
 		}
 
-		promLogEntryIn.Inc()
-
 		curTime = entry.Timestamp
 
-		var auditPayload *audit.AuditLog
-		var ok bool
-		if auditPayload, ok = entry.Payload.(*audit.AuditLog); !ok {
-			promAuditPayloadExtractError.Inc()
-			log.Errorf("Could not extract payload as audit payload")
-			continue
+		if failed := p.handleEntry(entry); len(failed) > 0 {
+			return p.rewind(startTime, failed)
 		}
+	}
 
-		if p.logfile != nil {
-			auditStr, err := p.marshaler.MarshalToString(auditPayload)
+	return p.finishPoll(startTime, curTime)
+}
 
-			if err != nil {
-				log.Errorf("Could not serialize audit payload: %v", err)
-				continue
-			}
+// handleEntry converts the log entry and passes it to the logfile, rules,
+// outfile and outputs. It returns the required outputs that failed to
+// deliver it or earlier events.
+func (p *Poller) handleEntry(entry *logging.Entry) []*sink.Output {
 
-			savedLogEntry := &model.SavedLoggingEntry{
-				Entry:        entry,
-				AuditPayload: auditStr,
-			}
+	logName := converter.AuditLogName(entry.LogName)
+	promLogEntryIn.WithLabelValues(logName).Inc()
 
-			entryStr, err = json.Marshal(savedLogEntry)
-			if err != nil {
-				log.Errorf("Could not convert log entry to json string: %v", err)
-				continue
-			}
+	var auditPayload *audit.AuditLog
+	var ok bool
+	if auditPayload, ok = entry.Payload.(*audit.AuditLog); !ok {
+		promAuditPayloadExtractError.Inc()
+		log.Errorf("Could not extract payload as audit payload")
+		return nil
+	}
 
-			if p.logfile != nil {
-				log.Tracef("saving log entry string: %s", string(entryStr))
+	// A rewound poll reads the same entries again, which were already
+	// written to the logfile, raw entry outputs and outfile, evaluated
+	// against the rules and delivered to all outputs but the ones in
+	// retry.
+	handled := p.handled[entry.InsertID]
+	if p.handled == nil {
+		p.handled = make(map[string]bool)
+	}
+	p.handled[entry.InsertID] = true
 
-				entryStr = append(entryStr, '\n')
+	if !handled && (p.logfile != nil || len(p.rawOutputs) > 0) {
+		auditStr, err := p.marshaler.MarshalToString(auditPayload)
 
-				_, err = p.logfile.Write(entryStr)
-				if err != nil {
-					log.Errorf("Could not write log entry to file %s: %v", p.cfg.LogfileName, err)
-					continue
-				}
-			}
+		if err != nil {
+			log.Errorf("Could not serialize audit payload: %v", err)
+			return nil
 		}
 
-		auditEvent, err := converter.ConvertLogEntrytoAuditEvent(entry, auditPayload)
-		if err != nil {
-			promAuditPayloadConvertError.Inc()
-			if p.cfg.SupressObjectConversionErrors && strings.HasPrefix(err.Error(), converter.ObjectReferenceErrorPrefix) {
-				log.Debugf("Could not convert log entry to audit object: %v", err)
-			} else {
-				log.Errorf("Could not convert log entry to audit object: %v", err)
-			}
-			continue
+		savedLogEntry := &model.SavedLoggingEntry{
+			Entry:        entry,
+			AuditPayload: auditStr,
 		}
-		auditStr, err := json.Marshal(auditEvent)
+
+		entryStr, err := json.Marshal(savedLogEntry)
 		if err != nil {
-			promAuditEventMarshalError.Inc()
-			log.Errorf("Could not serialize audit object: %v", err)
-			continue
+			log.Errorf("Could not convert log entry to json string: %v", err)
+			return nil
 		}
-		log.Tracef("Got audit event: %s", string(auditStr))
 
-		if p.outfile != nil {
-			auditStr = append(auditStr, '\n')
-			_, err = p.outfile.Write(auditStr)
-			if err != nil {
-				log.Errorf("Could not write audit event to file %s: %v", p.cfg.OutfileName, err)
-				continue
-			}
+		for _, output := range p.rawOutputs {
+			output.AddRawEntry(entry.Timestamp, entryStr)
 		}
 
-		auditEvents = append(auditEvents, auditEvent)
+		if p.logfile != nil {
+			log.Tracef("saving log entry string: %s", string(entryStr))
 
-		if len(auditEvents) >= p.cfg.MaxAuditEventsBatch {
-			err = p.sendAuditEventsBatch(auditEvents)
+			entryStr = append(entryStr, '\n')
+
+			_, err = p.logfile.Write(entryStr)
 			if err != nil {
-				promAuditEventSendError.Add(float64(len(auditEvents)))
-				log.Errorf("Could not send batch of audit events: %v", err)
-				auditEvents = nil
-				continue
+				log.Errorf("Could not write log entry to file %s: %v", p.cfg.LogfileName, err)
+				return nil
 			}
-			promAuditEventOut.Add(float64(len(auditEvents)))
-			auditEvents = nil
 		}
 	}
 
-	if len(auditEvents) > 0 {
-		err := p.sendAuditEventsBatch(auditEvents)
+	auditEvent, err := converter.ConvertLogEntry(entry, auditPayload)
+	if err != nil {
+		promAuditPayloadConvertError.WithLabelValues(logName).Inc()
+		if p.cfg.SupressObjectConversionErrors && strings.HasPrefix(err.Error(), converter.ObjectReferenceErrorPrefix) {
+			log.Debugf("Could not convert log entry to audit object: %v", err)
+		} else {
+			log.Errorf("Could not convert log entry to audit object: %v", err)
+		}
+		return nil
+	}
+
+	keep, err := p.filter.Apply(auditEvent, auditPayload)
+	if err != nil {
+		promCelEvalError.Inc()
+		log.Warnf("Could not apply CEL expressions to audit event: %v", err)
+	}
+	if !keep {
+		promAuditEventFiltered.Inc()
+		log.Tracef("Dropping audit event %s matching CEL exclude expression", auditEvent.AuditID)
+		return nil
+	}
+
+	if p.rules != nil && !handled {
+		p.evaluateRules(auditEvent)
+	}
+
+	auditStr, err := json.Marshal(auditEvent)
+	if err != nil {
+		promAuditEventMarshalError.Inc()
+		log.Errorf("Could not serialize audit object: %v", err)
+		return nil
+	}
+	log.Tracef("Got audit event: %s", string(auditStr))
+
+	// Outputs use the size of the json for max_batch_bytes, including
+	// a separator.
+	size := len(auditStr) + 1
+
+	if p.outfile != nil && !handled {
+		auditStr = append(auditStr, '\n')
+		_, err = p.outfile.Write(auditStr)
 		if err != nil {
-			promAuditEventSendError.Add(float64(len(auditEvents)))
-			log.Errorf("Could not send batch of audit events: %v", err)
+			log.Errorf("Could not write audit event to file %s: %v", p.cfg.OutfileName, err)
+			return nil
 		}
+	}
+
+	outputs := p.outputs
+	if handled {
+		outputs = p.retryOutputs()
+	}
+
+	// Each output batches the events itself, according to its
+	// batch_size, max_batch_bytes and max_linger.
+	return p.deliver(outputs, func(output *sink.Output) (int, int) {
+		return output.AddEvent(auditEvent, size)
+	})
+}
+
+// finishPoll flushes the outputs at the end of a poll, and returns the
+// time the next poll starts from.
+func (p *Poller) finishPoll(startTime time.Time, curTime time.Time) time.Time {
+
+	failed := p.deliver(p.outputs, func(output *sink.Output) (int, int) {
+		return output.Flush()
+	})
 
-		promAuditEventOut.Add(float64(len(auditEvents)))
-		auditEvents = nil
+	if len(failed) > 0 {
+		return p.rewind(startTime, failed)
 	}
 
+	p.handled = nil
+	p.retry = nil
+
 	return curTime
 }
+
+// retryOutputs returns the outputs that get the entries of a rewound poll
+// again.
+func (p *Poller) retryOutputs() []*sink.Output {
+
+	var outputs []*sink.Output
+	for _, output := range p.outputs {
+		if p.retry[output] {
+			outputs = append(outputs, output)
+		}
+	}
+
+	return outputs
+}
+
+// rewind returns the time the current poll started from, so the next poll
+// reads the same log entries again. The failed required outputs drop
+// their queued events and get all the entries again. The other required
+// outputs send their queued events first, and like the other outputs,
+// only get the entries that were not read before. Outputs that failed in
+// an earlier rewound poll keep getting all entries, since they may not
+// have read all of them again.
+func (p *Poller) rewind(startTime time.Time, failed []*sink.Output) time.Time {
+
+	if p.retry == nil {
+		p.retry = make(map[*sink.Output]bool)
+	}
+	for _, output := range failed {
+		p.retry[output] = true
+	}
+
+	var others []*sink.Output
+	for _, output := range p.outputs {
+		if output.Required() && !p.retry[output] {
+			others = append(others, output)
+		}
+	}
+
+	for _, output := range p.deliver(others, func(output *sink.Output) (int, int) {
+		return output.Flush()
+	}) {
+		p.retry[output] = true
+	}
+
+	for _, output := range p.retryOutputs() {
+		output.Discard()
+	}
+
+	promPollRewind.Inc()
+	log.Warnf("Not all events could be delivered to required outputs, will read log entries after %v again", startTime)
+
+	return startTime
+}
+
+func (p *Poller) evaluateRules(auditEvent *auditv1.Event) {
+
+	alerts, err := p.rules.Evaluate(auditEvent)
+	if err != nil {
+		promRuleEvalError.Inc()
+		log.Debugf("Could not evaluate rules against audit event %s: %v", auditEvent.AuditID, err)
+	}
+
+	if len(alerts) == 0 {
+		return
+	}
+
+	for _, alert := range alerts {
+		promRuleAlert.WithLabelValues(alert.Rule, alert.Priority).Inc()
+	}
+
+	select {
+	case p.alerts <- alerts:
+	default:
+		promAlertSendError.Add(float64(len(alerts)))
+		log.Errorf("Alert queue is full, dropping %d alerts", len(alerts))
+	}
+}
+
+// sendAlerts sends the queued alerts to the alert sink until the queue
+// is closed.
+func (p *Poller) sendAlerts() {
+
+	defer close(p.alertsDone)
+
+	for alerts := range p.alerts {
+		if err := p.alertSink.Send(alerts); err != nil {
+			promAlertSendError.Add(float64(len(alerts)))
+			log.Errorf("Could not send alerts: %v", err)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package poller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/filter"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/model"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/rotate"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/sink"
+	"google.golang.org/genproto/googleapis/cloud/audit"
+	"k8s.io/apimachinery/pkg/types"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+// fakeSink records the ids of the sent events, failing the first sends
+// with errs.
+type fakeSink struct {
+	mutex sync.Mutex
+	ids   []types.UID
+	errs  []error
+}
+
+func (f *fakeSink) Send(auditEvents []*auditv1.Event) error {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return err
+	}
+
+	for _, auditEvent := range auditEvents {
+		f.ids = append(f.ids, auditEvent.AuditID)
+	}
+	return nil
+}
+
+func (f *fakeSink) Close() error {
+	return nil
+}
+
+// fakeRawSink also counts the raw log entries passed to it.
+type fakeRawSink struct {
+	fakeSink
+	raw int
+}
+
+func (f *fakeRawSink) SendRaw(timestamp time.Time, entryJSON []byte) error {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.raw++
+	return nil
+}
+
+func (f *fakeSink) sent() []types.UID {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]types.UID(nil), f.ids...)
+}
+
+// newTestOutput returns an output sending each event on its own. Required
+// outputs send them while they are added, other outputs queue them for
+// their worker.
+func newTestOutput(t *testing.T, name string, required bool, s sink.Sink) *sink.Output {
+
+	cfg := config.OutputConfig{
+		Name:      name,
+		Type:      "webhook",
+		BatchSize: 1,
+		Required:  &required,
+		Retry:     config.RetryConfig{MaxAttempts: 1},
+	}
+	if !required {
+		cfg.QueueSize = 10
+	}
+
+	output, err := sink.NewOutput(cfg, s)
+	assert.Nil(t, err)
+
+	return output
+}
+
+func newTestPoller(t *testing.T, outputs ...*sink.Output) *Poller {
+
+	f, err := filter.New(nil, nil)
+	assert.Nil(t, err)
+
+	return &Poller{
+		cfg:       &config.Config{},
+		marshaler: &jsonpb.Marshaler{},
+		filter:    f,
+		outputs:   outputs,
+	}
+}
+
+// testEntry returns a log entry of the converter test files with the
+// provided insert id, which is also the AuditID of its audit event.
+func testEntry(t *testing.T, insertID string) *logging.Entry {
+
+	content, err := ioutil.ReadFile("../converter/test_files/log_entries/create_configmap.json")
+	assert.Nil(t, err)
+
+	var saved model.SavedLoggingEntry
+	assert.Nil(t, json.Unmarshal(content, &saved))
+
+	auditPayload := &audit.AuditLog{}
+	assert.Nil(t, jsonpb.UnmarshalString(saved.AuditPayload, auditPayload))
+
+	entry := saved.Entry
+	entry.Payload = auditPayload
+	entry.InsertID = insertID
+	return entry
+}
+
+func TestDeliver(t *testing.T) {
+
+	failing := newTestOutput(t, "failing", true, &fakeSink{errs: []error{fmt.Errorf("unavailable")}})
+	rejecting := newTestOutput(t, "rejecting", true, &fakeSink{errs: []error{sink.Permanent(fmt.Errorf("bad request"))}})
+	other := newTestOutput(t, "other", false, &fakeSink{errs: []error{fmt.Errorf("unavailable")}})
+	p := newTestPoller(t, failing, rejecting, other)
+
+	// Only required outputs that could not deliver events fail, events
+	// rejected permanently would fail again.
+	failed := p.deliver(p.outputs, func(output *sink.Output) (int, int) {
+		return output.Add([]*auditv1.Event{{AuditID: "a"}})
+	})
+	assert.Equal(t, []*sink.Output{failing}, failed)
+
+	for _, output := range p.outputs {
+		output.Close()
+	}
+}
+
+func TestRewind(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "swb-poller")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	okSink := &fakeSink{}
+	failingSink := &fakeSink{errs: []error{fmt.Errorf("unavailable")}}
+	otherSink := &fakeSink{}
+
+	ok := newTestOutput(t, "ok", true, okSink)
+	failing := newTestOutput(t, "failing", true, failingSink)
+	other := newTestOutput(t, "other", false, otherSink)
+	p := newTestPoller(t, ok, failing, other)
+
+	rawSink := &fakeRawSink{}
+	raw, err := sink.NewOutput(config.OutputConfig{
+		Name:    "raw",
+		Type:    "archive",
+		Archive: config.ArchiveConfig{RawEntries: true},
+	}, rawSink)
+	assert.Nil(t, err)
+	assert.True(t, raw.RawEntries())
+	p.rawOutputs = []*sink.Output{raw}
+
+	p.cfg.LogfileName = filepath.Join(dir, "entries.log")
+	p.logfile, err = rotate.Open(p.cfg.LogfileName, rotate.Options{})
+	assert.Nil(t, err)
+
+	startTime := time.Date(2020, 1, 9, 0, 0, 0, 0, time.UTC)
+
+	// The failing output makes the poll rewind
+	failed := p.handleEntry(testEntry(t, "first"))
+	assert.Equal(t, []*sink.Output{failing}, failed)
+	assert.Equal(t, startTime, p.rewind(startTime, failed))
+
+	// Reading the entry again only delivers it to the failed output,
+	// new entries go to all outputs.
+	assert.Nil(t, p.handleEntry(testEntry(t, "first")))
+	assert.Nil(t, p.handleEntry(testEntry(t, "second")))
+
+	curTime := startTime.Add(time.Minute)
+	assert.Equal(t, curTime, p.finishPoll(startTime, curTime))
+	assert.Nil(t, p.handled)
+	assert.Nil(t, p.retry)
+
+	// After a successful poll, entries are delivered to all outputs again.
+	assert.Nil(t, p.handleEntry(testEntry(t, "first")))
+	assert.Equal(t, curTime, p.finishPoll(startTime, curTime))
+
+	for _, output := range p.outputs {
+		output.Close()
+	}
+	assert.Nil(t, p.logfile.Close())
+
+	assert.Equal(t, []types.UID{"first", "second", "first"}, okSink.sent())
+	assert.Equal(t, []types.UID{"first", "second", "first"}, failingSink.sent())
+	assert.Equal(t, []types.UID{"first", "second", "first"}, otherSink.sent())
+
+	// The rewound entry was only written to the logfile and archived once
+	content, err := ioutil.ReadFile(p.cfg.LogfileName)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(strings.Split(strings.TrimSpace(string(content)), "\n")))
+	assert.Equal(t, 3, rawSink.raw)
+}
+
+func TestRewindFlushesOtherOutputs(t *testing.T) {
+
+	okSink := &fakeSink{}
+	failingSink := &fakeSink{errs: []error{fmt.Errorf("unavailable"), fmt.Errorf("unavailable")}}
+
+	required := true
+	ok, err := sink.NewOutput(config.OutputConfig{
+		Name:      "ok",
+		Type:      "webhook",
+		BatchSize: 10,
+		Required:  &required,
+		Retry:     config.RetryConfig{MaxAttempts: 1},
+	}, okSink)
+	assert.Nil(t, err)
+	failing := newTestOutput(t, "failing", true, failingSink)
+	p := newTestPoller(t, ok, failing)
+
+	startTime := time.Date(2020, 1, 9, 0, 0, 0, 0, time.UTC)
+
+	// The batch of the other required output is sent instead of being
+	// discarded, so it doesn't get the entry again.
+	failed := p.handleEntry(testEntry(t, "first"))
+	assert.Equal(t, []*sink.Output{failing}, failed)
+	p.rewind(startTime, failed)
+	assert.Equal(t, []types.UID{"first"}, okSink.sent())
+
+	// An output that failed before keeps getting all entries while the
+	// poll is rewound.
+	failed = p.handleEntry(testEntry(t, "first"))
+	assert.Equal(t, []*sink.Output{failing}, failed)
+	p.rewind(startTime, failed)
+
+	assert.Nil(t, p.handleEntry(testEntry(t, "first")))
+	assert.Equal(t, startTime, p.finishPoll(startTime, startTime))
+
+	ok.Close()
+	failing.Close()
+
+	assert.Equal(t, []types.UID{"first"}, okSink.sent())
+	assert.Equal(t, []types.UID{"first"}, failingSink.sent())
+}
@@ -12,13 +12,22 @@ const (
 var (
 	promLogFetchError                         prometheus.Counter
 
-	promLogEntryIn                            prometheus.Counter
+	promLogEntryIn                            *prometheus.CounterVec
 	promAuditEventOut                         prometheus.Counter
 
 	promAuditPayloadExtractError              prometheus.Counter
-	promAuditPayloadConvertError              prometheus.Counter
+	promAuditPayloadConvertError              *prometheus.CounterVec
 	promAuditEventMarshalError                prometheus.Counter
 	promAuditEventSendError                   prometheus.Counter
+
+	promAuditEventFiltered                    prometheus.Counter
+	promCelEvalError                          prometheus.Counter
+
+	promRuleAlert                             *prometheus.CounterVec
+	promRuleEvalError                         prometheus.Counter
+	promAlertSendError                        prometheus.Counter
+
+	promPollRewind                            prometheus.Counter
 )
 
 func CreateMetrics() {
@@ -31,13 +40,14 @@ func CreateMetrics() {
 		},
 	)
 
-	promLogEntryIn = prometheus.NewCounter(
+	promLogEntryIn = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: namespace,
 			Subsystem: subsystem,
 			Name:      "log_entry_in",
-			Help:      "the number of log entries received",
+			Help:      "the number of log entries received, by audit log name",
 		},
+		[]string{"log_name"},
 	)
 
 	promAuditEventOut = prometheus.NewCounter(
@@ -58,13 +68,14 @@ func CreateMetrics() {
 		},
 	)
 
-	promAuditPayloadConvertError = prometheus.NewCounter(
+	promAuditPayloadConvertError = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: namespace,
 			Subsystem: subsystem,
 			Name:      "audit_payload_convert_error",
-			Help:      "the number of times the bridge had an error converting an audit payload to an audit event",
+			Help:      "the number of times the bridge had an error converting an audit payload to an audit event, by audit log name",
 		},
+		[]string{"log_name"},
 	)
 
 	promAuditEventMarshalError = prometheus.NewCounter(
@@ -85,6 +96,61 @@ func CreateMetrics() {
 		},
 	)
 
+	promAuditEventFiltered = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "audit_event_filtered",
+			Help:      "the number of audit events dropped by a CEL exclude expression",
+		},
+	)
+
+	promCelEvalError = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "cel_eval_error",
+			Help:      "the number of times the bridge had an error evaluating CEL expressions against an audit event",
+		},
+	)
+
+	promRuleAlert = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rule_alert",
+			Help:      "the number of alerts emitted by the rule engine, by rule and priority",
+		},
+		[]string{"rule", "priority"},
+	)
+
+	promRuleEvalError = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rule_eval_error",
+			Help:      "the number of times the bridge had an error evaluating rules against an audit event",
+		},
+	)
+
+	promAlertSendError = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "alert_send_error",
+			Help:      "the number of alerts that could not successfully be sent to the alert sink",
+		},
+	)
+
+	promPollRewind = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "poll_rewind",
+			Help:      "the number of polls whose log entries will be read again because a required output could not deliver them",
+		},
+	)
+
 	prometheus.MustRegister(promLogFetchError)
 	prometheus.MustRegister(promLogEntryIn)
 	prometheus.MustRegister(promAuditEventOut)
@@ -92,6 +158,12 @@ func CreateMetrics() {
 	prometheus.MustRegister(promAuditPayloadConvertError)
 	prometheus.MustRegister(promAuditEventMarshalError)
 	prometheus.MustRegister(promAuditEventSendError)
+	prometheus.MustRegister(promAuditEventFiltered)
+	prometheus.MustRegister(promCelEvalError)
+	prometheus.MustRegister(promRuleAlert)
+	prometheus.MustRegister(promRuleEvalError)
+	prometheus.MustRegister(promAlertSendError)
+	prometheus.MustRegister(promPollRewind)
 }
 
 func ResetMetrics() {
@@ -102,6 +174,12 @@ func ResetMetrics() {
 	prometheus.Unregister(promAuditPayloadConvertError)
 	prometheus.Unregister(promAuditEventMarshalError)
 	prometheus.Unregister(promAuditEventSendError)
+	prometheus.Unregister(promAuditEventFiltered)
+	prometheus.Unregister(promCelEvalError)
+	prometheus.Unregister(promRuleAlert)
+	prometheus.Unregister(promRuleEvalError)
+	prometheus.Unregister(promAlertSendError)
+	prometheus.Unregister(promPollRewind)
 }
 
 func init() {
@@ -0,0 +1,349 @@
+package rotate
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The timestamp added to the name of rotated files, e.g.
+// audit.json.20200517T100000.000
+const backupTimeFormat = "20060102T150405.000"
+
+// After an automatic rotation failed, the file is written to without
+// trying to rotate it again for this long.
+const rotateRetryInterval = time.Minute
+
+// Options control when a File is rotated and which rotated files are
+// kept. Zero values disable the corresponding setting.
+type Options struct {
+	// Rotate once the file would grow beyond this many bytes.
+	MaxSize int64
+
+	// Rotate once the file has been written to for this long.
+	Interval time.Duration
+
+	// Keep at most this many rotated files.
+	MaxBackups int
+
+	// Remove rotated files older than this.
+	MaxAge time.Duration
+
+	// Compress rotated files with gzip.
+	Compress bool
+}
+
+// File is a file that is appended to, and rotated based on its size
+// and/or age. Rotated files get a timestamp suffix, are optionally
+// compressed, and are removed based on their number and age.
+type File struct {
+	path string
+	opts Options
+
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+
+	// When an automatic rotation last failed.
+	rotateFailedAt time.Time
+
+	// Compression and removal of rotated files happens in the background.
+	cleanupMutex sync.Mutex
+	cleanupWg    sync.WaitGroup
+}
+
+// Open opens (or creates) the file for appending.
+func Open(path string, opts Options) (*File, error) {
+
+	f := &File{
+		path: path,
+		opts: opts,
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *File) open() error {
+
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Could not open %s for writing: %v", f.path, err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Could not stat %s: %v", f.path, err)
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = time.Now()
+
+	return nil
+}
+
+// Write appends p to the file, first rotating the file if needed. If the
+// file can't be rotated (e.g. because the directory is read-only), p is
+// still written to the current file, and rotating is tried again later.
+func (f *File) Write(p []byte) (int, error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return 0, fmt.Errorf("File %s is closed", f.path)
+	}
+
+	if f.needsRotate(int64(len(p))) && time.Since(f.rotateFailedAt) >= rotateRetryInterval {
+		if err := f.rotate(); err != nil {
+			f.rotateFailedAt = time.Now()
+			log.Errorf("Could not rotate %s, will keep writing to it and try again in %v: %v", f.path, rotateRetryInterval, err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+func (f *File) needsRotate(size int64) bool {
+
+	// Don't rotate an empty file, even if a single write is larger than
+	// the maximum size.
+	if f.size == 0 {
+		return false
+	}
+
+	if f.opts.MaxSize > 0 && f.size+size > f.opts.MaxSize {
+		return true
+	}
+
+	if f.opts.Interval > 0 && time.Since(f.openedAt) >= f.opts.Interval {
+		return true
+	}
+
+	return false
+}
+
+// Rotate rotates the file now.
+func (f *File) Rotate() error {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return fmt.Errorf("File %s is closed", f.path)
+	}
+
+	return f.rotate()
+}
+
+func (f *File) rotate() error {
+
+	// The file is renamed while it is still open, so that writes keep
+	// going to it if it can't be rotated.
+	backup := f.backupName(time.Now())
+	if err := os.Rename(f.path, backup); err != nil {
+		return fmt.Errorf("Could not rename %s to %s: %v", f.path, backup, err)
+	}
+
+	old := f.file
+	if err := f.open(); err != nil {
+		if renameErr := os.Rename(backup, f.path); renameErr != nil {
+			log.Errorf("Could not rename %s back to %s: %v", backup, f.path, renameErr)
+		}
+		return err
+	}
+
+	if err := old.Close(); err != nil {
+		log.Warnf("Could not close %s: %v", backup, err)
+	}
+
+	log.Debugf("Rotated %s to %s", f.path, backup)
+
+	f.cleanupWg.Add(1)
+	go func() {
+		defer f.cleanupWg.Done()
+		f.cleanup(backup)
+	}()
+
+	return nil
+}
+
+func (f *File) backupName(t time.Time) string {
+
+	name := f.path + "." + t.UTC().Format(backupTimeFormat)
+
+	// Rotating more than once within a millisecond
+	backup := name
+	for i := 1; ; i++ {
+		_, err := os.Stat(backup)
+		_, errGz := os.Stat(backup + ".gz")
+		if os.IsNotExist(err) && os.IsNotExist(errGz) {
+			return backup
+		}
+		backup = fmt.Sprintf("%s-%d", name, i)
+	}
+}
+
+// Reopen closes and reopens the file, e.g. after it was moved away by an
+// external tool like logrotate.
+func (f *File) Reopen() error {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file != nil {
+		if err := f.file.Close(); err != nil {
+			log.Warnf("Could not close %s: %v", f.path, err)
+		}
+		f.file = nil
+	}
+
+	return f.open()
+}
+
+// Close closes the file, and waits for the compression and removal of
+// rotated files to finish.
+func (f *File) Close() error {
+
+	f.mutex.Lock()
+	var err error
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+	}
+	f.mutex.Unlock()
+
+	f.cleanupWg.Wait()
+
+	return err
+}
+
+// cleanup compresses the rotated file and removes old rotated files.
+func (f *File) cleanup(backup string) {
+
+	f.cleanupMutex.Lock()
+	defer f.cleanupMutex.Unlock()
+
+	if f.opts.Compress {
+		if err := compress(backup); err != nil {
+			log.Errorf("Could not compress %s: %v", backup, err)
+		}
+	}
+
+	backups, err := f.backups()
+	if err != nil {
+		log.Errorf("Could not list rotated files of %s: %v", f.path, err)
+		return
+	}
+
+	cutoff := time.Now().Add(-f.opts.MaxAge)
+
+	for i, b := range backups {
+		tooMany := f.opts.MaxBackups > 0 && i >= f.opts.MaxBackups
+		tooOld := f.opts.MaxAge > 0 && b.time.Before(cutoff)
+
+		if tooMany || tooOld {
+			if err := os.Remove(b.path); err != nil {
+				log.Errorf("Could not remove rotated file %s: %v", b.path, err)
+			}
+		}
+	}
+}
+
+func compress(path string) error {
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+type backupFile struct {
+	path string
+	time time.Time
+}
+
+// backups returns the rotated files, newest first.
+func (f *File) backups() ([]backupFile, error) {
+
+	dir := filepath.Dir(f.path)
+	prefix := filepath.Base(f.path) + "."
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []backupFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		ts := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".gz")
+		if i := strings.Index(ts, "-"); i >= 0 {
+			ts = ts[:i]
+		}
+
+		t, err := time.Parse(backupTimeFormat, ts)
+		if err != nil {
+			continue
+		}
+
+		backups = append(backups, backupFile{path: filepath.Join(dir, name), time: t})
+	}
+
+	sort.SliceStable(backups, func(i, j int) bool {
+		if backups[i].time.Equal(backups[j].time) {
+			return backups[i].path > backups[j].path
+		}
+		return backups[i].time.After(backups[j].time)
+	})
+
+	return backups, nil
+}
@@ -0,0 +1,266 @@
+package rotate_test
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/rotate"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "rotate")
+	assert.Nil(t, err)
+	return dir
+}
+
+// rotatedFiles returns the names of the rotated files in dir, oldest
+// first.
+func rotatedFiles(t *testing.T, dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Name() != "audit.json" {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRotateSize(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.json")
+	file, err := rotate.Open(path, rotate.Options{MaxSize: 10})
+	assert.Nil(t, err)
+
+	_, err = file.Write([]byte("0123456789"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(rotatedFiles(t, dir)))
+
+	// Doesn't fit anymore
+	_, err = file.Write([]byte("abc"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	rotated := rotatedFiles(t, dir)
+	assert.Equal(t, 1, len(rotated))
+	assert.True(t, strings.HasPrefix(rotated[0], "audit.json."))
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, rotated[0]))
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789", string(content))
+
+	content, err = ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", string(content))
+}
+
+func TestRotateInterval(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.json")
+	file, err := rotate.Open(path, rotate.Options{Interval: 50 * time.Millisecond})
+	assert.Nil(t, err)
+
+	_, err = file.Write([]byte("first"))
+	assert.Nil(t, err)
+	_, err = file.Write([]byte("second"))
+	assert.Nil(t, err)
+
+	time.Sleep(60 * time.Millisecond)
+
+	_, err = file.Write([]byte("third"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	rotated := rotatedFiles(t, dir)
+	assert.Equal(t, 1, len(rotated))
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, rotated[0]))
+	assert.Nil(t, err)
+	assert.Equal(t, "firstsecond", string(content))
+}
+
+func TestRotateCompress(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.json")
+	file, err := rotate.Open(path, rotate.Options{Compress: true})
+	assert.Nil(t, err)
+
+	_, err = file.Write([]byte("some audit events"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Rotate())
+	assert.Nil(t, file.Close())
+
+	rotated := rotatedFiles(t, dir)
+	assert.Equal(t, 1, len(rotated))
+	assert.True(t, strings.HasSuffix(rotated[0], ".gz"))
+
+	f, err := os.Open(filepath.Join(dir, rotated[0]))
+	assert.Nil(t, err)
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+	content, err := ioutil.ReadAll(gz)
+	assert.Nil(t, err)
+	assert.Equal(t, "some audit events", string(content))
+}
+
+func TestRotateMaxBackups(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.json")
+	file, err := rotate.Open(path, rotate.Options{MaxBackups: 2})
+	assert.Nil(t, err)
+
+	for _, content := range []string{"one", "two", "three", "four"} {
+		_, err = file.Write([]byte(content))
+		assert.Nil(t, err)
+		assert.Nil(t, file.Rotate())
+	}
+	assert.Nil(t, file.Close())
+
+	rotated := rotatedFiles(t, dir)
+	assert.Equal(t, 2, len(rotated))
+
+	// The newest ones are kept
+	var contents []string
+	for _, name := range rotated {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		assert.Nil(t, err)
+		contents = append(contents, string(content))
+	}
+	sort.Strings(contents)
+	assert.Equal(t, []string{"four", "three"}, contents)
+}
+
+func TestRotateMaxAge(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.json")
+
+	// Rotated a week ago, and unrelated files
+	old := filepath.Join(dir, "audit.json.20200517T100000.000.gz")
+	assert.Nil(t, ioutil.WriteFile(old, []byte("old"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "audit.json.bak"), []byte("other"), 0644))
+
+	file, err := rotate.Open(path, rotate.Options{MaxAge: 24 * time.Hour})
+	assert.Nil(t, err)
+
+	_, err = file.Write([]byte("new"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Rotate())
+	assert.Nil(t, file.Close())
+
+	rotated := rotatedFiles(t, dir)
+	assert.Equal(t, 2, len(rotated))
+	assert.Equal(t, "audit.json.bak", rotated[1])
+	assert.NotEqual(t, filepath.Base(old), rotated[0])
+}
+
+func TestRotateRenameError(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.json")
+	file, err := rotate.Open(path, rotate.Options{})
+	assert.Nil(t, err)
+
+	_, err = file.Write([]byte("before"))
+	assert.Nil(t, err)
+
+	// Moved away without reopening, so it can't be renamed
+	assert.Nil(t, os.Rename(path, path+".1"))
+	assert.NotNil(t, file.Rotate())
+
+	// The file is still open
+	_, err = file.Write([]byte("after"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	content, err := ioutil.ReadFile(path + ".1")
+	assert.Nil(t, err)
+	assert.Equal(t, "beforeafter", string(content))
+}
+
+func TestRotateSizeRenameError(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.json")
+	file, err := rotate.Open(path, rotate.Options{MaxSize: 10})
+	assert.Nil(t, err)
+
+	_, err = file.Write([]byte("0123456789"))
+	assert.Nil(t, err)
+
+	// Moved away without reopening, so it can't be rotated when it is
+	// full. Writes still go to the current file.
+	assert.Nil(t, os.Rename(path, path+".1"))
+
+	_, err = file.Write([]byte("abc"))
+	assert.Nil(t, err)
+	_, err = file.Write([]byte("def"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	content, err := ioutil.ReadFile(path + ".1")
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789abcdef", string(content))
+}
+
+func TestReopen(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.json")
+	file, err := rotate.Open(path, rotate.Options{})
+	assert.Nil(t, err)
+
+	_, err = file.Write([]byte("before"))
+	assert.Nil(t, err)
+
+	// Moved away by e.g. logrotate
+	assert.Nil(t, os.Rename(path, path+".1"))
+	assert.Nil(t, file.Reopen())
+
+	_, err = file.Write([]byte("after"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	content, err := ioutil.ReadFile(path + ".1")
+	assert.Nil(t, err)
+	assert.Equal(t, "before", string(content))
+
+	content, err = ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "after", string(content))
+
+	_, err = file.Write([]byte("closed"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,105 @@
+package rules
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AlertSink writes alerts as json lines to a file (or stdout, if the
+// file name is "-") and/or posts each alert as a json object to a url,
+// like the http output of falco.
+type AlertSink struct {
+	outfileName string
+	outfile     *os.File
+	url         string
+	httpClient  *http.Client
+}
+
+func NewAlertSink(outfileName string, url string) (*AlertSink, error) {
+
+	s := &AlertSink{
+		outfileName: outfileName,
+		url:         url,
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if outfileName == "-" {
+		s.outfile = os.Stdout
+	} else if outfileName != "" {
+		var err error
+		s.outfile, err = os.OpenFile(outfileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Could not open %s for writing: %v", outfileName, err)
+		}
+	}
+
+	return s, nil
+}
+
+// Send writes/posts all alerts, returning the last error encountered.
+func (s *AlertSink) Send(alerts []*Alert) error {
+
+	var sendErr error
+
+	for _, alert := range alerts {
+		alertJSON, err := json.Marshal(alert)
+		if err != nil {
+			sendErr = fmt.Errorf("Could not serialize alert to JSON: %v", err)
+			continue
+		}
+
+		if s.outfile != nil {
+			if _, err := s.outfile.Write(append(alertJSON, '\n')); err != nil {
+				sendErr = fmt.Errorf("Could not write alert to file %s: %v", s.outfileName, err)
+			}
+		}
+
+		if s.url != "" {
+			if err := s.post(alertJSON); err != nil {
+				sendErr = err
+			}
+		}
+	}
+
+	return sendErr
+}
+
+func (s *AlertSink) post(alertJSON []byte) error {
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewBuffer(alertJSON))
+	if err != nil {
+		return fmt.Errorf("Could not construct http request to %s: %v", s.url, err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Could not POST alert to %s: %v", s.url, err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	log.Debugf("response from post: status=%s body=%s:", resp.Status, string(body))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Non-2xx response %s from POST of alert: %s", resp.Status, string(body))
+	}
+
+	return nil
+}
+
+func (s *AlertSink) Close() {
+	if s.outfile != nil && s.outfile != os.Stdout {
+		if err := s.outfile.Close(); err != nil {
+			log.Errorf("Could not close alerts file %s: %v", s.outfileName, err)
+		}
+	}
+}
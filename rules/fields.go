@@ -0,0 +1,252 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/filter"
+)
+
+// Conditions and outputs refer to the audit event using fields similar to
+// the ka.* fields of falco. Every field is always present (with an empty
+// value if not applicable to the event) so conditions don't fail with
+// missing keys:
+//
+//	ka.auditid, ka.stage, ka.verb, ka.uri, ka.useragent, ka.sourceips
+//	ka.user.name, ka.user.groups
+//	ka.auth.decision, ka.auth.reason
+//	ka.target.apigroup, ka.target.resource, ka.target.subresource,
+//	ka.target.namespace, ka.target.name
+//	ka.response.code, ka.response.reason
+//	ka.req.binding.role, ka.req.binding.subjects
+//	ka.req.pod.host_network, ka.req.pod.host_pid, ka.req.pod.host_ipc,
+//	ka.req.pod.containers (list of container objects)
+//	ka.req.role.rules (list of rule objects)
+//	ka.req.object, ka.resp.object (the full request/response objects)
+const FieldsVar = "ka"
+
+const missingValue = "<NA>"
+
+// Fields returns the ka map for the provided audit event.
+func Fields(auditEvent *auditv1.Event) (map[string]interface{}, error) {
+
+	reqObject := map[string]interface{}{}
+	if auditEvent.RequestObject != nil && len(auditEvent.RequestObject.Raw) > 0 {
+		var err error
+		reqObject, err = filter.ToMap(auditEvent.RequestObject.Raw)
+		if err != nil {
+			return nil, fmt.Errorf("Could not decode request object: %v", err)
+		}
+	}
+
+	respObject := map[string]interface{}{}
+	if auditEvent.ResponseObject != nil && len(auditEvent.ResponseObject.Raw) > 0 {
+		var err error
+		respObject, err = filter.ToMap(auditEvent.ResponseObject.Raw)
+		if err != nil {
+			return nil, fmt.Errorf("Could not decode response object: %v", err)
+		}
+	}
+
+	target := map[string]interface{}{
+		"apigroup":    "",
+		"resource":    "",
+		"subresource": "",
+		"namespace":   "",
+		"name":        "",
+	}
+	if ref := auditEvent.ObjectRef; ref != nil {
+		target["apigroup"] = ref.APIGroup
+		target["resource"] = ref.Resource
+		target["subresource"] = ref.Subresource
+		target["namespace"] = ref.Namespace
+		target["name"] = ref.Name
+	}
+
+	response := map[string]interface{}{
+		"code":   int64(0),
+		"reason": "",
+	}
+	if status := auditEvent.ResponseStatus; status != nil {
+		response["code"] = int64(status.Code)
+		response["reason"] = string(status.Reason)
+	}
+
+	groups := []interface{}{}
+	for _, group := range auditEvent.User.Groups {
+		groups = append(groups, group)
+	}
+
+	sourceIPs := []interface{}{}
+	for _, ip := range auditEvent.SourceIPs {
+		sourceIPs = append(sourceIPs, ip)
+	}
+
+	return map[string]interface{}{
+		"auditid":   string(auditEvent.AuditID),
+		"stage":     string(auditEvent.Stage),
+		"verb":      auditEvent.Verb,
+		"uri":       auditEvent.RequestURI,
+		"useragent": auditEvent.UserAgent,
+		"sourceips": sourceIPs,
+		"user": map[string]interface{}{
+			"name":   auditEvent.User.Username,
+			"groups": groups,
+		},
+		"auth": map[string]interface{}{
+			"decision": auditEvent.Annotations["authorization.k8s.io/decision"],
+			"reason":   auditEvent.Annotations["authorization.k8s.io/reason"],
+		},
+		"target":   target,
+		"response": response,
+		"req": map[string]interface{}{
+			"binding": bindingFields(reqObject),
+			"pod":     podFields(reqObject),
+			"role":    roleFields(reqObject),
+			"object":  reqObject,
+		},
+		"resp": map[string]interface{}{
+			"object": respObject,
+		},
+	}, nil
+}
+
+func bindingFields(obj map[string]interface{}) map[string]interface{} {
+
+	subjects := []interface{}{}
+	for _, subject := range listAt(obj, "subjects") {
+		if s, ok := subject.(map[string]interface{}); ok {
+			subjects = append(subjects, stringAt(s, "name"))
+		}
+	}
+
+	return map[string]interface{}{
+		"role":     stringAt(obj, "roleRef", "name"),
+		"subjects": subjects,
+	}
+}
+
+func podFields(obj map[string]interface{}) map[string]interface{} {
+
+	fields := map[string]interface{}{
+		"host_network": false,
+		"host_pid":     false,
+		"host_ipc":     false,
+		"containers":   []interface{}{},
+	}
+
+	if stringAt(obj, "kind") != "Pod" {
+		return fields
+	}
+
+	fields["host_network"] = boolAt(obj, "spec", "hostNetwork")
+	fields["host_pid"] = boolAt(obj, "spec", "hostPID")
+	fields["host_ipc"] = boolAt(obj, "spec", "hostIPC")
+	fields["containers"] = listAt(obj, "spec", "containers")
+
+	return fields
+}
+
+func roleFields(obj map[string]interface{}) map[string]interface{} {
+
+	// Make sure every rule has all the list fields, so conditions like
+	// ka.req.role.rules.exists(r, "*" in r.resources) work for rules that
+	// only have nonResourceURLs.
+	rules := []interface{}{}
+	kind := stringAt(obj, "kind")
+	if kind == "Role" || kind == "ClusterRole" {
+		for _, rule := range listAt(obj, "rules") {
+			r, ok := rule.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			normalized := map[string]interface{}{}
+			for _, key := range []string{"apiGroups", "resources", "resourceNames", "verbs", "nonResourceURLs"} {
+				normalized[key] = listAt(r, key)
+			}
+			rules = append(rules, normalized)
+		}
+	}
+
+	return map[string]interface{}{
+		"rules": rules,
+	}
+}
+
+func valueAt(obj map[string]interface{}, path ...string) interface{} {
+	var cur interface{} = obj
+	for _, key := range path {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur = m[key]
+	}
+	return cur
+}
+
+func stringAt(obj map[string]interface{}, path ...string) string {
+	s, _ := valueAt(obj, path...).(string)
+	return s
+}
+
+func boolAt(obj map[string]interface{}, path ...string) bool {
+	b, _ := valueAt(obj, path...).(bool)
+	return b
+}
+
+func listAt(obj map[string]interface{}, path ...string) []interface{} {
+	l, ok := valueAt(obj, path...).([]interface{})
+	if !ok {
+		return []interface{}{}
+	}
+	return l
+}
+
+var outputFieldRegexp = regexp.MustCompile(`%(ka(\.[A-Za-z0-9_]+)+)`)
+
+// FormatOutput replaces the %ka.* fields in the output template with
+// their values, and also returns the values of the fields.
+func FormatOutput(output string, fields map[string]interface{}) (string, map[string]interface{}) {
+
+	outputFields := map[string]interface{}{}
+
+	formatted := outputFieldRegexp.ReplaceAllStringFunc(output, func(match string) string {
+		name := match[1:]
+		path := strings.Split(name, ".")[1:]
+
+		val := valueAt(fields, path...)
+		outputFields[name] = val
+
+		return formatValue(val)
+	})
+
+	return formatted, outputFields
+}
+
+func formatValue(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return missingValue
+	case string:
+		if v == "" {
+			return missingValue
+		}
+		return v
+	case []interface{}:
+		var parts []string
+		for _, elem := range v {
+			parts = append(parts, formatValue(elem))
+		}
+		return "(" + strings.Join(parts, ",") + ")"
+	case map[string]interface{}:
+		b, _ := json.Marshal(v)
+		return string(b)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
@@ -0,0 +1,227 @@
+package rules
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/google/cel-go/checker/decls"
+	"gopkg.in/yaml.v2"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/filter"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Priority is a falco-style rule priority. Lower values are more severe.
+type Priority int
+
+const (
+	PriorityEmergency Priority = iota
+	PriorityAlert
+	PriorityCritical
+	PriorityError
+	PriorityWarning
+	PriorityNotice
+	PriorityInformational
+	PriorityDebug
+)
+
+var priorityNames = []string{
+	"Emergency",
+	"Alert",
+	"Critical",
+	"Error",
+	"Warning",
+	"Notice",
+	"Informational",
+	"Debug",
+}
+
+func (p Priority) String() string {
+	if p < 0 || int(p) >= len(priorityNames) {
+		return fmt.Sprintf("Priority(%d)", int(p))
+	}
+	return priorityNames[p]
+}
+
+// ParsePriority parses a priority name, case insensitively. "info" is
+// accepted as an alias for "informational".
+func ParsePriority(name string) (Priority, error) {
+	if strings.EqualFold(name, "info") {
+		return PriorityInformational, nil
+	}
+
+	for i, n := range priorityNames {
+		if strings.EqualFold(name, n) {
+			return Priority(i), nil
+		}
+	}
+
+	return PriorityDebug, fmt.Errorf("Unknown priority %q, must be one of %v", name, priorityNames)
+}
+
+// Rule is a single detection rule.
+type Rule struct {
+	Name      string
+	Desc      string
+	Condition string
+	Output    string
+	Priority  Priority
+	Tags      []string
+	expr      *filter.Expression
+}
+
+type ruleYAML struct {
+	Rule      string   `yaml:"rule"`
+	Desc      string   `yaml:"desc"`
+	Condition string   `yaml:"condition"`
+	Output    string   `yaml:"output"`
+	Priority  string   `yaml:"priority"`
+	Enabled   *bool    `yaml:"enabled"`
+	Tags      []string `yaml:"tags"`
+}
+
+// RuleSet is a set of compiled rules.
+type RuleSet struct {
+	Rules []*Rule
+}
+
+// Alert is emitted when an audit event matches a rule. It has the same
+// json representation as falco alerts.
+type Alert struct {
+	Time         time.Time              `json:"time"`
+	Rule         string                 `json:"rule"`
+	Priority     string                 `json:"priority"`
+	Output       string                 `json:"output"`
+	Source       string                 `json:"source"`
+	Tags         []string               `json:"tags,omitempty"`
+	OutputFields map[string]interface{} `json:"output_fields"`
+}
+
+// Load reads and compiles the rules in the provided yaml file, skipping
+// disabled rules and rules with a priority less severe than minPriority.
+func Load(path string, minPriority Priority) (*RuleSet, error) {
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read rules file %s: %v", path, err)
+	}
+
+	rs, err := Parse(content, minPriority)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load rules file %s: %v", path, err)
+	}
+
+	return rs, nil
+}
+
+// Parse compiles the rules in the provided yaml document.
+func Parse(content []byte, minPriority Priority) (*RuleSet, error) {
+
+	var rulesYAML []ruleYAML
+	if err := yaml.UnmarshalStrict(content, &rulesYAML); err != nil {
+		return nil, fmt.Errorf("Could not parse rules: %v", err)
+	}
+
+	rs := &RuleSet{}
+	names := map[string]bool{}
+
+	for i, r := range rulesYAML {
+		if r.Rule == "" {
+			return nil, fmt.Errorf("Rule %d has no name", i)
+		}
+
+		if names[r.Rule] {
+			return nil, fmt.Errorf("Rule %q is defined more than once", r.Rule)
+		}
+		names[r.Rule] = true
+
+		if r.Output == "" {
+			return nil, fmt.Errorf("Rule %q has no output", r.Rule)
+		}
+
+		priority, err := ParsePriority(r.Priority)
+		if err != nil {
+			return nil, fmt.Errorf("Rule %q: %v", r.Rule, err)
+		}
+
+		expr, err := filter.CompileWithDecls(r.Rule, r.Condition, decls.Bool,
+			decls.NewIdent(FieldsVar, decls.NewMapType(decls.String, decls.Dyn), nil))
+		if err != nil {
+			return nil, err
+		}
+
+		if r.Enabled != nil && !*r.Enabled {
+			log.Debugf("Skipping disabled rule %q", r.Rule)
+			continue
+		}
+
+		if priority > minPriority {
+			log.Debugf("Skipping rule %q with priority %v", r.Rule, priority)
+			continue
+		}
+
+		rs.Rules = append(rs.Rules, &Rule{
+			Name:      r.Rule,
+			Desc:      r.Desc,
+			Condition: r.Condition,
+			Output:    r.Output,
+			Priority:  priority,
+			Tags:      r.Tags,
+			expr:      expr,
+		})
+	}
+
+	return rs, nil
+}
+
+// Evaluate returns an alert for every rule matching the audit event. A
+// rule whose condition can not be evaluated does not match, and the last
+// such error is returned alongside any alerts.
+func (rs *RuleSet) Evaluate(auditEvent *auditv1.Event) ([]*Alert, error) {
+
+	if len(rs.Rules) == 0 {
+		return nil, nil
+	}
+
+	fields, err := Fields(auditEvent)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := map[string]interface{}{
+		FieldsVar: fields,
+	}
+
+	var alerts []*Alert
+	var evalErr error
+
+	for _, rule := range rs.Rules {
+		match, err := rule.expr.EvalBool(vars)
+		if err != nil {
+			evalErr = err
+			continue
+		}
+
+		if !match {
+			continue
+		}
+
+		output, outputFields := FormatOutput(rule.Output, fields)
+
+		alerts = append(alerts, &Alert{
+			Time:         auditEvent.StageTimestamp.Time,
+			Rule:         rule.Name,
+			Priority:     rule.Priority.String(),
+			Output:       fmt.Sprintf("%s: %s %s", auditEvent.StageTimestamp.Time.Format(time.RFC3339Nano), rule.Priority, output),
+			Source:       "k8s_audit",
+			Tags:         rule.Tags,
+			OutputFields: outputFields,
+		})
+	}
+
+	return alerts, evalErr
+}
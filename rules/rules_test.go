@@ -0,0 +1,155 @@
+package rules_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/rules"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+func TestStarterRules(t *testing.T) {
+
+	rs, err := rules.Load("./swb_rules.yaml", rules.PriorityDebug)
+	if err != nil {
+		t.Fatalf("Could not load starter rules: %v", err)
+	}
+
+	auditEvtsDir := "../converter/test_files/k8s_audit_events"
+
+	files, err := ioutil.ReadDir(auditEvtsDir)
+	if err != nil {
+		t.Fatalf("Could not read directory containing audit events: %v", err)
+	}
+
+	actual := map[string][]string{}
+
+	for _, file := range files {
+		content, err := ioutil.ReadFile(path.Join(auditEvtsDir, file.Name()))
+		if err != nil {
+			t.Fatalf("Could not read audit events file %s: %v", file.Name(), err)
+		}
+
+		var auditEvent auditv1.Event
+		if err := json.Unmarshal(content, &auditEvent); err != nil {
+			t.Fatalf("Could not decode audit event %s: %v", file.Name(), err)
+		}
+
+		alerts, err := rs.Evaluate(&auditEvent)
+		assert.Nil(t, err, file.Name())
+
+		for _, alert := range alerts {
+			t.Logf("%s: %s", file.Name(), alert.Output)
+			assert.NotContains(t, alert.Output, "%ka", file.Name())
+			actual[strings.TrimSuffix(file.Name(), ".json")] = append(actual[strings.TrimSuffix(file.Name(), ".json")], alert.Rule)
+		}
+	}
+
+	for _, ruleNames := range actual {
+		sort.Strings(ruleNames)
+	}
+
+	assert.Equal(t, map[string][]string{
+		"attach_cluster_admin_role":              {"Attach to cluster-admin Role"},
+		"attach_pod":                             {"Attach/Exec Pod"},
+		"exec_pod":                               {"Attach/Exec Pod"},
+		"create_hostnetwork_pod":                 {"Create HostNetwork Pod"},
+		"create_cluster_role_pod_exec":           {"ClusterRole With Pod Exec Created"},
+		"create_cluster_role_wildcard_resources": {"ClusterRole With Wildcard Created"},
+		"create_cluster_role_wildcard_verbs":     {"ClusterRole With Wildcard Created"},
+		"create_cluster_role_write_privileges":   {"ClusterRole With Write Privileges Created"},
+		"modify_system_cluster_role":             {"System ClusterRole Modified/Deleted"},
+	}, actual)
+}
+
+func TestParseErrors(t *testing.T) {
+
+	_, err := rules.Parse([]byte(`
+- rule: Bad Priority
+  condition: ka.verb == "create"
+  output: created
+  priority: SEVERE
+`), rules.PriorityDebug)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Bad Priority")
+
+	_, err = rules.Parse([]byte(`
+- rule: Bad Condition
+  condition: ka.verb ==
+  output: created
+  priority: WARNING
+`), rules.PriorityDebug)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Bad Condition")
+
+	_, err = rules.Parse([]byte(`
+- rule: No Output
+  condition: ka.verb == "create"
+  priority: WARNING
+`), rules.PriorityDebug)
+	assert.NotNil(t, err)
+
+	_, err = rules.Parse([]byte(`
+- rule: Unknown Key
+  condition: ka.verb == "create"
+  output: created
+  priority: WARNING
+  severity: high
+`), rules.PriorityDebug)
+	assert.NotNil(t, err)
+}
+
+func TestMinPriorityAndEnabled(t *testing.T) {
+
+	rs, err := rules.Parse([]byte(`
+- rule: Warning Rule
+  condition: ka.verb == "create"
+  output: created
+  priority: WARNING
+- rule: Info Rule
+  condition: ka.verb == "create"
+  output: created
+  priority: INFO
+- rule: Disabled Rule
+  condition: ka.verb == "create"
+  output: created
+  priority: CRITICAL
+  enabled: false
+`), rules.PriorityNotice)
+	assert.Nil(t, err)
+
+	var names []string
+	for _, rule := range rs.Rules {
+		names = append(names, rule.Name)
+	}
+	assert.Equal(t, []string{"Warning Rule"}, names)
+}
+
+func TestFormatOutput(t *testing.T) {
+
+	fields := map[string]interface{}{
+		"verb": "create",
+		"user": map[string]interface{}{
+			"name":   "some-user",
+			"groups": []interface{}{"a", "b"},
+		},
+		"response": map[string]interface{}{
+			"code": int64(201),
+		},
+		"target": map[string]interface{}{
+			"name": "",
+		},
+	}
+
+	output, outputFields := rules.FormatOutput("%ka.verb by %ka.user.name (groups=%ka.user.groups code=%ka.response.code name=%ka.target.name missing=%ka.no.such.field)", fields)
+
+	assert.Equal(t, "create by some-user (groups=(a,b) code=201 name=<NA> missing=<NA>)", output)
+	assert.Equal(t, "some-user", outputFields["ka.user.name"])
+	assert.Equal(t, int64(201), outputFields["ka.response.code"])
+	assert.Contains(t, outputFields, "ka.no.such.field")
+}
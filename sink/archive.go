@@ -0,0 +1,584 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	archiveStagedExt = ".jsonl"
+	archiveGCSScope  = "https://www.googleapis.com/auth/devstorage.read_write"
+	archiveTimeForm  = "20060102T150405.000000000Z"
+)
+
+// Archive writes audit events to files in an object storage bucket (S3,
+// S3-compatible storage or GCS), partitioned by cluster and hour, as gzip
+// compressed json lines. Events are first appended to files in a local
+// staging directory. Staged files are uploaded once they reach the
+// maximum size or the flush interval, and are kept and retried until the
+// upload succeeds, also across restarts.
+type Archive struct {
+	cfg        config.OutputConfig
+	source     Source
+	dir        string
+	endpoint   *url.URL
+	httpClient *http.Client
+
+	// s3
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+
+	// gcs
+	tokenSource oauth2.TokenSource
+
+	mutex sync.Mutex
+	files map[string]*stagedFile
+
+	uploadMutex sync.Mutex
+	upload      chan struct{}
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+// stagedFile is the staging file events of one partition are currently
+// appended to.
+type stagedFile struct {
+	path    string
+	file    *os.File
+	size    int64
+	created time.Time
+}
+
+func NewArchive(cfg config.OutputConfig, source Source) (*Archive, error) {
+
+	if cfg.Archive.Bucket == "" {
+		return nil, fmt.Errorf("Output %s has no archive bucket", cfg.Name)
+	}
+
+	if cfg.Archive.Format != "jsonl" {
+		return nil, fmt.Errorf("Unknown archive format %q, only jsonl is supported, parquet is not implemented yet", cfg.Archive.Format)
+	}
+
+	httpClient, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// Uploads of large files take longer than other requests.
+	if cfg.HTTP.Timeout <= 0 {
+		httpClient.Timeout = 5 * time.Minute
+	}
+
+	a := &Archive{
+		cfg:        cfg,
+		source:     source,
+		dir:        filepath.Join(cfg.Archive.StagingDir, cfg.Name),
+		httpClient: httpClient,
+		files:      map[string]*stagedFile{},
+		upload:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+
+	endpoint := cfg.Url
+
+	switch cfg.Archive.Provider {
+	case "s3":
+		if endpoint == "" {
+			endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Archive.Region)
+		}
+
+		a.accessKeyID = cfg.Archive.AccessKeyID
+		a.secretAccessKey = cfg.Archive.SecretAccessKey
+		if a.accessKeyID == "" {
+			a.accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+			a.secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+			a.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		}
+		if a.accessKeyID == "" || a.secretAccessKey == "" {
+			return nil, fmt.Errorf("Output %s has no s3 access key", cfg.Name)
+		}
+	case "gcs":
+		if endpoint == "" {
+			endpoint = "https://storage.googleapis.com"
+		}
+
+		a.tokenSource, err = google.DefaultTokenSource(context.Background(), archiveGCSScope)
+		if err != nil {
+			return nil, fmt.Errorf("Could not find google credentials for output %s: %v", cfg.Name, err)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown archive provider %q, must be one of s3, gcs", cfg.Archive.Provider)
+	}
+
+	a.endpoint, err = url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse url %s: %v", endpoint, err)
+	}
+
+	if err := os.MkdirAll(a.dir, 0755); err != nil {
+		return nil, fmt.Errorf("Could not create staging directory %s: %v", a.dir, err)
+	}
+
+	a.wg.Add(1)
+	go a.run()
+
+	// Upload files staged before a restart.
+	a.triggerUpload()
+
+	return a, nil
+}
+
+// partition returns the path of the partition of the cluster and hour of
+// t, relative to the staging directory and the bucket prefix.
+func (a *Archive) partition(t time.Time) string {
+
+	if t.IsZero() {
+		t = time.Now()
+	}
+	t = t.UTC()
+
+	return fmt.Sprintf("cluster=%s/date=%s/hour=%s", a.source.Cluster, t.Format("2006-01-02"), t.Format("15"))
+}
+
+// Send appends the audit events to the staging files of their partitions.
+// Uploading happens in the background.
+func (a *Archive) Send(auditEvents []*auditv1.Event) error {
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	written := map[*stagedFile]bool{}
+	for _, auditEvent := range auditEvents {
+		line, err := json.Marshal(auditEvent)
+		if err != nil {
+			return Permanent(fmt.Errorf("Could not serialize audit event to JSON: %v", err))
+		}
+
+		file, err := a.write(a.partition(auditEvent.StageTimestamp.Time), line)
+		if err != nil {
+			return err
+		}
+		written[file] = true
+	}
+
+	full := false
+	for file := range written {
+		if err := file.file.Sync(); err != nil {
+			return fmt.Errorf("Could not write to staging file %s: %v", file.path, err)
+		}
+		full = a.sealFull(file) || full
+	}
+
+	if full {
+		a.triggerUpload()
+	}
+
+	return nil
+}
+
+// SendRaw appends the json of a raw log entry to the staging files, in the
+// partition of the time of the entry below raw/. Since entries come one at
+// a time, they are not synced to disk individually.
+func (a *Archive) SendRaw(timestamp time.Time, entryJSON []byte) error {
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	file, err := a.write("raw/"+a.partition(timestamp), entryJSON)
+	if err != nil {
+		return err
+	}
+
+	if a.sealFull(file) {
+		a.triggerUpload()
+	}
+
+	return nil
+}
+
+// write appends the line to the staging file of the partition.
+func (a *Archive) write(partition string, line []byte) (*stagedFile, error) {
+
+	file, err := a.stagedFile(partition)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := file.file.Write(append(line, '\n'))
+	file.size += int64(n)
+	if err != nil {
+		return nil, fmt.Errorf("Could not write to staging file %s: %v", file.path, err)
+	}
+
+	return file, nil
+}
+
+// sealFull seals the staging file if it reached the maximum size, and
+// returns true if it did.
+func (a *Archive) sealFull(file *stagedFile) bool {
+
+	if file.size < int64(a.cfg.Archive.MaxFileSizeMB)*1024*1024 {
+		return false
+	}
+
+	a.seal(file)
+	return true
+}
+
+func (a *Archive) stagedFile(partition string) (*stagedFile, error) {
+
+	if file, ok := a.files[partition]; ok {
+		return file, nil
+	}
+
+	dir := filepath.Join(a.dir, filepath.FromSlash(partition))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Could not create staging directory %s: %v", dir, err)
+	}
+
+	now := time.Now()
+	path := filepath.Join(dir, now.UTC().Format(archiveTimeForm)+archiveStagedExt)
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open staging file %s: %v", path, err)
+	}
+
+	file := &stagedFile{path: path, file: f, created: now}
+	a.files[partition] = file
+
+	return file, nil
+}
+
+// seal closes the staging file, so no more events are appended to it and
+// it can be uploaded.
+func (a *Archive) seal(file *stagedFile) {
+
+	if err := file.file.Close(); err != nil {
+		log.Errorf("Could not close staging file %s: %v", file.path, err)
+	}
+
+	for partition, f := range a.files {
+		if f == file {
+			delete(a.files, partition)
+		}
+	}
+}
+
+// sealExpired seals the staging files older than the flush interval, or
+// all staging files if all is true.
+func (a *Archive) sealExpired(all bool) {
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for _, file := range a.files {
+		if all || time.Since(file.created) >= a.cfg.Archive.FlushInterval {
+			a.seal(file)
+		}
+	}
+}
+
+func (a *Archive) triggerUpload() {
+	select {
+	case a.upload <- struct{}{}:
+	default:
+	}
+}
+
+func (a *Archive) run() {
+
+	defer a.wg.Done()
+
+	// Check for expired staging files a few times per flush interval.
+	ticker := time.NewTicker(a.cfg.Archive.FlushInterval / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			a.sealExpired(false)
+			a.uploadSealed()
+		case <-a.upload:
+			a.uploadSealed()
+		}
+	}
+}
+
+// sealedFiles returns the staging files which are not appended to
+// anymore, including those left over from before a restart.
+func (a *Archive) sealedFiles() ([]string, error) {
+
+	a.mutex.Lock()
+	open := map[string]bool{}
+	for _, file := range a.files {
+		open[file.path] = true
+	}
+	a.mutex.Unlock()
+
+	var sealed []string
+	err := filepath.Walk(a.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(path, archiveStagedExt) && !open[path] {
+			sealed = append(sealed, path)
+		}
+		return nil
+	})
+
+	sort.Strings(sealed)
+
+	return sealed, err
+}
+
+// uploadSealed uploads all sealed staging files, and returns an error if
+// any of them could not be uploaded. Those are retried later.
+func (a *Archive) uploadSealed() error {
+
+	a.uploadMutex.Lock()
+	defer a.uploadMutex.Unlock()
+
+	paths, err := a.sealedFiles()
+	if err != nil {
+		log.Errorf("Could not list staging directory %s: %v", a.dir, err)
+		return err
+	}
+
+	var lastErr error
+	for _, path := range paths {
+		if err := a.uploadFile(path); err != nil {
+			log.Errorf("Could not upload staging file %s, will retry later: %v", path, err)
+			promOutputArchiveUploadError.WithLabelValues(a.cfg.Name).Inc()
+			lastErr = err
+			continue
+		}
+
+		promOutputArchiveUpload.WithLabelValues(a.cfg.Name).Inc()
+
+		if err := os.Remove(path); err != nil {
+			log.Errorf("Could not remove uploaded staging file %s: %v", path, err)
+		}
+		removeEmptyDirs(filepath.Dir(path), a.dir)
+	}
+
+	return lastErr
+}
+
+// removeEmptyDirs removes dir and its parents up to root, as long as they
+// are empty.
+func removeEmptyDirs(dir string, root string) {
+	for dir != root && strings.HasPrefix(dir, root) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// objectKey returns the key of the object for the staging file.
+func (a *Archive) objectKey(path string) (string, error) {
+
+	rel, err := filepath.Rel(a.dir, path)
+	if err != nil {
+		return "", err
+	}
+
+	return a.cfg.Archive.Prefix + filepath.ToSlash(rel) + ".gz", nil
+}
+
+func (a *Archive) uploadFile(path string) error {
+
+	key, err := a.objectKey(path)
+	if err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	if _, err := gz.Write(content); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	backoff := a.cfg.Retry.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err = a.put(key, body.Bytes())
+		if err == nil {
+			log.Debugf("Uploaded %s to %s/%s", path, a.cfg.Archive.Bucket, key)
+			return nil
+		}
+
+		if IsPermanent(err) || attempt >= a.cfg.Archive.UploadAttempts {
+			return err
+		}
+
+		log.Warnf("Could not upload %s (attempt %d), retrying in %v: %v", key, attempt, backoff, err)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > a.cfg.Retry.MaxBackoff {
+			backoff = a.cfg.Retry.MaxBackoff
+		}
+	}
+}
+
+// put uploads the object, using the S3 api (path style) or the GCS xml
+// api.
+func (a *Archive) put(key string, body []byte) error {
+
+	objectUrl := *a.endpoint
+	objectUrl.Path = strings.TrimSuffix(objectUrl.Path, "/") + "/" + a.cfg.Archive.Bucket + "/" + key
+	objectUrl.RawPath = strings.TrimSuffix(a.endpoint.EscapedPath(), "/") + "/" + awsEscape(a.cfg.Archive.Bucket) + "/" + awsEscape(key)
+
+	req, err := http.NewRequest("PUT", objectUrl.String(), bytes.NewReader(body))
+	if err != nil {
+		return Permanent(fmt.Errorf("Could not construct http request to %s: %v", objectUrl.String(), err))
+	}
+
+	req.Header.Set("Content-Type", "application/gzip")
+
+	if a.tokenSource != nil {
+		token, err := a.tokenSource.Token()
+		if err != nil {
+			return fmt.Errorf("Could not get google access token: %v", err)
+		}
+		token.SetAuthHeader(req)
+	} else {
+		a.signV4(req, body, time.Now())
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Could not PUT %s: %v", objectUrl.String(), err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	log.Debugf("response from put: status=%s body=%s:", resp.Status, string(respBody))
+
+	if !isSuccess(a.cfg, resp.StatusCode) {
+		return statusError(resp.StatusCode, fmt.Errorf("Unsuccessful response %s from PUT of %s: %s", resp.Status, key, string(respBody)))
+	}
+
+	return nil
+}
+
+// awsEscape escapes the path like AWS signature version 4 expects:
+// everything but unreserved characters and slashes is percent encoded.
+func awsEscape(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signV4 signs the request with AWS signature version 4, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (a *Archive) signV4(req *http.Request, body []byte, now time.Time) {
+
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if a.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", a.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + a.cfg.Archive.Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+a.secretAccessKey), date)
+	key = hmacSHA256(key, a.cfg.Archive.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		a.accessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+// Close uploads all staged events. Files that could not be uploaded stay
+// in the staging directory and are uploaded after the next start.
+func (a *Archive) Close() error {
+
+	close(a.done)
+	a.wg.Wait()
+
+	a.sealExpired(true)
+
+	return a.uploadSealed()
+}
@@ -0,0 +1,250 @@
+package sink_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/sink"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+// fakeObjectStore is a minimal S3-compatible stand-in, storing the
+// objects PUT to it.
+type fakeObjectStore struct {
+	mutex    sync.Mutex
+	objects  map[string][]byte
+	failures int
+}
+
+func newFakeObjectStore() *fakeObjectStore {
+	return &fakeObjectStore{objects: map[string][]byte{}}
+}
+
+func (f *fakeObjectStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	hash := sha256.Sum256(body)
+
+	if r.Method != "PUT" ||
+		!strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=my-key/") ||
+		r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(hash[:]) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if f.failures > 0 {
+		f.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	f.objects[r.URL.Path] = body
+	w.WriteHeader(http.StatusOK)
+}
+
+// events returns the audit events of the objects below the path.
+func (f *fakeObjectStore) events(t *testing.T, prefix string) []auditv1.Event {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var auditEvents []auditv1.Event
+	for path, body := range f.objects {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		assert.Nil(t, err)
+		content, err := ioutil.ReadAll(gz)
+		assert.Nil(t, err)
+
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+			var auditEvent auditv1.Event
+			assert.Nil(t, json.Unmarshal([]byte(line), &auditEvent))
+			auditEvents = append(auditEvents, auditEvent)
+		}
+	}
+	return auditEvents
+}
+
+func testArchiveConfig(url string, stagingDir string) config.OutputConfig {
+	cfg := testOutputConfig()
+	cfg.Type = "archive"
+	cfg.Url = url
+	cfg.Archive = config.ArchiveConfig{
+		Provider:        "s3",
+		Bucket:          "audit",
+		Prefix:          "k8s/",
+		Region:          "us-east-1",
+		AccessKeyID:     "my-key",
+		SecretAccessKey: "my-secret",
+		Format:          "jsonl",
+		StagingDir:      stagingDir,
+		MaxFileSizeMB:   64,
+		FlushInterval:   time.Hour,
+		UploadAttempts:  3,
+	}
+	return cfg
+}
+
+func TestArchive(t *testing.T) {
+
+	store := newFakeObjectStore()
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "swb-archive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := testArchiveConfig(server.URL, dir)
+	archive, err := sink.NewArchive(cfg, sink.Source{Cluster: "my-cluster"})
+	assert.Nil(t, err)
+
+	auditEvents := append(testEvents(2, "default"), testEvents(1, "other")...)
+	auditEvents[0].StageTimestamp = metav1.NewMicroTime(time.Date(2020, 5, 17, 10, 30, 0, 0, time.UTC))
+	auditEvents[1].StageTimestamp = metav1.NewMicroTime(time.Date(2020, 5, 17, 10, 45, 0, 0, time.UTC))
+	auditEvents[2].StageTimestamp = metav1.NewMicroTime(time.Date(2020, 5, 17, 11, 5, 0, 0, time.UTC))
+
+	// Staged, but not uploaded before the flush interval
+	assert.Nil(t, archive.Send(auditEvents))
+	assert.Equal(t, 0, len(store.events(t, "/")))
+
+	// One object per hour
+	store.failures = 1
+	assert.Nil(t, archive.Close())
+
+	hour10 := store.events(t, "/audit/k8s/cluster=my-cluster/date=2020-05-17/hour=10/")
+	assert.Equal(t, 2, len(hour10))
+	hour11 := store.events(t, "/audit/k8s/cluster=my-cluster/date=2020-05-17/hour=11/")
+	assert.Equal(t, 1, len(hour11))
+	assert.Equal(t, "other-0", string(hour11[0].AuditID))
+
+	for path := range store.objects {
+		assert.True(t, strings.HasSuffix(path, ".jsonl.gz"))
+	}
+
+	// Nothing left in the staging directory
+	var staged []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if !info.IsDir() {
+			staged = append(staged, path)
+		}
+		return nil
+	})
+	assert.Empty(t, staged)
+}
+
+func TestArchiveStagedAcrossRestarts(t *testing.T) {
+
+	store := newFakeObjectStore()
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "swb-archive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Uploads fail, the events stay staged.
+	cfg := testArchiveConfig(server.URL, dir)
+	store.failures = 100
+	archive, err := sink.NewArchive(cfg, sink.Source{Cluster: "my-cluster"})
+	assert.Nil(t, err)
+	assert.Nil(t, archive.Send(testEvents(3, "default")))
+	assert.NotNil(t, archive.Close())
+	assert.Equal(t, 0, len(store.events(t, "/")))
+
+	// And are uploaded after the restart.
+	store.failures = 0
+	cfg.Archive.FlushInterval = 20 * time.Millisecond
+	archive, err = sink.NewArchive(cfg, sink.Source{Cluster: "my-cluster"})
+	assert.Nil(t, err)
+
+	assert.Eventually(t, func() bool {
+		return len(store.events(t, "/audit/k8s/cluster=my-cluster/")) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	// Expired staging files are uploaded by the flush timer.
+	assert.Nil(t, archive.Send(testEvents(1, "other")))
+	assert.Eventually(t, func() bool {
+		return len(store.events(t, "/audit/k8s/cluster=my-cluster/")) == 4
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Nil(t, archive.Close())
+}
+
+func TestArchiveRawEntries(t *testing.T) {
+
+	store := newFakeObjectStore()
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "swb-archive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := testArchiveConfig(server.URL, dir)
+	archive, err := sink.NewArchive(cfg, sink.Source{Cluster: "my-cluster"})
+	assert.Nil(t, err)
+	output, err := sink.NewOutput(cfg, archive)
+	assert.Nil(t, err)
+	assert.False(t, output.RawEntries())
+	output.Close()
+
+	cfg.Archive.RawEntries = true
+	archive, err = sink.NewArchive(cfg, sink.Source{Cluster: "my-cluster"})
+	assert.Nil(t, err)
+	output, err = sink.NewOutput(cfg, archive)
+	assert.Nil(t, err)
+	assert.True(t, output.RawEntries())
+
+	output.AddRawEntry(time.Date(2020, 5, 17, 10, 30, 0, 0, time.UTC), []byte(`{"auditID":"raw-0"}`))
+	output.Add(testEvents(1, "default"))
+	output.Close()
+
+	raw := store.events(t, "/audit/k8s/raw/cluster=my-cluster/date=2020-05-17/hour=10/")
+	assert.Equal(t, 1, len(raw))
+	assert.Equal(t, "raw-0", string(raw[0].AuditID))
+	assert.Equal(t, 1, len(store.events(t, "/audit/k8s/cluster=my-cluster/")))
+}
+
+func TestArchiveInvalidConfig(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "swb-archive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := testArchiveConfig("http://localhost", dir)
+	cfg.Archive.Format = "parquet"
+	_, err = sink.NewArchive(cfg, sink.Source{})
+	assert.NotNil(t, err)
+
+	cfg = testArchiveConfig("http://localhost", dir)
+	cfg.Archive.Provider = "azure"
+	_, err = sink.NewArchive(cfg, sink.Source{})
+	assert.NotNil(t, err)
+
+	cfg = testArchiveConfig("http://localhost", dir)
+	cfg.Archive.Bucket = ""
+	_, err = sink.NewArchive(cfg, sink.Source{})
+	assert.NotNil(t, err)
+}
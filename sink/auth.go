@@ -0,0 +1,133 @@
+package sink
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// authenticator adds the authentication configured for an output to its
+// http requests: a bearer token (static, or read from a file which is
+// read again periodically, like projected service account tokens), basic
+// auth and/or an HMAC-SHA256 signature of the body.
+type authenticator struct {
+	cfg config.AuthConfig
+
+	mutex    sync.Mutex
+	token    string
+	readTime time.Time
+}
+
+func newAuthenticator(cfg config.AuthConfig) (*authenticator, error) {
+
+	if cfg.BearerToken != "" && cfg.BearerTokenFile != "" {
+		return nil, fmt.Errorf("Only one of bearer_token and bearer_token_file can be set")
+	}
+
+	if (cfg.BearerToken != "" || cfg.BearerTokenFile != "") && cfg.Username != "" {
+		return nil, fmt.Errorf("Only one of a bearer token and basic auth can be set")
+	}
+
+	a := &authenticator{cfg: cfg}
+
+	if cfg.BearerTokenFile != "" {
+		if _, err := a.bearerToken(); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// bearerToken returns the token, reading the token file again once the
+// refresh interval passed. If the file can't be read, the previous token
+// is used.
+func (a *authenticator) bearerToken() (string, error) {
+
+	if a.cfg.BearerTokenFile == "" {
+		return a.cfg.BearerToken, nil
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.token != "" && time.Since(a.readTime) < a.cfg.TokenRefreshInterval {
+		return a.token, nil
+	}
+
+	content, err := ioutil.ReadFile(a.cfg.BearerTokenFile)
+	if err == nil && strings.TrimSpace(string(content)) == "" {
+		err = fmt.Errorf("File is empty")
+	}
+	if err != nil {
+		err = fmt.Errorf("Could not read bearer token file %s: %v", a.cfg.BearerTokenFile, err)
+		if a.token == "" {
+			return "", err
+		}
+		log.Warnf("%v, using the previous token", err)
+		return a.token, nil
+	}
+
+	a.token = strings.TrimSpace(string(content))
+	a.readTime = time.Now()
+
+	return a.token, nil
+}
+
+// expireToken makes the next request read the token file again, e.g.
+// after the receiver did not accept the token.
+func (a *authenticator) expireToken() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.readTime = time.Time{}
+}
+
+// apply adds the authentication headers for the body to the request.
+func (a *authenticator) apply(req *http.Request, body []byte) error {
+
+	token, err := a.bearerToken()
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	if a.cfg.Username != "" {
+		req.SetBasicAuth(a.cfg.Username, a.cfg.Password)
+	}
+
+	if a.cfg.HMACSecret != "" {
+		timestamp, signature := signBody(a.cfg.HMACSecret, body, time.Now())
+		req.Header.Set(a.cfg.HMACTimestampHeader, timestamp)
+		req.Header.Set(a.cfg.HMACSignatureHeader, signature)
+	}
+
+	return nil
+}
+
+// signBody returns the timestamp (seconds since the epoch) and the
+// signature "sha256=<hex of HMAC-SHA256(secret, timestamp + "." + body)>".
+// Receivers can reject requests with old timestamps to prevent replays.
+func signBody(secret string, body []byte, now time.Time) (string, string) {
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return timestamp, "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
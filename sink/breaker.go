@@ -0,0 +1,143 @@
+package sink
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerHalfOpen = "half-open"
+	breakerOpen     = "open"
+)
+
+// The values of the circuit breaker state metric.
+var breakerStateValues = map[string]float64{
+	breakerClosed:   0,
+	breakerHalfOpen: 1,
+	breakerOpen:     2,
+}
+
+// circuitBreaker tracks whether an output is healthy. It opens after a
+// number of consecutive failures, and then lets a single batch through
+// once the open timeout passed. If that batch is sent, the breaker closes
+// again, otherwise it stays open for another timeout.
+type circuitBreaker struct {
+	output      string
+	threshold   int
+	openTimeout time.Duration
+
+	mutex    sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(output string, threshold int, openTimeout time.Duration) *circuitBreaker {
+
+	if threshold <= 0 {
+		return nil
+	}
+
+	b := &circuitBreaker{
+		output:      output,
+		threshold:   threshold,
+		openTimeout: openTimeout,
+	}
+	b.setState(breakerClosed)
+
+	return b
+}
+
+// allow returns true if a batch may be sent. In the half-open state, only
+// the probe is allowed until its result is recorded.
+func (b *circuitBreaker) allow() bool {
+
+	if b == nil {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if time.Since(b.openedAt) >= b.openTimeout {
+			b.setState(breakerHalfOpen)
+			return true
+		}
+	}
+
+	return false
+}
+
+// ready returns true if the next batch would be allowed.
+func (b *circuitBreaker) ready() bool {
+
+	if b == nil {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.state == breakerClosed || (b.state == breakerOpen && time.Since(b.openedAt) >= b.openTimeout)
+}
+
+// record updates the breaker with the result of sending a batch. Only
+// errors that would be retried count as failures: a receiver rejecting
+// events is still available.
+func (b *circuitBreaker) record(err error) {
+
+	if b == nil {
+		return
+	}
+
+	failed := err != nil && !IsPermanent(err)
+	if partialErr, ok := err.(*PartialError); ok && len(partialErr.Retry) == 0 {
+		failed = false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !failed {
+		if b.state != breakerClosed {
+			log.Infof("Output %s recovered, closing its circuit breaker", b.output)
+		}
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+
+	b.failures++
+
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state == breakerClosed {
+			log.Warnf("Output %s failed %d times in a row, opening its circuit breaker for %v", b.output, b.failures, b.openTimeout)
+		}
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+func (b *circuitBreaker) getState() string {
+
+	if b == nil {
+		return breakerClosed
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.state
+}
+
+func (b *circuitBreaker) setState(state string) {
+	b.state = state
+	promOutputCircuitBreakerState.WithLabelValues(b.output).Set(breakerStateValues[state])
+}
@@ -0,0 +1,123 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+const (
+	cloudEventsSpecVersion = "1.0"
+	cloudEventsContentType = "application/cloudevents+json"
+	cloudEventsBatchType   = "application/cloudevents-batch+json"
+)
+
+// cloudEvent is the structured (json) representation of a CloudEvents 1.0
+// event, see https://github.com/cloudevents/spec/blob/v1.0/json-format.md
+type cloudEvent struct {
+	SpecVersion     string         `json:"specversion"`
+	ID              string         `json:"id"`
+	Source          string         `json:"source"`
+	Type            string         `json:"type"`
+	Subject         string         `json:"subject,omitempty"`
+	Time            string         `json:"time,omitempty"`
+	DataContentType string         `json:"datacontenttype"`
+	Data            *auditv1.Event `json:"data"`
+}
+
+// cloudEventsSource returns the source of the events of the cluster.
+func cloudEventsSource(source Source) string {
+	return fmt.Sprintf("//container.googleapis.com/projects/%s/clusters/%s", source.Project, source.Cluster)
+}
+
+// cloudEventsSubject returns the object reference of the audit event as a
+// path, e.g. namespaces/default/pods/my-pod/exec
+func cloudEventsSubject(auditEvent *auditv1.Event) string {
+
+	ref := auditEvent.ObjectRef
+	if ref == nil {
+		return ""
+	}
+
+	var parts []string
+	if ref.Namespace != "" {
+		parts = append(parts, "namespaces", ref.Namespace)
+	}
+	if ref.Resource != "" {
+		parts = append(parts, ref.Resource)
+	}
+	if ref.Name != "" {
+		parts = append(parts, ref.Name)
+	}
+	if ref.Subresource != "" {
+		parts = append(parts, ref.Subresource)
+	}
+
+	return strings.Join(parts, "/")
+}
+
+func newCloudEvent(auditEvent *auditv1.Event, eventType string, source Source) *cloudEvent {
+
+	ce := &cloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              string(auditEvent.AuditID),
+		Source:          cloudEventsSource(source),
+		Type:            eventType,
+		Subject:         cloudEventsSubject(auditEvent),
+		DataContentType: "application/json",
+		Data:            auditEvent,
+	}
+
+	if !auditEvent.StageTimestamp.IsZero() {
+		ce.Time = auditEvent.StageTimestamp.Time.UTC().Format(time.RFC3339Nano)
+	}
+
+	return ce
+}
+
+// binaryHeaders returns the http headers of the event in binary content
+// mode, where the data of the event is the body of the request.
+func (ce *cloudEvent) binaryHeaders() http.Header {
+
+	header := http.Header{}
+	header.Set("Content-Type", ce.DataContentType)
+	header.Set("Ce-Specversion", ce.SpecVersion)
+	header.Set("Ce-Id", ce.ID)
+	header.Set("Ce-Source", ce.Source)
+	header.Set("Ce-Type", ce.Type)
+	if ce.Subject != "" {
+		header.Set("Ce-Subject", ce.Subject)
+	}
+	if ce.Time != "" {
+		header.Set("Ce-Time", ce.Time)
+	}
+
+	return header
+}
+
+// encodeCloudEvent returns the body and headers of a request for a single
+// event, in structured or binary mode.
+func encodeCloudEvent(ce *cloudEvent, mode string) ([]byte, http.Header, error) {
+
+	if mode == "binary" {
+		body, err := json.Marshal(ce.Data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not serialize audit event to JSON: %v", err)
+		}
+		return body, ce.binaryHeaders(), nil
+	}
+
+	body, err := json.Marshal(ce)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not serialize cloud event to JSON: %v", err)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", cloudEventsContentType)
+
+	return body, header, nil
+}
@@ -0,0 +1,83 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// bodyCompressor compresses http request bodies of an output, setting the
+// Content-Encoding accordingly.
+type bodyCompressor struct {
+	output    string
+	encoding  string
+	threshold int
+	zstd      *zstd.Encoder
+}
+
+func newBodyCompressor(output string, compression string, threshold int) (*bodyCompressor, error) {
+
+	c := &bodyCompressor{
+		output:    output,
+		threshold: threshold,
+	}
+
+	switch compression {
+	case "", "none":
+	case "gzip":
+		c.encoding = "gzip"
+	case "zstd":
+		c.encoding = "zstd"
+
+		var err error
+		c.zstd, err = zstd.NewWriter(nil)
+		if err != nil {
+			return nil, fmt.Errorf("Could not create zstd encoder: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown compression %q for output %s, must be one of none, gzip, zstd", compression, output)
+	}
+
+	return c, nil
+}
+
+// compress returns the body to send and its Content-Encoding, which is
+// empty if the body is not compressed.
+func (c *bodyCompressor) compress(body []byte) ([]byte, string, error) {
+
+	promOutputRequestBytes.WithLabelValues(c.output).Add(float64(len(body)))
+
+	if c.encoding == "" || len(body) < c.threshold {
+		promOutputRequestBytesSent.WithLabelValues(c.output).Add(float64(len(body)))
+		return body, "", nil
+	}
+
+	var compressed []byte
+
+	switch c.encoding {
+	case "gzip":
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(body); err != nil {
+			return nil, "", fmt.Errorf("Could not compress request body: %v", err)
+		}
+		if err := gz.Close(); err != nil {
+			return nil, "", fmt.Errorf("Could not compress request body: %v", err)
+		}
+		compressed = buf.Bytes()
+	case "zstd":
+		compressed = c.zstd.EncodeAll(body, nil)
+	}
+
+	promOutputRequestBytesSent.WithLabelValues(c.output).Add(float64(len(compressed)))
+
+	return compressed, c.encoding, nil
+}
+
+func (c *bodyCompressor) close() {
+	if c.zstd != nil {
+		c.zstd.Close()
+	}
+}
@@ -0,0 +1,227 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Elasticsearch indexes batches of audit events using the _bulk api of
+// elasticsearch or opensearch. The AuditID is used as the document id, so
+// events that are sent again overwrite the earlier copy.
+type Elasticsearch struct {
+	cfg        config.OutputConfig
+	source     Source
+	baseUrl    string
+	index      *template.Template
+	httpClient *http.Client
+}
+
+type bulkAction struct {
+	Index bulkActionMeta `json:"index"`
+}
+
+type bulkActionMeta struct {
+	Index string `json:"_index"`
+	ID    string `json:"_id,omitempty"`
+}
+
+type bulkResponse struct {
+	Errors bool                  `json:"errors"`
+	Items  []map[string]bulkItem `json:"items"`
+}
+
+type bulkItem struct {
+	Index  string          `json:"_index"`
+	ID     string          `json:"_id"`
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+func NewElasticsearch(cfg config.OutputConfig, source Source) (*Elasticsearch, error) {
+
+	if cfg.Url == "" {
+		return nil, fmt.Errorf("Output %s has no url", cfg.Name)
+	}
+
+	index, err := parseTemplate("index", cfg.Elasticsearch.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Elasticsearch{
+		cfg:        cfg,
+		source:     source,
+		baseUrl:    strings.TrimRight(cfg.Url, "/"),
+		index:      index,
+		httpClient: httpClient,
+	}
+
+	if cfg.Elasticsearch.TemplateFile != "" {
+		if err := e.putIndexTemplate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+// putIndexTemplate creates (or updates) the index template from the
+// template file, so the indices created by the output get the expected
+// mappings and settings.
+func (e *Elasticsearch) putIndexTemplate() error {
+
+	content, err := ioutil.ReadFile(e.cfg.Elasticsearch.TemplateFile)
+	if err != nil {
+		return fmt.Errorf("Could not read index template file %s: %v", e.cfg.Elasticsearch.TemplateFile, err)
+	}
+
+	url := fmt.Sprintf("%s/_index_template/%s", e.baseUrl, e.cfg.Elasticsearch.TemplateName)
+
+	resp, body, err := e.do("PUT", url, "application/json", content)
+	if err != nil {
+		return fmt.Errorf("Could not create index template %s: %v", e.cfg.Elasticsearch.TemplateName, err)
+	}
+
+	if !isSuccess(e.cfg, resp.StatusCode) {
+		return fmt.Errorf("Could not create index template %s: unsuccessful response %s: %s",
+			e.cfg.Elasticsearch.TemplateName, resp.Status, string(body))
+	}
+
+	log.Infof("Created index template %s for output %s", e.cfg.Elasticsearch.TemplateName, e.cfg.Name)
+
+	return nil
+}
+
+func (e *Elasticsearch) Send(auditEvents []*auditv1.Event) error {
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+
+	for _, auditEvent := range auditEvents {
+		index, err := executeTemplate(e.index, newTemplateData(e.source, auditEvent))
+		if err != nil {
+			return Permanent(err)
+		}
+
+		action := &bulkAction{
+			Index: bulkActionMeta{
+				Index: index,
+				ID:    string(auditEvent.AuditID),
+			},
+		}
+
+		if err := enc.Encode(action); err != nil {
+			return Permanent(fmt.Errorf("Could not serialize bulk action to JSON: %v", err))
+		}
+		if err := enc.Encode(auditEvent); err != nil {
+			return Permanent(fmt.Errorf("Could not serialize audit event to JSON: %v", err))
+		}
+	}
+
+	resp, respBody, err := e.do("POST", e.baseUrl+"/_bulk", "application/x-ndjson", body.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if !isSuccess(e.cfg, resp.StatusCode) {
+		return statusError(resp.StatusCode, fmt.Errorf("Unsuccessful response %s from POST of audit events: %s", resp.Status, string(respBody)))
+	}
+
+	var bulkResp bulkResponse
+	if err := json.Unmarshal(respBody, &bulkResp); err != nil {
+		return fmt.Errorf("Could not parse bulk response: %v", err)
+	}
+
+	if !bulkResp.Errors {
+		return nil
+	}
+
+	return bulkItemsError(auditEvents, bulkResp.Items)
+}
+
+// bulkItemsError returns a *PartialError for the failed items of a bulk
+// request. Items that were throttled or hit a server error are retried,
+// all other failed items (e.g. mapping errors) are rejected.
+func bulkItemsError(auditEvents []*auditv1.Event, items []map[string]bulkItem) error {
+
+	if len(items) != len(auditEvents) {
+		return fmt.Errorf("Bulk response has %d items for %d audit events", len(items), len(auditEvents))
+	}
+
+	partialErr := &PartialError{}
+	var firstErr string
+
+	for i, item := range items {
+		// Each item has a single key, the action (index).
+		for _, result := range item {
+			if result.Status < 300 {
+				continue
+			}
+
+			if firstErr == "" {
+				firstErr = fmt.Sprintf("status %d for document %s in %s: %s", result.Status, result.ID, result.Index, string(result.Error))
+			}
+
+			if result.Status == http.StatusTooManyRequests || result.Status >= 500 {
+				partialErr.Retry = append(partialErr.Retry, auditEvents[i])
+			} else {
+				partialErr.Rejected++
+				partialErr.RejectedEvents = append(partialErr.RejectedEvents, auditEvents[i])
+			}
+		}
+	}
+
+	partialErr.Err = fmt.Errorf("Could not index %d of %d audit events (%d rejected), first error: %s",
+		len(partialErr.Retry)+partialErr.Rejected, len(auditEvents), partialErr.Rejected, firstErr)
+
+	return partialErr
+}
+
+func (e *Elasticsearch) do(method string, url string, contentType string, body []byte) (*http.Response, []byte, error) {
+
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, nil, Permanent(fmt.Errorf("Could not construct http request to %s: %v", url, err))
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	if e.cfg.Elasticsearch.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+e.cfg.Elasticsearch.APIKey)
+	} else if e.cfg.Elasticsearch.Username != "" {
+		req.SetBasicAuth(e.cfg.Elasticsearch.Username, e.cfg.Elasticsearch.Password)
+	}
+	for key, val := range e.cfg.Headers {
+		req.Header.Set(key, val)
+	}
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not %s to %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	log.Debugf("response from %s: status=%s body=%s:", strings.ToLower(method), resp.Status, string(respBody))
+
+	return resp, respBody, nil
+}
+
+func (e *Elasticsearch) Close() error {
+	return nil
+}
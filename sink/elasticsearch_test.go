@@ -0,0 +1,144 @@
+package sink_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/sink"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testElasticsearchConfig(url string) config.OutputConfig {
+	cfg := testOutputConfig()
+	cfg.Type = "elasticsearch"
+	cfg.Url = url
+	cfg.Elasticsearch = config.ElasticsearchConfig{
+		Index:        `audit-{{ .Cluster }}-{{ .Time.Format "2006.01.02" }}`,
+		Username:     "elastic",
+		Password:     "changeme",
+		TemplateName: "k8s-audit",
+	}
+	return cfg
+}
+
+func TestElasticsearch(t *testing.T) {
+
+	var lines []map[string]interface{}
+	var templateBody []byte
+	var templatePath string
+	itemStatus := []int{201, 201, 201}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		assert.Equal(t, "elastic", user)
+		assert.Equal(t, "changeme", password)
+
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if r.Method == "PUT" {
+			templatePath = r.URL.Path
+			templateBody = body
+			w.Write([]byte(`{"acknowledged":true}`))
+			return
+		}
+
+		assert.Equal(t, "/_bulk", r.URL.Path)
+		assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+
+		lines = nil
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			var line map[string]interface{}
+			json.Unmarshal(scanner.Bytes(), &line)
+			lines = append(lines, line)
+		}
+
+		resp := map[string]interface{}{"errors": false}
+		var items []interface{}
+		for i := 0; i < len(lines)/2; i++ {
+			status := itemStatus[i]
+			item := map[string]interface{}{"_index": "audit", "status": status}
+			if status >= 300 {
+				resp["errors"] = true
+				item["error"] = map[string]interface{}{"type": "mapper_parsing_exception"}
+			}
+			items = append(items, map[string]interface{}{"index": item})
+		}
+		resp["items"] = items
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "swb-elasticsearch")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	templateFile := filepath.Join(dir, "template.json")
+	assert.Nil(t, ioutil.WriteFile(templateFile, []byte(`{"index_patterns":["audit-*"]}`), 0644))
+
+	cfg := testElasticsearchConfig(server.URL)
+	cfg.Elasticsearch.TemplateFile = templateFile
+
+	elasticsearch, err := sink.NewElasticsearch(cfg, sink.Source{Project: "my-project", Cluster: "my-cluster"})
+	assert.Nil(t, err)
+	assert.Equal(t, "/_index_template/k8s-audit", templatePath)
+	assert.Equal(t, `{"index_patterns":["audit-*"]}`, string(templateBody))
+
+	auditEvents := testEvents(3, "default")
+	for _, auditEvent := range auditEvents {
+		auditEvent.StageTimestamp = metav1.NewMicroTime(time.Date(2020, 5, 17, 10, 0, 0, 0, time.UTC))
+	}
+
+	assert.Nil(t, elasticsearch.Send(auditEvents))
+	assert.Equal(t, 6, len(lines))
+	action := lines[0]["index"].(map[string]interface{})
+	assert.Equal(t, "audit-my-cluster-2020.05.17", action["_index"])
+	assert.Equal(t, "default-0", action["_id"])
+	assert.Equal(t, "default-0", lines[1]["auditID"])
+
+	// One item throttled, one rejected
+	itemStatus = []int{201, 429, 400}
+	err = elasticsearch.Send(auditEvents)
+	partialErr, ok := err.(*sink.PartialError)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(partialErr.Retry))
+	assert.Equal(t, auditEvents[1], partialErr.Retry[0])
+	assert.Equal(t, 1, partialErr.Rejected)
+	assert.Contains(t, err.Error(), "mapper_parsing_exception")
+}
+
+func TestElasticsearchErrors(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	elasticsearch, err := sink.NewElasticsearch(testElasticsearchConfig(server.URL), sink.Source{})
+	assert.Nil(t, err)
+
+	err = elasticsearch.Send(testEvents(1, "default"))
+	assert.NotNil(t, err)
+	assert.True(t, sink.IsPermanent(err))
+
+	// The template can't be created
+	cfg := testElasticsearchConfig(server.URL)
+	cfg.Elasticsearch.TemplateFile = "/does/not/exist.json"
+	_, err = sink.NewElasticsearch(cfg, sink.Source{})
+	assert.NotNil(t, err)
+
+	cfg = testElasticsearchConfig(server.URL)
+	cfg.Elasticsearch.Index = "audit-{{ .Cluster"
+	_, err = sink.NewElasticsearch(cfg, sink.Source{})
+	assert.NotNil(t, err)
+}
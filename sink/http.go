@@ -0,0 +1,120 @@
+package sink
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+)
+
+// The defaults of the http settings of outputs.
+const (
+	defaultHTTPTimeout         = 30 * time.Second
+	defaultConnectTimeout      = 10 * time.Second
+	defaultKeepAlive           = 30 * time.Second
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 10
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// newHTTPClient creates the http client of an output, using the tls and
+// connection settings of the output.
+func newHTTPClient(cfg config.OutputConfig) (*http.Client, error) {
+
+	for _, code := range cfg.SuccessCodes {
+		if code < 100 || code > 599 {
+			return nil, fmt.Errorf("Invalid success code %d for output %s", code, cfg.Name)
+		}
+	}
+
+	transport, err := newReloadingTransport(cfg.TLS, cfg.HTTP)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := cfg.HTTP.Timeout
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeout
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// newTransport creates a transport with the connection settings, without
+// any tls configuration.
+func newTransport(cfg config.HTTPConfig, proxy func(*http.Request) (*url.URL, error)) *http.Transport {
+
+	dialer := &net.Dialer{
+		Timeout:   orDefault(cfg.ConnectTimeout, defaultConnectTimeout),
+		KeepAlive: orDefault(cfg.KeepAlive, defaultKeepAlive),
+	}
+
+	maxIdleConns := cfg.MaxIdleConns
+	if maxIdleConns <= 0 {
+		maxIdleConns = defaultMaxIdleConns
+	}
+	maxIdleConnsPerHost := cfg.MaxIdleConnsPerHost
+	if maxIdleConnsPerHost <= 0 {
+		maxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   dialer.Timeout,
+		ResponseHeaderTimeout: cfg.ReadTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableKeepAlives:     cfg.DisableKeepAlives,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       orDefault(cfg.IdleConnTimeout, defaultIdleConnTimeout),
+	}
+}
+
+func orDefault(d time.Duration, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// newProxyFunc returns the proxy function of a transport for the proxy
+// settings. Requests to localhost are never proxied.
+func newProxyFunc(cfg config.ProxyConfig) (func(*http.Request) (*url.URL, error), error) {
+
+	if cfg.URL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	proxyUrl, err := url.Parse(cfg.URL)
+	if err != nil || proxyUrl.Host == "" {
+		return nil, fmt.Errorf("Invalid proxy url %q", cfg.URL)
+	}
+
+	switch proxyUrl.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("Unknown proxy scheme %q, must be one of http, https, socks5", proxyUrl.Scheme)
+	}
+
+	if cfg.Username != "" {
+		proxyUrl.User = url.UserPassword(cfg.Username, cfg.Password)
+	}
+
+	proxyFunc := (&httpproxy.Config{
+		HTTPProxy:  proxyUrl.String(),
+		HTTPSProxy: proxyUrl.String(),
+		NoProxy:    strings.Join(cfg.NoProxy, ","),
+	}).ProxyFunc()
+
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}, nil
+}
@@ -0,0 +1,72 @@
+package sink_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/sink"
+)
+
+func TestWebhookProxy(t *testing.T) {
+
+	var proxied []string
+	var proxyAuth string
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		proxyAuth = r.Header.Get("Proxy-Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	cfg := testOutputConfig()
+	cfg.Url = "http://falco.example.invalid/k8s-audit"
+	cfg.HTTP.Proxy = config.ProxyConfig{
+		URL:      proxy.URL,
+		Username: "swb",
+		Password: "secret",
+	}
+
+	webhook, err := sink.NewWebhook(cfg, sink.Source{})
+	assert.Nil(t, err)
+	assert.Nil(t, webhook.Send(testEvents(1, "default")))
+	assert.Equal(t, []string{"http://falco.example.invalid/k8s-audit"}, proxied)
+	assert.Equal(t, "Basic c3diOnNlY3JldA==", proxyAuth)
+
+	// Hosts in no_proxy are connected to directly, which fails here
+	cfg.HTTP.Proxy.NoProxy = []string{".example.invalid"}
+	webhook, err = sink.NewWebhook(cfg, sink.Source{})
+	assert.Nil(t, err)
+	assert.NotNil(t, webhook.Send(testEvents(1, "default")))
+	assert.Equal(t, 1, len(proxied))
+
+	cfg.HTTP.Proxy.URL = "ftp://proxy.example.com"
+	_, err = sink.NewWebhook(cfg, sink.Source{})
+	assert.NotNil(t, err)
+}
+
+func TestWebhookReadTimeout(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	cfg := testOutputConfig()
+	cfg.Url = server.URL
+	cfg.HTTP.ReadTimeout = 50 * time.Millisecond
+
+	webhook, err := sink.NewWebhook(cfg, sink.Source{})
+	assert.Nil(t, err)
+	assert.NotNil(t, webhook.Send(testEvents(1, "default")))
+
+	cfg.HTTP.ReadTimeout = time.Second
+	webhook, err = sink.NewWebhook(cfg, sink.Source{})
+	assert.Nil(t, err)
+	assert.Nil(t, webhook.Send(testEvents(1, "default")))
+}
@@ -0,0 +1,218 @@
+package sink
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg/scram"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+)
+
+// Kafka produces every audit event as a json message to a kafka topic.
+// Send only returns once the brokers acknowledged all messages (with the
+// configured acks), so a kafka output can hold back the poll cursor until
+// the events are safely stored.
+type Kafka struct {
+	cfg      config.OutputConfig
+	source   Source
+	topic    *template.Template
+	producer sarama.SyncProducer
+}
+
+func NewKafka(cfg config.OutputConfig, source Source) (*Kafka, error) {
+
+	if len(cfg.Kafka.Brokers) == 0 {
+		return nil, fmt.Errorf("Output %s has no kafka brokers", cfg.Name)
+	}
+
+	saramaConfig, err := newSaramaConfig(cfg.Kafka)
+	if err != nil {
+		return nil, err
+	}
+
+	topic, err := parseTemplate("topic", cfg.Kafka.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	producer, err := sarama.NewSyncProducer(cfg.Kafka.Brokers, saramaConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to kafka brokers %v: %v", cfg.Kafka.Brokers, err)
+	}
+
+	return &Kafka{
+		cfg:      cfg,
+		source:   source,
+		topic:    topic,
+		producer: producer,
+	}, nil
+}
+
+func newSaramaConfig(cfg config.KafkaConfig) (*sarama.Config, error) {
+
+	saramaConfig := sarama.NewConfig()
+	saramaConfig.ClientID = "stackdriver-webhook-bridge"
+	saramaConfig.Producer.Return.Successes = true
+
+	if cfg.Version != "" {
+		version, err := sarama.ParseKafkaVersion(cfg.Version)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse kafka version %q: %v", cfg.Version, err)
+		}
+		saramaConfig.Version = version
+	}
+
+	switch cfg.Acks {
+	case "all":
+		saramaConfig.Producer.RequiredAcks = sarama.WaitForAll
+	case "leader":
+		saramaConfig.Producer.RequiredAcks = sarama.WaitForLocal
+	case "none":
+		saramaConfig.Producer.RequiredAcks = sarama.NoResponse
+	default:
+		return nil, fmt.Errorf("Unknown kafka acks %q, must be one of all, leader, none", cfg.Acks)
+	}
+
+	switch cfg.Compression {
+	case "none":
+		saramaConfig.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		saramaConfig.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		saramaConfig.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		saramaConfig.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		saramaConfig.Producer.Compression = sarama.CompressionZSTD
+	default:
+		return nil, fmt.Errorf("Unknown kafka compression %q, must be one of none, gzip, snappy, lz4, zstd", cfg.Compression)
+	}
+
+	switch cfg.Key {
+	case "namespace", "cluster", "auditid":
+	default:
+		return nil, fmt.Errorf("Unknown kafka key %q, must be one of namespace, cluster, auditid", cfg.Key)
+	}
+
+	tlsConfig, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		saramaConfig.Net.TLS.Enable = true
+		saramaConfig.Net.TLS.Config = tlsConfig
+	}
+
+	if cfg.SASL.Mechanism != "" {
+		saramaConfig.Net.SASL.Enable = true
+		saramaConfig.Net.SASL.User = cfg.SASL.User
+		saramaConfig.Net.SASL.Password = cfg.SASL.Password
+
+		switch strings.ToUpper(cfg.SASL.Mechanism) {
+		case sarama.SASLTypePlaintext:
+			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		case sarama.SASLTypeSCRAMSHA256:
+			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+			saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{hashGenerator: sha256.New}
+			}
+		case sarama.SASLTypeSCRAMSHA512:
+			saramaConfig.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+			saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{hashGenerator: sha512.New}
+			}
+		default:
+			return nil, fmt.Errorf("Unknown kafka SASL mechanism %q, must be one of PLAIN, SCRAM-SHA-256, SCRAM-SHA-512", cfg.SASL.Mechanism)
+		}
+	}
+
+	if err := saramaConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid kafka configuration: %v", err)
+	}
+
+	return saramaConfig, nil
+}
+
+func (k *Kafka) Send(auditEvents []*auditv1.Event) error {
+
+	var msgs []*sarama.ProducerMessage
+
+	for _, auditEvent := range auditEvents {
+		auditEventJSON, err := json.Marshal(auditEvent)
+		if err != nil {
+			return Permanent(fmt.Errorf("Could not serialize audit event to JSON: %v", err))
+		}
+
+		topic, err := executeTemplate(k.topic, newTemplateData(k.source, auditEvent))
+		if err != nil {
+			return Permanent(err)
+		}
+
+		msgs = append(msgs, &sarama.ProducerMessage{
+			Topic: topic,
+			Key:   sarama.StringEncoder(k.key(auditEvent)),
+			Value: sarama.ByteEncoder(auditEventJSON),
+		})
+	}
+
+	if err := k.producer.SendMessages(msgs); err != nil {
+		if produceErrs, ok := err.(sarama.ProducerErrors); ok && len(produceErrs) > 0 {
+			return fmt.Errorf("Could not produce %d of %d audit events to kafka: %v",
+				len(produceErrs), len(msgs), produceErrs[0].Err)
+		}
+		return fmt.Errorf("Could not produce audit events to kafka: %v", err)
+	}
+
+	return nil
+}
+
+// key returns the message key of the audit event. Messages with the same
+// key go to the same partition, so their order is preserved.
+func (k *Kafka) key(auditEvent *auditv1.Event) string {
+	switch k.cfg.Kafka.Key {
+	case "auditid":
+		return string(auditEvent.AuditID)
+	case "cluster":
+		return k.source.Cluster
+	default:
+		namespace := ""
+		if auditEvent.ObjectRef != nil {
+			namespace = auditEvent.ObjectRef.Namespace
+		}
+		return k.source.Cluster + "/" + namespace
+	}
+}
+
+func (k *Kafka) Close() error {
+	return k.producer.Close()
+}
+
+// scramClient implements sarama.SCRAMClient using github.com/xdg/scram.
+type scramClient struct {
+	hashGenerator scram.HashGeneratorFcn
+	conversation  *scram.ClientConversation
+}
+
+func (s *scramClient) Begin(userName, password, authzID string) error {
+	client, err := s.hashGenerator.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	s.conversation = client.NewConversation()
+	return nil
+}
+
+func (s *scramClient) Step(challenge string) (string, error) {
+	return s.conversation.Step(challenge)
+}
+
+func (s *scramClient) Done() bool {
+	return s.conversation.Done()
+}
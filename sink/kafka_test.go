@@ -0,0 +1,94 @@
+package sink_test
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/sink"
+)
+
+func testKafkaConfig(broker *sarama.MockBroker) config.OutputConfig {
+	cfg := testOutputConfig()
+	cfg.Type = "kafka"
+	cfg.Kafka = config.KafkaConfig{
+		Brokers:     []string{broker.Addr()},
+		Topic:       "audit-{{ .Cluster }}",
+		Key:         "namespace",
+		Acks:        "all",
+		Compression: "none",
+	}
+	return cfg
+}
+
+func newKafkaBroker(t *testing.T, produceErr sarama.KError) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("audit-my-cluster", 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).
+			SetError("audit-my-cluster", 0, produceErr),
+	})
+	return broker
+}
+
+func produceRequests(broker *sarama.MockBroker) int {
+	count := 0
+	for _, rr := range broker.History() {
+		if _, ok := rr.Request.(*sarama.ProduceRequest); ok {
+			count++
+		}
+	}
+	return count
+}
+
+func TestKafka(t *testing.T) {
+
+	broker := newKafkaBroker(t, sarama.ErrNoError)
+	defer broker.Close()
+
+	kafka, err := sink.NewKafka(testKafkaConfig(broker), sink.Source{Project: "my-project", Cluster: "my-cluster"})
+	assert.Nil(t, err)
+
+	assert.Nil(t, kafka.Send(testEvents(3, "default")))
+	assert.Nil(t, kafka.Close())
+
+	assert.True(t, produceRequests(broker) > 0)
+}
+
+func TestKafkaProduceError(t *testing.T) {
+
+	broker := newKafkaBroker(t, sarama.ErrMessageSizeTooLarge)
+	defer broker.Close()
+
+	kafka, err := sink.NewKafka(testKafkaConfig(broker), sink.Source{Project: "my-project", Cluster: "my-cluster"})
+	assert.Nil(t, err)
+	defer kafka.Close()
+
+	err = kafka.Send(testEvents(2, "default"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Could not produce 2 of 2 audit events to kafka")
+}
+
+func TestKafkaInvalidConfig(t *testing.T) {
+
+	broker := newKafkaBroker(t, sarama.ErrNoError)
+	defer broker.Close()
+
+	for _, modify := range []func(cfg *config.OutputConfig){
+		func(cfg *config.OutputConfig) { cfg.Kafka.Brokers = nil },
+		func(cfg *config.OutputConfig) { cfg.Kafka.Acks = "some" },
+		func(cfg *config.OutputConfig) { cfg.Kafka.Compression = "brotli" },
+		func(cfg *config.OutputConfig) { cfg.Kafka.Key = "verb" },
+		func(cfg *config.OutputConfig) { cfg.Kafka.SASL.Mechanism = "GSSAPI" },
+		func(cfg *config.OutputConfig) { cfg.Kafka.Topic = "audit-{{ .Cluster" },
+	} {
+		cfg := testKafkaConfig(broker)
+		modify(&cfg)
+
+		_, err := sink.NewKafka(cfg, sink.Source{Cluster: "my-cluster"})
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,251 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const lokiPushPath = "/loki/api/v1/push"
+
+// Loki pushes batches of audit events to the push api of loki. Events are
+// grouped into streams by their labels, and within a stream, entries are
+// sent in timestamp order.
+type Loki struct {
+	cfg        config.OutputConfig
+	source     Source
+	pushUrl    string
+	labels     map[string]*template.Template
+	httpClient *http.Client
+
+	// Loki rejects entries older than the last entry of a stream, so keep
+	// track of the last timestamp sent to each stream, and of the newest
+	// timestamp sent to any stream.
+	mutex  sync.Mutex
+	last   map[string]time.Time
+	newest time.Time
+}
+
+// Streams whose last entry is older than the out-of-order window of
+// loki (half of its max_chunk_age, 1h by default) before the newest
+// entry are forgotten, so the tracked streams don't grow without bound.
+const lokiOutOfOrderWindow = time.Hour
+
+type lokiPushRequest struct {
+	Streams []*lokiStream `json:"streams"`
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+
+	key     string
+	entries []lokiEntry
+}
+
+type lokiEntry struct {
+	time time.Time
+	line string
+}
+
+func NewLoki(cfg config.OutputConfig, source Source) (*Loki, error) {
+
+	if cfg.Url == "" {
+		return nil, fmt.Errorf("Output %s has no url", cfg.Name)
+	}
+
+	// The url can be just the address of loki, or the full url of the
+	// push endpoint.
+	pushUrl, err := url.Parse(cfg.Url)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse url %s: %v", cfg.Url, err)
+	}
+	if pushUrl.Path == "" || pushUrl.Path == "/" {
+		pushUrl.Path = lokiPushPath
+	}
+
+	httpClient, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Loki{
+		cfg:        cfg,
+		source:     source,
+		pushUrl:    pushUrl.String(),
+		labels:     map[string]*template.Template{},
+		httpClient: httpClient,
+		last:       map[string]time.Time{},
+	}
+
+	for name, text := range cfg.Loki.Labels {
+		l.labels[name], err = parseTemplate(name, text)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse loki label %s: %v", name, err)
+		}
+	}
+
+	return l, nil
+}
+
+func (l *Loki) Send(auditEvents []*auditv1.Event) error {
+
+	streams := map[string]*lokiStream{}
+	var req lokiPushRequest
+
+	for _, auditEvent := range auditEvents {
+		labels, key, err := l.streamLabels(auditEvent)
+		if err != nil {
+			return Permanent(err)
+		}
+
+		line, err := json.Marshal(auditEvent)
+		if err != nil {
+			return Permanent(fmt.Errorf("Could not serialize audit event to JSON: %v", err))
+		}
+
+		stream, ok := streams[key]
+		if !ok {
+			stream = &lokiStream{Stream: labels, key: key}
+			streams[key] = stream
+			req.Streams = append(req.Streams, stream)
+		}
+
+		stream.entries = append(stream.entries, lokiEntry{
+			time: auditEvent.StageTimestamp.Time,
+			line: string(line),
+		})
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	last := map[string]time.Time{}
+
+	for _, stream := range req.Streams {
+		sort.SliceStable(stream.entries, func(i, j int) bool {
+			return stream.entries[i].time.Before(stream.entries[j].time)
+		})
+
+		// Entries older than what was already sent to the stream are sent
+		// with the timestamp of the last entry instead.
+		prev := l.last[stream.key]
+		for _, entry := range stream.entries {
+			ts := entry.time
+			if ts.Before(prev) {
+				ts = prev
+			}
+			stream.Values = append(stream.Values, [2]string{strconv.FormatInt(ts.UnixNano(), 10), entry.line})
+			prev = ts
+		}
+		last[stream.key] = prev
+	}
+
+	if err := l.push(&req); err != nil {
+		return err
+	}
+
+	for key, ts := range last {
+		l.last[key] = ts
+		if ts.After(l.newest) {
+			l.newest = ts
+		}
+	}
+
+	oldest := l.newest.Add(-lokiOutOfOrderWindow)
+	for key, ts := range l.last {
+		if ts.Before(oldest) {
+			delete(l.last, key)
+		}
+	}
+
+	return nil
+}
+
+// streamLabels returns the labels of the stream for the audit event, and
+// a key identifying the stream. Labels with empty values are left out.
+func (l *Loki) streamLabels(auditEvent *auditv1.Event) (map[string]string, string, error) {
+
+	data := newTemplateData(l.source, auditEvent)
+	labels := map[string]string{}
+	var names []string
+
+	for name, tmpl := range l.labels {
+		val, err := executeTemplate(tmpl, data)
+		if err != nil {
+			return nil, "", err
+		}
+		if val == "" {
+			continue
+		}
+		labels[name] = val
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%q", name, labels[name]))
+	}
+
+	return labels, "{" + strings.Join(parts, ",") + "}", nil
+}
+
+func (l *Loki) push(pushReq *lokiPushRequest) error {
+
+	body, err := json.Marshal(pushReq)
+	if err != nil {
+		return Permanent(fmt.Errorf("Could not serialize push request to JSON: %v", err))
+	}
+
+	req, err := http.NewRequest("POST", l.pushUrl, bytes.NewBuffer(body))
+	if err != nil {
+		return Permanent(fmt.Errorf("Could not construct http request to %s: %v", l.pushUrl, err))
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if l.cfg.Loki.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", l.cfg.Loki.TenantID)
+	}
+	if l.cfg.Loki.Username != "" {
+		req.SetBasicAuth(l.cfg.Loki.Username, l.cfg.Loki.Password)
+	}
+	for key, val := range l.cfg.Headers {
+		req.Header.Set(key, val)
+	}
+
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Could not POST audit events to %s: %v", l.pushUrl, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	log.Debugf("response from post: status=%s body=%s:", resp.Status, string(respBody))
+
+	if !isSuccess(l.cfg, resp.StatusCode) {
+		return statusError(resp.StatusCode, fmt.Errorf("Unsuccessful response %s from POST of audit events: %s", resp.Status, string(respBody)))
+	}
+
+	return nil
+}
+
+func (l *Loki) Close() error {
+	return nil
+}
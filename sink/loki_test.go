@@ -0,0 +1,116 @@
+package sink_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/sink"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type lokiPush struct {
+	Streams []struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	} `json:"streams"`
+}
+
+func TestLoki(t *testing.T) {
+
+	var pushes []lokiPush
+	var header http.Header
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/loki/api/v1/push", r.URL.Path)
+		header = r.Header
+		body, _ := ioutil.ReadAll(r.Body)
+		var push lokiPush
+		json.Unmarshal(body, &push)
+		pushes = append(pushes, push)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	cfg := testOutputConfig()
+	cfg.Type = "loki"
+	cfg.Url = server.URL
+	cfg.Loki = config.LokiConfig{
+		Labels: map[string]string{
+			"job":       "swb",
+			"cluster":   "{{ .Cluster }}",
+			"namespace": "{{ .Namespace }}",
+		},
+		TenantID: "team-a",
+	}
+
+	loki, err := sink.NewLoki(cfg, sink.Source{Cluster: "my-cluster"})
+	assert.Nil(t, err)
+
+	start := time.Date(2020, 5, 17, 10, 0, 0, 0, time.UTC)
+	auditEvents := append(testEvents(2, "default"), testEvents(1, "")...)
+	auditEvents[0].StageTimestamp = metav1.NewMicroTime(start.Add(2 * time.Second))
+	auditEvents[1].StageTimestamp = metav1.NewMicroTime(start.Add(1 * time.Second))
+	auditEvents[2].StageTimestamp = metav1.NewMicroTime(start)
+
+	assert.Nil(t, loki.Send(auditEvents))
+	assert.Equal(t, "team-a", header.Get("X-Scope-OrgID"))
+
+	streams := pushes[0].Streams
+	assert.Equal(t, 2, len(streams))
+	assert.Equal(t, map[string]string{"job": "swb", "cluster": "my-cluster", "namespace": "default"}, streams[0].Stream)
+	assert.Equal(t, map[string]string{"job": "swb", "cluster": "my-cluster"}, streams[1].Stream)
+
+	// Sorted by timestamp within the stream
+	assert.Equal(t, 2, len(streams[0].Values))
+	assert.Equal(t, "1589709601000000000", streams[0].Values[0][0])
+	assert.Contains(t, streams[0].Values[0][1], `"auditID":"default-1"`)
+	assert.Equal(t, "1589709602000000000", streams[0].Values[1][0])
+
+	// An older entry for the same stream is sent with the timestamp of the
+	// last entry.
+	late := testEvents(1, "default")
+	late[0].StageTimestamp = metav1.NewMicroTime(start)
+	assert.Nil(t, loki.Send(late))
+	assert.Equal(t, "1589709602000000000", pushes[1].Streams[0].Values[0][0])
+
+	// Once other streams are more than an hour ahead, the stream is
+	// forgotten and older entries keep their timestamp.
+	later := testEvents(1, "kube-system")
+	later[0].StageTimestamp = metav1.NewMicroTime(start.Add(2 * time.Hour))
+	assert.Nil(t, loki.Send(later))
+
+	late[0].StageTimestamp = metav1.NewMicroTime(start.Add(-time.Second))
+	assert.Nil(t, loki.Send(late))
+	assert.Equal(t, "1589709599000000000", pushes[3].Streams[0].Values[0][0])
+}
+
+func TestLokiErrors(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("entry out of order"))
+	}))
+	defer server.Close()
+
+	cfg := testOutputConfig()
+	cfg.Type = "loki"
+	cfg.Url = server.URL
+	cfg.Loki.Labels = map[string]string{"job": "swb"}
+
+	loki, err := sink.NewLoki(cfg, sink.Source{})
+	assert.Nil(t, err)
+
+	err = loki.Send(testEvents(1, "default"))
+	assert.NotNil(t, err)
+	assert.True(t, sink.IsPermanent(err))
+
+	cfg.Loki.Labels = map[string]string{"job": "{{ .Job"}
+	_, err = sink.NewLoki(cfg, sink.Source{})
+	assert.NotNil(t, err)
+}
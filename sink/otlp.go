@@ -0,0 +1,336 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	otlpLogsPath  = "/v1/logs"
+	otlpScopeName = "github.com/sysdiglabs/stackdriver-webhook-bridge"
+)
+
+// OTLP exports batches of audit events as OpenTelemetry log records, using
+// OTLP over http (protobuf or json) or grpc. Each batch is sent as one
+// export request.
+type OTLP struct {
+	cfg        config.OutputConfig
+	url        string
+	resource   *resourcepb.Resource
+	httpClient *http.Client
+	conn       *grpc.ClientConn
+	client     collogspb.LogsServiceClient
+}
+
+func otlpString(key string, val string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: val}}}
+}
+
+func otlpInt(key string, val int64) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: val}}}
+}
+
+func NewOTLP(cfg config.OutputConfig, source Source) (*OTLP, error) {
+
+	if cfg.Url == "" {
+		return nil, fmt.Errorf("Output %s has no url", cfg.Name)
+	}
+
+	o := &OTLP{
+		cfg: cfg,
+		resource: &resourcepb.Resource{
+			Attributes: []*commonpb.KeyValue{
+				otlpString("service.name", "stackdriver-webhook-bridge"),
+				otlpString("cloud.provider", "gcp"),
+				otlpString("cloud.account.id", source.Project),
+				otlpString("k8s.cluster.name", source.Cluster),
+			},
+		},
+	}
+
+	for key, val := range cfg.OTLP.ResourceAttributes {
+		o.resource.Attributes = append(o.resource.Attributes, otlpString(key, val))
+	}
+
+	switch cfg.OTLP.Protocol {
+	case "http/protobuf", "http/json":
+		// The url can be just the address of the collector, or the full
+		// url of the logs endpoint.
+		logsUrl, err := url.Parse(cfg.Url)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse url %s: %v", cfg.Url, err)
+		}
+		if logsUrl.Path == "" || logsUrl.Path == "/" {
+			logsUrl.Path = otlpLogsPath
+		}
+
+		o.httpClient, err = newHTTPClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.HTTP.Timeout <= 0 {
+			o.httpClient.Timeout = cfg.OTLP.Timeout
+		}
+		o.url = logsUrl.String()
+	case "grpc":
+		// The url is host:port, optionally with a http:// (insecure) or
+		// https:// scheme.
+		target := cfg.Url
+		insecure := cfg.OTLP.Insecure
+		if strings.HasPrefix(target, "http://") {
+			target = strings.TrimPrefix(target, "http://")
+			insecure = true
+		}
+		target = strings.TrimPrefix(target, "https://")
+
+		opts := []grpc.DialOption{}
+		if insecure {
+			opts = append(opts, grpc.WithInsecure())
+		} else {
+			// Without insecure, grpc always uses tls, with the tls
+			// settings of the output.
+			tlsCfg := cfg.TLS
+			tlsCfg.Enabled = true
+			tlsConfig, err := newTLSConfig(tlsCfg)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+		}
+
+		// Dialing doesn't block, connection errors show up when sending.
+		conn, err := grpc.Dial(target, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("Could not create grpc connection to %s: %v", target, err)
+		}
+
+		o.url = target
+		o.conn = conn
+		o.client = collogspb.NewLogsServiceClient(conn)
+	default:
+		return nil, fmt.Errorf("Unknown otlp protocol %q, must be one of http/protobuf, http/json, grpc", cfg.OTLP.Protocol)
+	}
+
+	return o, nil
+}
+
+// logRecord maps the audit event to an OpenTelemetry log record, with the
+// json of the audit event as the body.
+func logRecord(auditEvent *auditv1.Event, observed time.Time) (*logspb.LogRecord, error) {
+
+	auditEventJSON, err := json.Marshal(auditEvent)
+	if err != nil {
+		return nil, fmt.Errorf("Could not serialize audit event to JSON: %v", err)
+	}
+
+	record := &logspb.LogRecord{
+		TimeUnixNano:         uint64(auditEvent.StageTimestamp.Time.UnixNano()),
+		ObservedTimeUnixNano: uint64(observed.UnixNano()),
+		SeverityNumber:       logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+		SeverityText:         "INFO",
+		Body:                 &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: string(auditEventJSON)}},
+		Attributes: []*commonpb.KeyValue{
+			otlpString("k8s.audit.id", string(auditEvent.AuditID)),
+			otlpString("k8s.audit.stage", string(auditEvent.Stage)),
+			otlpString("k8s.audit.verb", auditEvent.Verb),
+			otlpString("user.name", auditEvent.User.Username),
+		},
+	}
+
+	if ref := auditEvent.ObjectRef; ref != nil {
+		if ref.Namespace != "" {
+			record.Attributes = append(record.Attributes, otlpString("k8s.namespace.name", ref.Namespace))
+		}
+		record.Attributes = append(record.Attributes, otlpString("k8s.audit.resource", ref.Resource))
+		if ref.Name != "" {
+			record.Attributes = append(record.Attributes, otlpString("k8s.audit.name", ref.Name))
+		}
+	}
+
+	if auditEvent.ResponseStatus != nil {
+		code := auditEvent.ResponseStatus.Code
+		record.Attributes = append(record.Attributes, otlpInt("http.status_code", int64(code)))
+
+		if code >= 500 {
+			record.SeverityNumber, record.SeverityText = logspb.SeverityNumber_SEVERITY_NUMBER_ERROR, "ERROR"
+		} else if code >= 400 {
+			record.SeverityNumber, record.SeverityText = logspb.SeverityNumber_SEVERITY_NUMBER_WARN, "WARN"
+		}
+	}
+
+	return record, nil
+}
+
+func (o *OTLP) Send(auditEvents []*auditv1.Event) error {
+
+	scopeLogs := &logspb.ScopeLogs{
+		Scope: &commonpb.InstrumentationScope{Name: otlpScopeName},
+	}
+
+	now := time.Now()
+	for _, auditEvent := range auditEvents {
+		record, err := logRecord(auditEvent, now)
+		if err != nil {
+			return Permanent(err)
+		}
+		scopeLogs.LogRecords = append(scopeLogs.LogRecords, record)
+	}
+
+	req := &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{
+			{
+				Resource:  o.resource,
+				ScopeLogs: []*logspb.ScopeLogs{scopeLogs},
+			},
+		},
+	}
+
+	var resp *collogspb.ExportLogsServiceResponse
+	var err error
+
+	if o.client != nil {
+		resp, err = o.exportGRPC(req)
+	} else {
+		resp, err = o.exportHTTP(req)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return partialSuccessError(resp, len(auditEvents))
+}
+
+// partialSuccessError returns a *PartialError if the collector rejected
+// some of the log records.
+func partialSuccessError(resp *collogspb.ExportLogsServiceResponse, numRecords int) error {
+
+	rejected := resp.GetPartialSuccess().GetRejectedLogRecords()
+	if rejected <= 0 {
+		return nil
+	}
+
+	if rejected > int64(numRecords) {
+		rejected = int64(numRecords)
+	}
+
+	return &PartialError{
+		Rejected: int(rejected),
+		Err:      fmt.Errorf("Collector rejected %d of %d log records: %s", rejected, numRecords, resp.PartialSuccess.ErrorMessage),
+	}
+}
+
+func (o *OTLP) exportHTTP(exportReq *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+
+	var body []byte
+	var err error
+	contentType := "application/x-protobuf"
+
+	if o.cfg.OTLP.Protocol == "http/json" {
+		// OTLP/JSON encodes enums as numbers.
+		body, err = protojson.MarshalOptions{UseEnumNumbers: true}.Marshal(exportReq)
+		contentType = "application/json"
+	} else {
+		body, err = proto.Marshal(exportReq)
+	}
+	if err != nil {
+		return nil, Permanent(fmt.Errorf("Could not serialize export request: %v", err))
+	}
+
+	req, err := http.NewRequest("POST", o.url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, Permanent(fmt.Errorf("Could not construct http request to %s: %v", o.url, err))
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	for key, val := range o.cfg.Headers {
+		req.Header.Set(key, val)
+	}
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Could not POST log records to %s: %v", o.url, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	log.Debugf("response from post: status=%s body=%s:", resp.Status, string(respBody))
+
+	if !isSuccess(o.cfg, resp.StatusCode) {
+		return nil, statusError(resp.StatusCode, fmt.Errorf("Unsuccessful response %s from POST of log records: %s", resp.Status, string(respBody)))
+	}
+
+	exportResp := &collogspb.ExportLogsServiceResponse{}
+	if len(respBody) == 0 {
+		return exportResp, nil
+	}
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(respBody, exportResp)
+	} else {
+		err = proto.Unmarshal(respBody, exportResp)
+	}
+	if err != nil {
+		log.Warnf("Could not parse export response from %s: %v", o.url, err)
+	}
+
+	return exportResp, nil
+}
+
+func (o *OTLP) exportGRPC(exportReq *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.cfg.OTLP.Timeout)
+	defer cancel()
+
+	if len(o.cfg.Headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(o.cfg.Headers))
+	}
+
+	exportResp, err := o.client.Export(ctx, exportReq)
+	if err != nil {
+		code := status.Code(err)
+		err = fmt.Errorf("Could not export log records to %s: %v", o.url, err)
+
+		// https://opentelemetry.io/docs/specs/otlp/#failures
+		switch code {
+		case codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted,
+			codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+			return nil, err
+		default:
+			return nil, Permanent(err)
+		}
+	}
+
+	return exportResp, nil
+}
+
+func (o *OTLP) Close() error {
+	if o.conn != nil {
+		return o.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package sink_test
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/sink"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+func testOTLPConfig(url string, protocol string) config.OutputConfig {
+	cfg := testOutputConfig()
+	cfg.Type = "otlp"
+	cfg.Url = url
+	cfg.OTLP = config.OTLPConfig{
+		Protocol: protocol,
+		Timeout:  time.Second,
+	}
+	return cfg
+}
+
+// attributes returns the string/int attributes in the KeyValue list.
+func attributes(kvs []*commonpb.KeyValue) map[string]interface{} {
+	attrs := map[string]interface{}{}
+	for _, kv := range kvs {
+		if s, ok := kv.Value.Value.(*commonpb.AnyValue_StringValue); ok {
+			attrs[kv.Key] = s.StringValue
+		} else {
+			attrs[kv.Key] = kv.Value.GetIntValue()
+		}
+	}
+	return attrs
+}
+
+func checkExportRequest(t *testing.T, req *collogspb.ExportLogsServiceRequest) {
+	resourceLogs := req.ResourceLogs[0]
+	assert.Equal(t, "my-cluster", attributes(resourceLogs.Resource.Attributes)["k8s.cluster.name"])
+
+	records := resourceLogs.ScopeLogs[0].LogRecords
+	assert.Equal(t, 2, len(records))
+
+	record := records[0]
+	assert.Equal(t, logspb.SeverityNumber_SEVERITY_NUMBER_INFO, record.SeverityNumber)
+	assert.Equal(t, "INFO", record.SeverityText)
+
+	attrs := attributes(record.Attributes)
+	assert.Equal(t, "default", attrs["k8s.namespace.name"])
+	assert.Equal(t, "default-0", attrs["k8s.audit.id"])
+	assert.Equal(t, int64(201), attrs["http.status_code"])
+}
+
+func TestOTLPHTTPJSON(t *testing.T) {
+
+	var req map[string]interface{}
+	var header http.Header
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/logs", r.URL.Path)
+		header = r.Header
+		body, _ := ioutil.ReadAll(r.Body)
+		req = nil
+		json.Unmarshal(body, &req)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"partialSuccess":{"rejectedLogRecords":"1","errorMessage":"bad record"}}`))
+	}))
+	defer server.Close()
+
+	otlp, err := sink.NewOTLP(testOTLPConfig(server.URL, "http/json"), sink.Source{Project: "my-project", Cluster: "my-cluster"})
+	assert.Nil(t, err)
+
+	auditEvents := testEvents(2, "default")
+	auditEvents[1].ResponseStatus.Code = 403
+
+	err = otlp.Send(auditEvents)
+	partialErr, ok := err.(*sink.PartialError)
+	assert.True(t, ok)
+	assert.Equal(t, 1, partialErr.Rejected)
+	assert.Contains(t, err.Error(), "bad record")
+	assert.Equal(t, "application/json", header.Get("Content-Type"))
+
+	resourceLogs := req["resourceLogs"].([]interface{})[0].(map[string]interface{})
+	resourceAttrs := resourceLogs["resource"].(map[string]interface{})["attributes"].([]interface{})
+	assert.Contains(t, resourceAttrs, map[string]interface{}{"key": "k8s.cluster.name", "value": map[string]interface{}{"stringValue": "my-cluster"}})
+
+	records := resourceLogs["scopeLogs"].([]interface{})[0].(map[string]interface{})["logRecords"].([]interface{})
+	assert.Equal(t, 2, len(records))
+
+	record := records[1].(map[string]interface{})
+	assert.Equal(t, float64(13), record["severityNumber"])
+	assert.Equal(t, "WARN", record["severityText"])
+	assert.Contains(t, record["body"].(map[string]interface{})["stringValue"], `"auditID":"default-1"`)
+
+	attrs := record["attributes"].([]interface{})
+	assert.Contains(t, attrs, map[string]interface{}{"key": "k8s.namespace.name", "value": map[string]interface{}{"stringValue": "default"}})
+	assert.Contains(t, attrs, map[string]interface{}{"key": "http.status_code", "value": map[string]interface{}{"intValue": "403"}})
+}
+
+func TestOTLPHTTPProtobuf(t *testing.T) {
+
+	req := &collogspb.ExportLogsServiceRequest{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Nil(t, proto.Unmarshal(body, req))
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer server.Close()
+
+	otlp, err := sink.NewOTLP(testOTLPConfig(server.URL, "http/protobuf"), sink.Source{Project: "my-project", Cluster: "my-cluster"})
+	assert.Nil(t, err)
+
+	assert.Nil(t, otlp.Send(testEvents(2, "default")))
+	checkExportRequest(t, req)
+}
+
+type logsServer struct {
+	collogspb.UnimplementedLogsServiceServer
+
+	req *collogspb.ExportLogsServiceRequest
+	md  metadata.MD
+}
+
+func (s *logsServer) Export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	s.req = req
+	s.md, _ = metadata.FromIncomingContext(ctx)
+	return &collogspb.ExportLogsServiceResponse{
+		PartialSuccess: &collogspb.ExportLogsPartialSuccess{RejectedLogRecords: 1, ErrorMessage: "bad"},
+	}, nil
+}
+
+func TestOTLPGRPC(t *testing.T) {
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	logs := &logsServer{}
+	server := grpc.NewServer()
+	collogspb.RegisterLogsServiceServer(server, logs)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	cfg := testOTLPConfig("http://"+lis.Addr().String(), "grpc")
+	cfg.Headers = map[string]string{"X-Tenant": "team-a"}
+
+	otlp, err := sink.NewOTLP(cfg, sink.Source{Project: "my-project", Cluster: "my-cluster"})
+	assert.Nil(t, err)
+	defer otlp.Close()
+
+	err = otlp.Send(testEvents(2, "default"))
+	partialErr, ok := err.(*sink.PartialError)
+	assert.True(t, ok)
+	assert.Equal(t, 1, partialErr.Rejected)
+	assert.Contains(t, err.Error(), "bad")
+
+	assert.Equal(t, []string{"team-a"}, logs.md.Get("x-tenant"))
+	checkExportRequest(t, logs.req)
+}
+
+func TestOTLPGRPCTLS(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "swb-otlp")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil)
+	serverCert := newTestCert(t, "collector.example.com", ca)
+
+	caFile := filepath.Join(dir, "ca.crt")
+	ca.write(t, caFile, "", time.Now())
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	logs := &logsServer{}
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.cert.Raw}, PrivateKey: serverCert.key}},
+	})))
+	collogspb.RegisterLogsServiceServer(server, logs)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	// The collector's certificate is only trusted with the CA of the
+	// output's tls settings.
+	cfg := testOTLPConfig(lis.Addr().String(), "grpc")
+	otlp, err := sink.NewOTLP(cfg, sink.Source{Cluster: "my-cluster"})
+	assert.Nil(t, err)
+	assert.NotNil(t, otlp.Send(testEvents(2, "default")))
+	otlp.Close()
+
+	cfg.TLS = config.TLSConfig{CAFile: caFile, ServerName: "collector.example.com"}
+	otlp, err = sink.NewOTLP(cfg, sink.Source{Cluster: "my-cluster"})
+	assert.Nil(t, err)
+	defer otlp.Close()
+
+	err = otlp.Send(testEvents(2, "default"))
+	_, ok := err.(*sink.PartialError)
+	assert.True(t, ok)
+	checkExportRequest(t, logs.req)
+}
+
+func TestOTLPInvalidConfig(t *testing.T) {
+
+	_, err := sink.NewOTLP(testOTLPConfig("http://collector:4318", "thrift"), sink.Source{})
+	assert.NotNil(t, err)
+
+	_, err = sink.NewOTLP(testOTLPConfig("", "grpc"), sink.Source{})
+	assert.NotNil(t, err)
+}
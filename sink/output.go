@@ -0,0 +1,771 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/checker/decls"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/filter"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The annotation added to audit events whose request and response objects
+// were removed to fit into a batch, like the truncate audit backend of
+// the API server does.
+const truncatedAnnotation = "audit.k8s.io/truncated"
+
+// Output wraps a sink with the settings common to all outputs: a filter
+// expression selecting the events sent to the output, batching, retries,
+// rate limits, a circuit breaker and concurrent workers.
+//
+// Events are batched in lanes, each with its own worker sending the
+// batches of the lane in order. Only required outputs with a single
+// worker and without a queue send batches in Add and Flush themselves
+// instead. Required outputs with workers wait for room in full queues,
+// other outputs never hold up the poller: batches that don't fit into
+// their queues are spooled or dropped.
+type Output struct {
+	Name    string
+	cfg     config.OutputConfig
+	sink    Sink
+	filter  *filter.Expression
+	limiter *rateLimiter
+	breaker *circuitBreaker
+	spool   *spool
+
+	// Only one worker replays the spool at a time.
+	replayMutex sync.Mutex
+
+	// Events rejected permanently by the sink, if rejected_file is set.
+	rejectedMutex sync.Mutex
+	rejectedFile  *os.File
+
+	// Whether the size of the json of events is needed, for
+	// max_batch_bytes or a rate limit on bytes.
+	needSize bool
+
+	mutex sync.Mutex
+	lanes []*lane
+
+	// The results of batches sent by workers or because of max_linger,
+	// reported with the next Add or Flush.
+	resultsMutex sync.Mutex
+	sent         int
+	failed       int
+
+	// The batches queued or being sent by workers.
+	inflight sync.WaitGroup
+
+	done    chan struct{}
+	linger  sync.WaitGroup
+	replay  sync.WaitGroup
+	workers sync.WaitGroup
+}
+
+// lane holds the batch being built for one worker, and the queue of
+// batches to be sent by it.
+type lane struct {
+	pending      []*auditv1.Event
+	pendingBytes int
+	pendingSince time.Time
+	queue        chan *batch
+}
+
+// batch holds the events sent at once, and the size of their json if it
+// is known, or -1.
+type batch struct {
+	events []*auditv1.Event
+	bytes  int
+}
+
+func NewOutput(cfg config.OutputConfig, s Sink) (*Output, error) {
+
+	o := &Output{
+		Name:     cfg.Name,
+		cfg:      cfg,
+		sink:     s,
+		limiter:  newRateLimiter(cfg.Name, cfg.RateLimit),
+		needSize: cfg.MaxBatchBytes > 0 || cfg.RateLimit.BytesPerSecond > 0,
+		breaker:  newCircuitBreaker(cfg.Name, cfg.CircuitBreaker.FailureThreshold, cfg.CircuitBreaker.OpenTimeout),
+		done:     make(chan struct{}),
+	}
+
+	if o.breaker != nil {
+		var err error
+		o.spool, err = newSpool(cfg.CircuitBreaker.SpoolDir, cfg.Name, cfg.CircuitBreaker.SpoolMaxSizeMB)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.RejectedFile != "" {
+		var err error
+		o.rejectedFile, err = os.OpenFile(cfg.RejectedFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Could not open rejected file %s: %v", cfg.RejectedFile, err)
+		}
+	}
+
+	if cfg.Filter != "" {
+		var err error
+		o.filter, err = filter.Compile(cfg.Name, cfg.Filter, decls.Bool)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	workers := cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	switch cfg.Ordering {
+	case "", "object":
+	case "global":
+		if workers > 1 {
+			return nil, fmt.Errorf("Output %s can't use more than one worker with global ordering", cfg.Name)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown ordering %q for output %s, must be one of object, global", cfg.Ordering, cfg.Name)
+	}
+
+	for i := 0; i < workers; i++ {
+		l := &lane{}
+		if workers > 1 || cfg.QueueSize > 0 || !o.Required() {
+			l.queue = make(chan *batch, cfg.QueueSize)
+			o.workers.Add(1)
+			go o.worker(l)
+		}
+		o.lanes = append(o.lanes, l)
+	}
+
+	if cfg.MaxLinger > 0 {
+		o.linger.Add(1)
+		go o.lingerLoop()
+	}
+
+	if o.spool != nil {
+		o.replay.Add(1)
+		go o.replayLoop()
+	}
+
+	return o, nil
+}
+
+// Add queues the audit events matching the filter of the output, and
+// sends all full batches. It returns the number of events successfully
+// sent and the number of events that could not be sent since the last
+// call of Add or Flush. With workers, this doesn't include batches that
+// are still queued.
+//
+// If the queue of a worker of a required output is full, Add blocks until
+// there is room.
+func (o *Output) Add(auditEvents []*auditv1.Event) (int, int) {
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	for _, auditEvent := range auditEvents {
+		o.add(auditEvent, 0)
+	}
+
+	return o.results()
+}
+
+// AddEvent is like Add for a single audit event whose json is size bytes
+// long, e.g. because the caller already serialized it. A size of 0 means
+// it is not known.
+func (o *Output) AddEvent(auditEvent *auditv1.Event, size int) (int, int) {
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.add(auditEvent, size)
+
+	return o.results()
+}
+
+func (o *Output) add(auditEvent *auditv1.Event, size int) {
+
+	if !o.matches(auditEvent) {
+		promOutputEventFiltered.WithLabelValues(o.Name).Inc()
+		return
+	}
+
+	auditEvent, size = o.fit(auditEvent, size)
+	l := o.lane(auditEvent)
+
+	// Send the queued events first if the event doesn't fit into the
+	// batch anymore. An event larger than max_batch_bytes is sent in a
+	// batch of its own.
+	if len(l.pending) > 0 && o.cfg.MaxBatchBytes > 0 && l.pendingBytes+size > o.cfg.MaxBatchBytes {
+		o.dispatch(l)
+	}
+
+	if len(l.pending) == 0 {
+		l.pendingSince = time.Now()
+	}
+	l.pending = append(l.pending, auditEvent)
+	l.pendingBytes += size
+	promOutputQueuedEvents.WithLabelValues(o.Name).Inc()
+
+	if len(l.pending) >= o.cfg.BatchSize {
+		o.dispatch(l)
+	}
+}
+
+// lane returns the lane of the audit event. All events of an object, or
+// with the same ordering key for sinks that have one, use the same lane,
+// so they are sent in order.
+func (o *Output) lane(auditEvent *auditv1.Event) *lane {
+
+	if len(o.lanes) == 1 {
+		return o.lanes[0]
+	}
+
+	h := fnv.New32a()
+	key := ""
+	if orderedSink, ok := o.sink.(OrderedSink); ok {
+		key = orderedSink.OrderingKey(auditEvent)
+	}
+	if key != "" {
+		h.Write([]byte(key))
+	} else if ref := auditEvent.ObjectRef; ref != nil {
+		h.Write([]byte(ref.Namespace + "/" + ref.Resource + "/" + ref.Name))
+	}
+
+	return o.lanes[h.Sum32()%uint32(len(o.lanes))]
+}
+
+// fit returns the audit event and the size of its json, if it is needed.
+// If the event is larger than max_batch_bytes, its request and response
+// objects are removed.
+func (o *Output) fit(auditEvent *auditv1.Event, size int) (*auditv1.Event, int) {
+
+	if !o.needSize {
+		return auditEvent, 0
+	}
+
+	if size <= 0 {
+		size = eventSize(auditEvent)
+	}
+	if o.cfg.MaxBatchBytes <= 0 || size <= o.cfg.MaxBatchBytes {
+		return auditEvent, size
+	}
+
+	if auditEvent.RequestObject == nil && auditEvent.ResponseObject == nil {
+		log.Warnf("Audit event %s (%d bytes) is larger than max_batch_bytes of output %s, sending it on its own",
+			auditEvent.AuditID, size, o.Name)
+		return auditEvent, size
+	}
+
+	truncated := *auditEvent
+	truncated.RequestObject = nil
+	truncated.ResponseObject = nil
+	truncated.Annotations = map[string]string{}
+	for key, val := range auditEvent.Annotations {
+		truncated.Annotations[key] = val
+	}
+	truncated.Annotations[truncatedAnnotation] = "true"
+
+	promOutputEventTruncated.WithLabelValues(o.Name).Inc()
+	log.Warnf("Audit event %s (%d bytes) is larger than max_batch_bytes of output %s, removed its request and response objects",
+		auditEvent.AuditID, size, o.Name)
+
+	return &truncated, eventSize(&truncated)
+}
+
+// eventSize returns the size of the json of the audit event, including a
+// separator.
+func eventSize(auditEvent *auditv1.Event) int {
+	auditEventJSON, err := json.Marshal(auditEvent)
+	if err != nil {
+		// Fails when sending it anyway
+		return 0
+	}
+	return len(auditEventJSON) + 1
+}
+
+// dispatch sends the pending events of the lane as one batch, or queues
+// the batch for the worker of the lane.
+func (o *Output) dispatch(l *lane) {
+
+	b := &batch{events: l.pending, bytes: -1}
+	if o.needSize {
+		b.bytes = l.pendingBytes
+	}
+	l.pending = nil
+	l.pendingBytes = 0
+
+	if l.queue == nil {
+		o.addResults(o.sendBatch(b))
+		promOutputQueuedEvents.WithLabelValues(o.Name).Sub(float64(len(b.events)))
+		return
+	}
+
+	o.inflight.Add(1)
+	promOutputQueuedBatches.WithLabelValues(o.Name).Inc()
+
+	// Other outputs must not hold up the poller, a batch that doesn't fit
+	// into their queue is spooled or dropped instead. Close still waits
+	// for room, to send everything that is queued.
+	if o.Required() || o.closed() {
+		l.queue <- b
+		return
+	}
+
+	select {
+	case l.queue <- b:
+	default:
+		promOutputQueuedBatches.WithLabelValues(o.Name).Dec()
+		o.inflight.Done()
+		o.overflow(b.events)
+	}
+}
+
+// overflow handles a batch that doesn't fit into the queue of a worker,
+// writing it to the spool if there is one, and dropping it otherwise.
+func (o *Output) overflow(batch []*auditv1.Event) {
+
+	if len(batch) == 0 {
+		return
+	}
+
+	promOutputQueuedEvents.WithLabelValues(o.Name).Sub(float64(len(batch)))
+
+	if o.spool != nil {
+		err := o.spool.write(batch)
+		if err == nil {
+			promOutputEventSpooled.WithLabelValues(o.Name).Add(float64(len(batch)))
+			log.Warnf("Queue of output %s is full, spooled %d audit events", o.Name, len(batch))
+			return
+		}
+		log.Errorf("Could not spool %d audit events of output %s: %v", len(batch), o.Name, err)
+	}
+
+	promOutputEventDropped.WithLabelValues(o.Name).Add(float64(len(batch)))
+	promOutputEventSendError.WithLabelValues(o.Name).Add(float64(len(batch)))
+	log.Errorf("Queue of output %s is full, dropped %d audit events", o.Name, len(batch))
+	o.addResults(0, len(batch))
+}
+
+// closed returns true once Close was called.
+func (o *Output) closed() bool {
+	select {
+	case <-o.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (o *Output) worker(l *lane) {
+
+	defer o.workers.Done()
+
+	for b := range l.queue {
+		promOutputQueuedBatches.WithLabelValues(o.Name).Dec()
+		o.addResults(o.sendBatch(b))
+		promOutputQueuedEvents.WithLabelValues(o.Name).Sub(float64(len(b.events)))
+		o.inflight.Done()
+	}
+}
+
+func (o *Output) addResults(sent int, failed int) {
+	o.resultsMutex.Lock()
+	defer o.resultsMutex.Unlock()
+
+	o.sent += sent
+	o.failed += failed
+}
+
+// results returns the results since the last call, and resets them.
+func (o *Output) results() (int, int) {
+	o.resultsMutex.Lock()
+	defer o.resultsMutex.Unlock()
+
+	sent, failed := o.sent, o.failed
+	o.sent, o.failed = 0, 0
+	return sent, failed
+}
+
+// lingerLoop sends the queued events once the oldest of them has waited
+// for max_linger, instead of waiting for the end of the poll.
+func (o *Output) lingerLoop() {
+
+	defer o.linger.Done()
+
+	ticker := time.NewTicker(o.cfg.MaxLinger / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-o.done:
+			return
+		case <-ticker.C:
+			o.mutex.Lock()
+			for _, l := range o.lanes {
+				if len(l.pending) > 0 && time.Since(l.pendingSince) >= o.cfg.MaxLinger {
+					o.dispatch(l)
+				}
+			}
+			o.mutex.Unlock()
+		}
+	}
+}
+
+// replayLoop sends the spooled events once the circuit breaker lets
+// batches through again, even if no new events are added to the output.
+func (o *Output) replayLoop() {
+
+	defer o.replay.Done()
+
+	ticker := time.NewTicker(o.cfg.CircuitBreaker.OpenTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-o.done:
+			return
+		case <-ticker.C:
+			if o.spool.empty() || !o.breaker.ready() {
+				continue
+			}
+
+			// An empty batch only replays the spool, on the worker of
+			// the first lane (with any events pending there).
+			o.mutex.Lock()
+			o.dispatch(o.lanes[0])
+			o.mutex.Unlock()
+		}
+	}
+}
+
+// CircuitBreakerState returns the state of the circuit breaker of the
+// output: closed, half-open or open.
+func (o *Output) CircuitBreakerState() string {
+	return o.breaker.getState()
+}
+
+// RawEntries returns true if the output keeps the raw log entries, which
+// are passed to it with AddRawEntry.
+func (o *Output) RawEntries() bool {
+	_, ok := o.sink.(RawSink)
+	return ok && o.cfg.Archive.RawEntries
+}
+
+// AddRawEntry passes the json of a raw log entry to the sink of the
+// output. Raw entries are neither filtered nor batched.
+func (o *Output) AddRawEntry(timestamp time.Time, entryJSON []byte) {
+
+	if err := o.sink.(RawSink).SendRaw(timestamp, entryJSON); err != nil {
+		log.Errorf("Could not write raw log entry to output %s: %v", o.Name, err)
+	}
+}
+
+// Required returns true if the poller must not advance past events this
+// output could not deliver.
+func (o *Output) Required() bool {
+	return o.cfg.Required != nil && *o.cfg.Required
+}
+
+// Discard drops any queued events of a required output without sending
+// them, because they will be read again on the next poll, and waits for
+// batches that are already being sent. Other outputs keep their queued
+// events, which may have been added by earlier polls.
+func (o *Output) Discard() {
+
+	if !o.Required() {
+		return
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	for _, l := range o.lanes {
+		promOutputQueuedEvents.WithLabelValues(o.Name).Sub(float64(len(l.pending)))
+		l.pending = nil
+		l.pendingBytes = 0
+
+		for drained := false; l.queue != nil && !drained; {
+			select {
+			case b := <-l.queue:
+				promOutputQueuedBatches.WithLabelValues(o.Name).Dec()
+				promOutputQueuedEvents.WithLabelValues(o.Name).Sub(float64(len(b.events)))
+				o.inflight.Done()
+			default:
+				drained = true
+			}
+		}
+	}
+
+	o.inflight.Wait()
+	o.results()
+}
+
+// Flush sends any queued events. For required outputs, it waits for the
+// workers to send all queued batches, so the results include all events
+// added before. Other outputs report the results of batches still being
+// sent with a later call of Add or Flush.
+func (o *Output) Flush() (int, int) {
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	for _, l := range o.lanes {
+		if len(l.pending) > 0 {
+			o.dispatch(l)
+		}
+	}
+
+	if o.Required() {
+		o.inflight.Wait()
+	}
+
+	return o.results()
+}
+
+func (o *Output) matches(auditEvent *auditv1.Event) bool {
+
+	if o.filter == nil {
+		return true
+	}
+
+	vars, err := filter.Variables(auditEvent, nil)
+	if err == nil {
+		var match bool
+		match, err = o.filter.EvalBool(vars)
+		if err == nil {
+			return match
+		}
+	}
+
+	// Send events that can't be evaluated rather than losing them.
+	promOutputFilterError.WithLabelValues(o.Name).Inc()
+	log.Warnf("Could not evaluate filter of output %s: %v", o.Name, err)
+
+	return true
+}
+
+// sendBatch sends the batch, after any events spooled while the circuit
+// breaker was open.
+func (o *Output) sendBatch(b *batch) (int, int) {
+
+	o.replaySpool()
+
+	if len(b.events) == 0 {
+		return 0, 0
+	}
+
+	sent, failed, _ := o.send(b.events, b.bytes, false)
+	return sent, failed
+}
+
+// replaySpool sends the spooled events once the output is available
+// again, in batches of batch_size, until the circuit breaker opens again.
+func (o *Output) replaySpool() {
+
+	if o.spool == nil || o.spool.empty() || !o.breaker.ready() {
+		return
+	}
+
+	o.replayMutex.Lock()
+	defer o.replayMutex.Unlock()
+
+	log.Infof("Sending spooled events to output %s", o.Name)
+
+	// Spooled events were not reported as sent or failed, only report
+	// them as sent once they are. Failures are only counted by the
+	// metrics of the output, since a required output can't rewind to
+	// them.
+	err := o.spool.replay(o.cfg.BatchSize, func(auditEvents []*auditv1.Event) bool {
+		sent, failed, rejected := o.send(auditEvents, -1, true)
+		o.addResults(sent, 0)
+		return sent+failed+rejected == len(auditEvents)
+	})
+	if err != nil {
+		log.Errorf("Could not replay spooled events of output %s: %v", o.Name, err)
+	}
+}
+
+// reject handles a batch that can't be sent because the circuit breaker
+// is open, writing it to the spool if there is one. Spooled events are
+// neither sent nor failed yet, they are only counted in the spooled metric.
+func (o *Output) reject(batch []*auditv1.Event) (int, int) {
+
+	if o.spool != nil {
+		err := o.spool.write(batch)
+		if err == nil {
+			promOutputEventSpooled.WithLabelValues(o.Name).Add(float64(len(batch)))
+			log.Debugf("Spooled %d audit events of output %s while its circuit breaker is open", len(batch), o.Name)
+			return 0, 0
+		}
+		log.Errorf("Could not spool %d audit events of output %s: %v", len(batch), o.Name, err)
+	} else {
+		log.Debugf("Could not send %d audit events to output %s, its circuit breaker is open", len(batch), o.Name)
+	}
+
+	promOutputEventSendError.WithLabelValues(o.Name).Add(float64(len(batch)))
+	return 0, len(batch)
+}
+
+// send sends the batch, whose json is size bytes long if it is known, or
+// -1. It returns the number of events sent, failed and rejected. Events
+// the sink rejected permanently are not failed, since reading them again
+// won't help, see rejectPermanently. When replaying the spool, events that
+// can't be sent because the circuit breaker is open are neither spooled
+// again nor failed, but left in the spool.
+func (o *Output) send(batch []*auditv1.Event, size int, replaying bool) (int, int, int) {
+
+	backoff := o.cfg.Retry.InitialBackoff
+	sent, failed, rejected := 0, 0, 0
+
+	for attempt := 1; ; attempt++ {
+		if !o.breaker.allow() {
+			if replaying {
+				return sent, failed, rejected
+			}
+			spooled, dropped := o.reject(batch)
+			return sent + spooled, failed + dropped, rejected
+		}
+
+		o.limiter.wait(batch, size)
+
+		err := o.sink.Send(batch)
+		o.breaker.record(err)
+		if err == nil {
+			promOutputEventOut.WithLabelValues(o.Name).Add(float64(len(batch)))
+			log.Infof("Forwarded %d events to output %s", len(batch), o.Name)
+			return sent + len(batch), failed, rejected
+		}
+
+		if partialErr, ok := err.(*PartialError); ok {
+			delivered := len(batch) - len(partialErr.Retry) - partialErr.Rejected
+			promOutputEventOut.WithLabelValues(o.Name).Add(float64(delivered))
+			log.Infof("Forwarded %d of %d events to output %s, %d rejected: %v",
+				delivered, len(batch), o.Name, partialErr.Rejected, err)
+			o.rejectPermanently(partialErr.RejectedEvents, partialErr.Rejected, err)
+
+			sent += delivered
+			rejected += partialErr.Rejected
+			batch = partialErr.Retry
+			size = -1
+
+			if len(batch) == 0 {
+				return sent, failed, rejected
+			}
+		}
+
+		// The failure opened the circuit breaker, keep the batch in the
+		// spool rather than dropping it.
+		if !IsPermanent(err) && o.spool != nil && !o.breaker.ready() {
+			if replaying {
+				return sent, failed, rejected
+			}
+			spooled, dropped := o.reject(batch)
+			return sent + spooled, failed + dropped, rejected
+		}
+
+		if IsPermanent(err) {
+			log.Errorf("Output %s rejected batch of %d audit events: %v", o.Name, len(batch), err)
+			o.rejectPermanently(batch, len(batch), err)
+			return sent, failed, rejected + len(batch)
+		}
+
+		if attempt >= o.cfg.Retry.MaxAttempts {
+			promOutputEventSendError.WithLabelValues(o.Name).Add(float64(len(batch)))
+			log.Errorf("Could not send batch of %d audit events to output %s (attempt %d/%d): %v",
+				len(batch), o.Name, attempt, o.cfg.Retry.MaxAttempts, err)
+			return sent, failed + len(batch), rejected
+		}
+
+		promOutputSendRetry.WithLabelValues(o.Name).Inc()
+		log.Warnf("Could not send batch of %d audit events to output %s (attempt %d/%d), will retry in %v: %v",
+			len(batch), o.Name, attempt, o.cfg.Retry.MaxAttempts, backoff, err)
+
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > o.cfg.Retry.MaxBackoff {
+			backoff = o.cfg.Retry.MaxBackoff
+		}
+	}
+}
+
+// rejectPermanently handles n events the sink rejected permanently, of
+// which the provided ones are known. They count as neither sent nor
+// failed, so a required output doesn't read them (and everything after
+// them) again, but are written to the rejected_file of the output.
+func (o *Output) rejectPermanently(auditEvents []*auditv1.Event, n int, err error) {
+
+	if n == 0 {
+		return
+	}
+
+	promOutputEventSendError.WithLabelValues(o.Name).Add(float64(n))
+	promOutputEventRejected.WithLabelValues(o.Name).Add(float64(n))
+
+	if o.rejectedFile == nil {
+		for _, auditEvent := range auditEvents {
+			log.Warnf("Output %s rejected audit event %s: %v", o.Name, auditEvent.AuditID, err)
+		}
+		return
+	}
+
+	var buf []byte
+	for _, auditEvent := range auditEvents {
+		auditEventJSON, err := json.Marshal(auditEvent)
+		if err != nil {
+			log.Errorf("Could not serialize rejected audit event %s of output %s: %v", auditEvent.AuditID, o.Name, err)
+			continue
+		}
+		buf = append(append(buf, auditEventJSON...), '\n')
+	}
+
+	o.rejectedMutex.Lock()
+	defer o.rejectedMutex.Unlock()
+
+	if _, err := o.rejectedFile.Write(buf); err != nil {
+		log.Errorf("Could not write %d rejected audit events of output %s to %s: %v", len(auditEvents), o.Name, o.cfg.RejectedFile, err)
+	}
+}
+
+// Close sends any queued events, waits for the workers to send them and
+// closes the sink. The output must not be used afterwards.
+func (o *Output) Close() {
+
+	close(o.done)
+	o.linger.Wait()
+	o.replay.Wait()
+
+	o.mutex.Lock()
+	for _, l := range o.lanes {
+		if len(l.pending) > 0 {
+			o.dispatch(l)
+		}
+		if l.queue != nil {
+			close(l.queue)
+		}
+	}
+	o.mutex.Unlock()
+
+	o.workers.Wait()
+
+	if err := o.sink.Close(); err != nil {
+		log.Errorf("Could not close output %s: %v", o.Name, err)
+	}
+
+	if o.rejectedFile != nil {
+		if err := o.rejectedFile.Close(); err != nil {
+			log.Errorf("Could not close rejected file of output %s: %v", o.Name, err)
+		}
+	}
+}
@@ -0,0 +1,732 @@
+package sink_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/sink"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+type fakeSink struct {
+	batches [][]*auditv1.Event
+	errs    []error
+}
+
+func (f *fakeSink) Send(auditEvents []*auditv1.Event) error {
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	f.batches = append(f.batches, auditEvents)
+	return nil
+}
+
+func (f *fakeSink) Close() error {
+	return nil
+}
+
+// lockedSink records the sent events, and can be used by several workers.
+type lockedSink struct {
+	mutex  sync.Mutex
+	events []*auditv1.Event
+}
+
+func (f *lockedSink) Send(auditEvents []*auditv1.Event) error {
+	time.Sleep(time.Millisecond)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.events = append(f.events, auditEvents...)
+	return nil
+}
+
+func (f *lockedSink) Close() error {
+	return nil
+}
+
+// orderedSink keeps the events of each namespace in order.
+type orderedSink struct {
+	lockedSink
+}
+
+func (f *orderedSink) OrderingKey(auditEvent *auditv1.Event) string {
+	return auditEvent.ObjectRef.Namespace
+}
+
+func testEvents(n int, namespace string) []*auditv1.Event {
+	var auditEvents []*auditv1.Event
+	for i := 0; i < n; i++ {
+		auditEvents = append(auditEvents, &auditv1.Event{
+			AuditID: types.UID(fmt.Sprintf("%s-%d", namespace, i)),
+			Verb:    "create",
+			ObjectRef: &auditv1.ObjectReference{
+				Resource:  "pods",
+				Namespace: namespace,
+			},
+			ResponseStatus: &metav1.Status{Code: 201},
+		})
+	}
+	return auditEvents
+}
+
+// testOutputConfig returns the config of a required output, which sends
+// batches while events are added.
+func testOutputConfig() config.OutputConfig {
+	required := true
+	return config.OutputConfig{
+		Name:      "test",
+		Type:      "webhook",
+		BatchSize: 3,
+		Required:  &required,
+		Retry: config.RetryConfig{
+			MaxAttempts:    1,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+		},
+	}
+}
+
+func TestOutputBatching(t *testing.T) {
+
+	fake := &fakeSink{}
+	output, err := sink.NewOutput(testOutputConfig(), fake)
+	assert.Nil(t, err)
+
+	sent, failed := output.Add(testEvents(4, "default"))
+	assert.Equal(t, 3, sent)
+	assert.Equal(t, 0, failed)
+	assert.Equal(t, 1, len(fake.batches))
+
+	sent, failed = output.Add(testEvents(1, "other"))
+	assert.Equal(t, 0, sent)
+	assert.Equal(t, 0, failed)
+
+	sent, failed = output.Flush()
+	assert.Equal(t, 2, sent)
+	assert.Equal(t, 0, failed)
+	assert.Equal(t, 2, len(fake.batches))
+	assert.Equal(t, types.UID("default-3"), fake.batches[1][0].AuditID)
+	assert.Equal(t, types.UID("other-0"), fake.batches[1][1].AuditID)
+
+	sent, failed = output.Flush()
+	assert.Equal(t, 0, sent+failed)
+}
+
+func TestOutputFilter(t *testing.T) {
+
+	cfg := testOutputConfig()
+	cfg.Filter = `event.objectRef.namespace != "staging"`
+
+	fake := &fakeSink{}
+	output, err := sink.NewOutput(cfg, fake)
+	assert.Nil(t, err)
+
+	output.Add(testEvents(2, "staging"))
+	output.Add(testEvents(2, "default"))
+	sent, _ := output.Flush()
+
+	assert.Equal(t, 2, sent)
+	assert.Equal(t, types.UID("default-0"), fake.batches[0][0].AuditID)
+
+	cfg.Filter = `event.verb ==`
+	_, err = sink.NewOutput(cfg, fake)
+	assert.NotNil(t, err)
+}
+
+func TestOutputRetry(t *testing.T) {
+
+	cfg := testOutputConfig()
+	cfg.Retry.MaxAttempts = 3
+
+	fake := &fakeSink{errs: []error{fmt.Errorf("unavailable"), fmt.Errorf("unavailable")}}
+	output, err := sink.NewOutput(cfg, fake)
+	assert.Nil(t, err)
+
+	sent, failed := output.Add(testEvents(3, "default"))
+	assert.Equal(t, 3, sent)
+	assert.Equal(t, 0, failed)
+
+	fake.errs = []error{fmt.Errorf("unavailable"), fmt.Errorf("unavailable"), fmt.Errorf("unavailable")}
+	sent, failed = output.Add(testEvents(3, "default"))
+	assert.Equal(t, 0, sent)
+	assert.Equal(t, 3, failed)
+
+	// Permanent errors are not retried, and the rejected events are not
+	// failed since reading them again won't help.
+	fake.errs = []error{sink.Permanent(fmt.Errorf("bad request")), nil}
+	sent, failed = output.Add(testEvents(3, "default"))
+	assert.Equal(t, 0, sent)
+	assert.Equal(t, 0, failed)
+	assert.Equal(t, 1, len(fake.errs))
+}
+
+func TestOutputDiscard(t *testing.T) {
+
+	cfg := testOutputConfig()
+	required := true
+	cfg.Required = &required
+
+	fake := &fakeSink{}
+	output, err := sink.NewOutput(cfg, fake)
+	assert.Nil(t, err)
+	assert.True(t, output.Required())
+
+	output.Add(testEvents(2, "default"))
+	output.Discard()
+
+	sent, failed := output.Flush()
+	assert.Equal(t, 0, sent+failed)
+	assert.Equal(t, 0, len(fake.batches))
+
+	// Other outputs keep their queued events, which may be from earlier
+	// polls.
+	cfg.Required = nil
+	other := &lockedSink{}
+	output, err = sink.NewOutput(cfg, other)
+	assert.Nil(t, err)
+
+	output.Add(testEvents(2, "default"))
+	output.Discard()
+	output.Close()
+	assert.Equal(t, 2, len(other.events))
+}
+
+func TestOutputPartialRetry(t *testing.T) {
+
+	cfg := testOutputConfig()
+	cfg.Retry.MaxAttempts = 3
+
+	auditEvents := testEvents(3, "default")
+
+	fake := &fakeSink{errs: []error{&sink.PartialError{
+		Retry:          auditEvents[1:2],
+		Rejected:       1,
+		RejectedEvents: auditEvents[2:],
+		Err:            fmt.Errorf("1 event throttled, 1 event rejected"),
+	}}}
+	output, err := sink.NewOutput(cfg, fake)
+	assert.Nil(t, err)
+
+	sent, failed := output.Add(auditEvents)
+	assert.Equal(t, 2, sent)
+	assert.Equal(t, 0, failed)
+	assert.Equal(t, 1, len(fake.batches))
+	assert.Equal(t, types.UID("default-1"), fake.batches[0][0].AuditID)
+	assert.Equal(t, 1, len(fake.batches[0]))
+}
+
+func TestOutputRejectedFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "swb-rejected")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := testOutputConfig()
+	cfg.RejectedFile = filepath.Join(dir, "rejected.jsonl")
+
+	auditEvents := testEvents(6, "default")
+
+	fake := &fakeSink{errs: []error{
+		&sink.PartialError{
+			Rejected:       1,
+			RejectedEvents: auditEvents[1:2],
+			Err:            fmt.Errorf("1 event rejected"),
+		},
+		sink.Permanent(fmt.Errorf("bad request")),
+	}}
+	output, err := sink.NewOutput(cfg, fake)
+	assert.Nil(t, err)
+
+	sent, failed := output.Add(auditEvents)
+	assert.Equal(t, 2, sent)
+	assert.Equal(t, 0, failed)
+	output.Close()
+
+	content, err := ioutil.ReadFile(cfg.RejectedFile)
+	assert.Nil(t, err)
+
+	var rejected []types.UID
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var auditEvent auditv1.Event
+		assert.Nil(t, json.Unmarshal([]byte(line), &auditEvent))
+		rejected = append(rejected, auditEvent.AuditID)
+	}
+	assert.Equal(t, []types.UID{"default-1", "default-3", "default-4", "default-5"}, rejected)
+}
+
+func TestOutputMaxBatchBytes(t *testing.T) {
+
+	cfg := testOutputConfig()
+	cfg.BatchSize = 100
+
+	auditEvents := testEvents(4, "default")
+	eventJSON, err := json.Marshal(auditEvents[0])
+	assert.Nil(t, err)
+
+	// Room for two events per batch
+	cfg.MaxBatchBytes = 2*(len(eventJSON)+1) + 60
+
+	fake := &fakeSink{}
+	output, err := sink.NewOutput(cfg, fake)
+	assert.Nil(t, err)
+
+	sent, failed := output.Add(auditEvents[:3])
+	assert.Equal(t, 2, sent)
+	assert.Equal(t, 0, failed)
+
+	sent, failed = output.Add(auditEvents[3:])
+	assert.Equal(t, 0, sent)
+	sent, failed = output.Flush()
+	assert.Equal(t, 2, sent)
+	assert.Equal(t, 2, len(fake.batches))
+	assert.Equal(t, 2, len(fake.batches[1]))
+
+	// The objects of oversized events are removed.
+	large := testEvents(1, "large")[0]
+	large.RequestObject = &runtime.Unknown{Raw: []byte(`{"data":"` + strings.Repeat("x", cfg.MaxBatchBytes) + `"}`)}
+	large.ResponseObject = large.RequestObject
+
+	output.Add(testEvents(1, "default"))
+	output.Add([]*auditv1.Event{large})
+	sent, failed = output.Flush()
+	assert.Equal(t, 2, sent)
+	assert.Equal(t, 0, failed)
+	assert.Equal(t, 3, len(fake.batches))
+	assert.Equal(t, 2, len(fake.batches[2]))
+	assert.Nil(t, fake.batches[2][1].RequestObject)
+	assert.Nil(t, fake.batches[2][1].ResponseObject)
+	assert.Equal(t, "true", fake.batches[2][1].Annotations["audit.k8s.io/truncated"])
+	assert.NotNil(t, large.RequestObject)
+
+	// Events that are still too large are sent on their own.
+	large = testEvents(1, "large")[0]
+	large.Annotations = map[string]string{"data": strings.Repeat("x", cfg.MaxBatchBytes)}
+
+	output.Add(testEvents(1, "default"))
+	output.Add([]*auditv1.Event{large})
+	output.Add(testEvents(1, "other"))
+	sent, failed = output.Flush()
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, 6, len(fake.batches))
+	assert.Equal(t, types.UID("large-0"), fake.batches[4][0].AuditID)
+	assert.Equal(t, 1, len(fake.batches[4]))
+}
+
+func TestOutputMaxLinger(t *testing.T) {
+
+	cfg := testOutputConfig()
+	cfg.BatchSize = 100
+	cfg.MaxLinger = 20 * time.Millisecond
+
+	fake := &fakeSink{}
+	output, err := sink.NewOutput(cfg, fake)
+	assert.Nil(t, err)
+	defer output.Close()
+
+	sent, failed := output.Add(testEvents(2, "default"))
+	assert.Equal(t, 0, sent+failed)
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Already sent by the linger timer, the results are reported with
+	// the next Add or Flush.
+	sent, failed = output.Add(testEvents(1, "other"))
+	assert.Equal(t, 2, sent)
+	assert.Equal(t, 0, failed)
+	assert.Equal(t, 1, len(fake.batches))
+
+	sent, failed = output.Flush()
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, 2, len(fake.batches))
+}
+
+func TestOutputWorkers(t *testing.T) {
+
+	cfg := testOutputConfig()
+	cfg.BatchSize = 1
+	cfg.Workers = 3
+	cfg.QueueSize = 2
+	cfg.Ordering = "object"
+
+	fake := &lockedSink{}
+	output, err := sink.NewOutput(cfg, fake)
+	assert.Nil(t, err)
+	defer output.Close()
+
+	// Events of several objects, interleaved
+	var auditEvents []*auditv1.Event
+	for i := 0; i < 10; i++ {
+		for _, namespace := range []string{"a", "b", "c", "d"} {
+			auditEvent := testEvents(1, namespace)[0]
+			auditEvent.AuditID = types.UID(fmt.Sprintf("%s-%d", namespace, i))
+			auditEvents = append(auditEvents, auditEvent)
+		}
+	}
+
+	sent, failed := output.Add(auditEvents)
+	assert.True(t, sent <= 40)
+	assert.Equal(t, 0, failed)
+
+	// Flush waits for all queued batches
+	flushed, failed := output.Flush()
+	assert.Equal(t, 40, sent+flushed)
+	assert.Equal(t, 0, failed)
+	assert.Equal(t, 40, len(fake.events))
+
+	// Events of each object were sent in order
+	next := map[string]int{}
+	for _, auditEvent := range fake.events {
+		namespace := auditEvent.ObjectRef.Namespace
+		assert.Equal(t, types.UID(fmt.Sprintf("%s-%d", namespace, next[namespace])), auditEvent.AuditID)
+		next[namespace]++
+	}
+}
+
+func TestOutputOrdering(t *testing.T) {
+
+	cfg := testOutputConfig()
+	cfg.Workers = 2
+	cfg.Ordering = "global"
+	_, err := sink.NewOutput(cfg, &fakeSink{})
+	assert.NotNil(t, err)
+
+	cfg.Ordering = "random"
+	_, err = sink.NewOutput(cfg, &fakeSink{})
+	assert.NotNil(t, err)
+
+	// A single worker with a queue sends all events in order
+	cfg.Workers = 1
+	cfg.QueueSize = 1
+	cfg.BatchSize = 1
+	cfg.Ordering = "global"
+	fake := &lockedSink{}
+	output, err := sink.NewOutput(cfg, fake)
+	assert.Nil(t, err)
+	defer output.Close()
+
+	auditEvents := append(testEvents(3, "a"), testEvents(3, "b")...)
+	output.Add(auditEvents)
+	output.Flush()
+	assert.Equal(t, auditEvents, fake.events)
+}
+
+func TestOutputOrderingKey(t *testing.T) {
+
+	cfg := testOutputConfig()
+	cfg.BatchSize = 1
+	cfg.Workers = 3
+	cfg.QueueSize = 2
+	cfg.Ordering = "object"
+
+	fake := &orderedSink{}
+	output, err := sink.NewOutput(cfg, fake)
+	assert.Nil(t, err)
+	defer output.Close()
+
+	// Events of different objects with the same ordering key
+	var auditEvents []*auditv1.Event
+	for i := 0; i < 10; i++ {
+		for _, namespace := range []string{"a", "b", "c", "d"} {
+			auditEvent := testEvents(1, namespace)[0]
+			auditEvent.AuditID = types.UID(fmt.Sprintf("%s-%d", namespace, i))
+			auditEvent.ObjectRef.Name = fmt.Sprintf("pod-%d", i)
+			auditEvents = append(auditEvents, auditEvent)
+		}
+	}
+
+	sent, _ := output.Add(auditEvents)
+	flushed, failed := output.Flush()
+	assert.Equal(t, 40, sent+flushed)
+	assert.Equal(t, 0, failed)
+
+	// The events of each key were sent by the same worker, in order
+	next := map[string]int{}
+	for _, auditEvent := range fake.events {
+		namespace := auditEvent.ObjectRef.Namespace
+		assert.Equal(t, types.UID(fmt.Sprintf("%s-%d", namespace, next[namespace])), auditEvent.AuditID)
+		next[namespace]++
+	}
+}
+
+func TestOutputRateLimit(t *testing.T) {
+
+	cfg := testOutputConfig()
+	cfg.BatchSize = 10
+	cfg.RateLimit = config.RateLimitConfig{
+		EventsPerSecond: 100,
+		BurstEvents:     10,
+	}
+
+	fake := &fakeSink{}
+	output, err := sink.NewOutput(cfg, fake)
+	assert.Nil(t, err)
+	defer output.Close()
+
+	// The first batch uses the burst, the others wait 100ms each.
+	start := time.Now()
+	sent, failed := output.Add(testEvents(30, "default"))
+	assert.Equal(t, 30, sent)
+	assert.Equal(t, 0, failed)
+	assert.True(t, time.Since(start) >= 180*time.Millisecond)
+
+	// Limited by bytes, the second batch waits for one second of tokens.
+	eventJSON, err := json.Marshal(testEvents(1, "default")[0])
+	assert.Nil(t, err)
+	size := len(eventJSON) + 1
+	cfg.RateLimit = config.RateLimitConfig{
+		BytesPerSecond: float64(50 * size),
+		BurstBytes:     10 * size,
+	}
+
+	output, err = sink.NewOutput(cfg, &fakeSink{})
+	assert.Nil(t, err)
+	defer output.Close()
+
+	start = time.Now()
+	output.Add(testEvents(15, "default"))
+	output.Flush()
+	assert.True(t, time.Since(start) >= 80*time.Millisecond)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestOutputCircuitBreaker(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "swb-spool")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := testOutputConfig()
+	cfg.CircuitBreaker = config.CircuitBreakerConfig{
+		FailureThreshold: 2,
+		OpenTimeout:      50 * time.Millisecond,
+		SpoolDir:         dir,
+		SpoolMaxSizeMB:   1,
+	}
+
+	unavailable := fmt.Errorf("unavailable")
+	fake := &fakeSink{errs: []error{unavailable, unavailable, unavailable}}
+	output, err := sink.NewOutput(cfg, fake)
+	assert.Nil(t, err)
+	assert.Equal(t, "closed", output.CircuitBreakerState())
+
+	// Opens after two failed batches, and the second batch is spooled,
+	// which counts as neither sent nor failed
+	sent, failed := output.Add(testEvents(6, "default"))
+	assert.Equal(t, 0, sent)
+	assert.Equal(t, 3, failed)
+	assert.Equal(t, "open", output.CircuitBreakerState())
+
+	// While open, events are spooled without trying to send them
+	sent, failed = output.Add(testEvents(3, "spooled"))
+	assert.Equal(t, 0, sent)
+	assert.Equal(t, 0, failed)
+
+	// The probe fails, so the breaker opens again
+	time.Sleep(60 * time.Millisecond)
+	sent, failed = output.Add(testEvents(3, "more"))
+	assert.Equal(t, 0, sent)
+	assert.Equal(t, 0, failed)
+	assert.Equal(t, "open", output.CircuitBreakerState())
+
+	// The probe succeeds, and the spooled events are sent first
+	time.Sleep(60 * time.Millisecond)
+	sent, failed = output.Add(testEvents(3, "other"))
+	assert.Equal(t, 12, sent)
+	assert.Equal(t, 0, failed)
+	assert.Equal(t, "closed", output.CircuitBreakerState())
+
+	// The spool is replayed in the background, only look at the sink
+	// once it stopped.
+	output.Close()
+	assert.Equal(t, 0, len(fake.errs))
+	assert.Equal(t, 4, len(fake.batches))
+	assert.Equal(t, testEvents(6, "default")[3:], fake.batches[0])
+	assert.Equal(t, testEvents(3, "spooled"), fake.batches[1])
+	assert.Equal(t, testEvents(3, "more"), fake.batches[2])
+	assert.Equal(t, testEvents(3, "other"), fake.batches[3])
+
+	// Without a spool, events are not sent while the breaker is open
+	cfg.CircuitBreaker.SpoolDir = ""
+	fake = &fakeSink{errs: []error{unavailable, unavailable}}
+	output, err = sink.NewOutput(cfg, fake)
+	assert.Nil(t, err)
+	defer output.Close()
+
+	output.Add(testEvents(6, "default"))
+	sent, failed = output.Add(testEvents(3, "default"))
+	assert.Equal(t, 0, sent)
+	assert.Equal(t, 3, failed)
+}
+
+func TestOutputSpoolReplay(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "swb-spool")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := testOutputConfig()
+	cfg.CircuitBreaker = config.CircuitBreakerConfig{
+		FailureThreshold: 1,
+		OpenTimeout:      20 * time.Millisecond,
+		SpoolDir:         dir,
+		SpoolMaxSizeMB:   1,
+	}
+
+	unavailable := fmt.Errorf("unavailable")
+	fake := &fakeSink{errs: []error{unavailable, nil, unavailable}}
+	output, err := sink.NewOutput(cfg, fake)
+	assert.Nil(t, err)
+
+	output.Add(testEvents(3, "first"))
+	output.Add(testEvents(6, "second"))
+
+	// The spool is replayed without adding events. The second batch of
+	// the replay fails, and the events are replayed again in order once
+	// the breaker lets them through.
+	time.Sleep(200 * time.Millisecond)
+	sent, failed := output.Flush()
+	assert.Equal(t, 9, sent)
+	assert.Equal(t, 0, failed)
+	assert.Equal(t, "closed", output.CircuitBreakerState())
+
+	output.Close()
+	assert.Equal(t, [][]*auditv1.Event{
+		testEvents(3, "first"), testEvents(6, "second")[:3], testEvents(6, "second")[3:],
+	}, fake.batches)
+
+	entries, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+
+	// A replay interrupted by a restart is picked up again, before the
+	// events spooled since.
+	spoolPath := filepath.Join(dir, "restarted.jsonl")
+	writeSpool(t, spoolPath+".replay", testEvents(2, "interrupted"))
+	writeSpool(t, spoolPath, testEvents(1, "later"))
+
+	cfg.Name = "restarted"
+	fake = &fakeSink{}
+	output, err = sink.NewOutput(cfg, fake)
+	assert.Nil(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	sent, _ = output.Flush()
+	assert.Equal(t, 3, sent)
+
+	output.Close()
+	assert.Equal(t, [][]*auditv1.Event{append(testEvents(2, "interrupted"), testEvents(1, "later")...)}, fake.batches)
+}
+
+// writeSpool writes the audit events as json lines, like the spool does.
+func writeSpool(t *testing.T, path string, auditEvents []*auditv1.Event) {
+	var buf []byte
+	for _, auditEvent := range auditEvents {
+		auditEventJSON, err := json.Marshal(auditEvent)
+		assert.Nil(t, err)
+		buf = append(append(buf, auditEventJSON...), '\n')
+	}
+	assert.Nil(t, ioutil.WriteFile(path, buf, 0644))
+}
+
+// gateSink blocks sending until it is opened.
+type gateSink struct {
+	lockedSink
+	open chan struct{}
+}
+
+func (f *gateSink) Send(auditEvents []*auditv1.Event) error {
+	<-f.open
+	return f.lockedSink.Send(auditEvents)
+}
+
+func TestOutputNotRequired(t *testing.T) {
+
+	cfg := testOutputConfig()
+	cfg.Required = nil
+	cfg.BatchSize = 2
+	cfg.QueueSize = 3
+
+	fake := &gateSink{open: make(chan struct{})}
+	output, err := sink.NewOutput(cfg, fake)
+	assert.Nil(t, err)
+
+	// Neither Add nor Flush wait for the sink
+	sent, failed := output.Add(testEvents(4, "default"))
+	assert.Equal(t, 0, sent+failed)
+	sent, failed = output.Add(testEvents(1, "other"))
+	assert.Equal(t, 0, sent+failed)
+	sent, failed = output.Flush()
+	assert.Equal(t, 0, sent+failed)
+
+	output.Add(testEvents(1, "more"))
+
+	// Close sends everything that is queued
+	close(fake.open)
+	output.Close()
+	assert.Equal(t, 6, len(fake.events))
+}
+
+func TestOutputQueueFull(t *testing.T) {
+
+	cfg := testOutputConfig()
+	cfg.Required = nil
+	cfg.BatchSize = 1
+	cfg.QueueSize = 1
+
+	fake := &gateSink{open: make(chan struct{})}
+	output, err := sink.NewOutput(cfg, fake)
+	assert.Nil(t, err)
+
+	// The worker waits for the sink with the first batch, the second one
+	// is queued and the third one doesn't fit anymore.
+	output.Add(testEvents(1, "first"))
+	time.Sleep(20 * time.Millisecond)
+	sent, failed := output.Add(testEvents(2, "default"))
+	assert.Equal(t, 0, sent)
+	assert.Equal(t, 1, failed)
+
+	close(fake.open)
+	output.Close()
+	assert.Equal(t, 2, len(fake.events))
+}
+
+func TestOutputAddEvent(t *testing.T) {
+
+	cfg := testOutputConfig()
+	cfg.BatchSize = 100
+	cfg.MaxBatchBytes = 100
+
+	fake := &fakeSink{}
+	output, err := sink.NewOutput(cfg, fake)
+	assert.Nil(t, err)
+
+	// The provided sizes are used instead of serializing the events
+	auditEvents := testEvents(3, "default")
+	sent, _ := output.AddEvent(auditEvents[0], 40)
+	assert.Equal(t, 0, sent)
+	sent, _ = output.AddEvent(auditEvents[1], 40)
+	assert.Equal(t, 0, sent)
+	sent, _ = output.AddEvent(auditEvents[2], 40)
+	assert.Equal(t, 2, sent)
+
+	sent, _ = output.Flush()
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, 2, len(fake.batches))
+}
@@ -0,0 +1,248 @@
+package sink
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace = "swb"
+	subsystem = "output"
+)
+
+var (
+	promOutputEventOut       *prometheus.CounterVec
+	promOutputEventSendError *prometheus.CounterVec
+	promOutputEventFiltered  *prometheus.CounterVec
+	promOutputFilterError    *prometheus.CounterVec
+	promOutputSendRetry      *prometheus.CounterVec
+	promOutputEventTruncated *prometheus.CounterVec
+
+	promOutputRequestBytes     *prometheus.CounterVec
+	promOutputRequestBytesSent *prometheus.CounterVec
+
+	promOutputArchiveUpload      *prometheus.CounterVec
+	promOutputArchiveUploadError *prometheus.CounterVec
+
+	promOutputQueuedEvents  *prometheus.GaugeVec
+	promOutputQueuedBatches *prometheus.GaugeVec
+	promOutputRateLimitWait *prometheus.CounterVec
+
+	promOutputCircuitBreakerState *prometheus.GaugeVec
+	promOutputEventSpooled        *prometheus.CounterVec
+	promOutputEventDropped        *prometheus.CounterVec
+	promOutputEventRejected       *prometheus.CounterVec
+)
+
+func CreateMetrics() {
+	promOutputEventOut = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "audit_event_out",
+			Help:      "the number of audit events successfully sent, by output",
+		},
+		[]string{"output"},
+	)
+
+	promOutputEventSendError = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "audit_event_send_error",
+			Help:      "the number of audit events that could not successfully be sent, by output",
+		},
+		[]string{"output"},
+	)
+
+	promOutputEventFiltered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "audit_event_filtered",
+			Help:      "the number of audit events not sent because they did not match the filter, by output",
+		},
+		[]string{"output"},
+	)
+
+	promOutputFilterError = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "filter_error",
+			Help:      "the number of times the filter of an output could not be evaluated, by output",
+		},
+		[]string{"output"},
+	)
+
+	promOutputSendRetry = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "send_retry",
+			Help:      "the number of times sending a batch of audit events was retried, by output",
+		},
+		[]string{"output"},
+	)
+
+	promOutputEventTruncated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "audit_event_truncated",
+			Help:      "the number of audit events whose request and response objects were removed to fit into a batch, by output",
+		},
+		[]string{"output"},
+	)
+
+	promOutputRequestBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "request_bytes",
+			Help:      "the number of bytes of request bodies before compression, by output",
+		},
+		[]string{"output"},
+	)
+
+	promOutputRequestBytesSent = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "request_bytes_sent",
+			Help:      "the number of bytes of request bodies sent after compression, by output",
+		},
+		[]string{"output"},
+	)
+
+	promOutputArchiveUpload = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "archive_upload",
+			Help:      "the number of files uploaded to object storage, by output",
+		},
+		[]string{"output"},
+	)
+
+	promOutputArchiveUploadError = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "archive_upload_error",
+			Help:      "the number of files that could not be uploaded to object storage, by output",
+		},
+		[]string{"output"},
+	)
+
+	promOutputQueuedEvents = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "queued_events",
+			Help:      "the number of audit events waiting to be sent, by output",
+		},
+		[]string{"output"},
+	)
+
+	promOutputQueuedBatches = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "queued_batches",
+			Help:      "the number of batches waiting in the queues of the workers, by output",
+		},
+		[]string{"output"},
+	)
+
+	promOutputRateLimitWait = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rate_limit_wait_seconds",
+			Help:      "the time spent waiting for the rate limit before sending batches, by output",
+		},
+		[]string{"output"},
+	)
+
+	promOutputCircuitBreakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "circuit_breaker_state",
+			Help:      "the state of the circuit breaker (0 closed, 1 half-open, 2 open), by output",
+		},
+		[]string{"output"},
+	)
+
+	promOutputEventSpooled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "audit_event_spooled",
+			Help:      "the number of audit events written to the spool while the circuit breaker was open or the queue was full, by output",
+		},
+		[]string{"output"},
+	)
+
+	promOutputEventDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "audit_event_dropped",
+			Help:      "the number of audit events dropped because the queue of a non-required output was full, by output",
+		},
+		[]string{"output"},
+	)
+
+	promOutputEventRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "audit_event_rejected",
+			Help:      "the number of audit events rejected permanently, which are not retried or read again, by output",
+		},
+		[]string{"output"},
+	)
+
+	prometheus.MustRegister(promOutputEventOut)
+	prometheus.MustRegister(promOutputEventSendError)
+	prometheus.MustRegister(promOutputEventFiltered)
+	prometheus.MustRegister(promOutputFilterError)
+	prometheus.MustRegister(promOutputSendRetry)
+	prometheus.MustRegister(promOutputEventTruncated)
+	prometheus.MustRegister(promOutputRequestBytes)
+	prometheus.MustRegister(promOutputRequestBytesSent)
+	prometheus.MustRegister(promOutputArchiveUpload)
+	prometheus.MustRegister(promOutputArchiveUploadError)
+	prometheus.MustRegister(promOutputQueuedEvents)
+	prometheus.MustRegister(promOutputQueuedBatches)
+	prometheus.MustRegister(promOutputRateLimitWait)
+	prometheus.MustRegister(promOutputCircuitBreakerState)
+	prometheus.MustRegister(promOutputEventSpooled)
+	prometheus.MustRegister(promOutputEventDropped)
+	prometheus.MustRegister(promOutputEventRejected)
+}
+
+func ResetMetrics() {
+	prometheus.Unregister(promOutputEventOut)
+	prometheus.Unregister(promOutputEventSendError)
+	prometheus.Unregister(promOutputEventFiltered)
+	prometheus.Unregister(promOutputFilterError)
+	prometheus.Unregister(promOutputSendRetry)
+	prometheus.Unregister(promOutputEventTruncated)
+	prometheus.Unregister(promOutputRequestBytes)
+	prometheus.Unregister(promOutputRequestBytesSent)
+	prometheus.Unregister(promOutputArchiveUpload)
+	prometheus.Unregister(promOutputArchiveUploadError)
+	prometheus.Unregister(promOutputQueuedEvents)
+	prometheus.Unregister(promOutputQueuedBatches)
+	prometheus.Unregister(promOutputRateLimitWait)
+	prometheus.Unregister(promOutputCircuitBreakerState)
+	prometheus.Unregister(promOutputEventSpooled)
+	prometheus.Unregister(promOutputEventDropped)
+	prometheus.Unregister(promOutputEventRejected)
+}
+
+func init() {
+	CreateMetrics()
+}
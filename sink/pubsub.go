@@ -0,0 +1,259 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	pubsubScope = "https://www.googleapis.com/auth/pubsub"
+
+	// A publish request holds at most this many messages, and at most
+	// 10MB of json (including the base64 encoded data of the messages).
+	pubsubMaxMessages = 1000
+	pubsubMaxBytes    = 10 * 1000 * 1000
+)
+
+// PubSub publishes audit events to a Google Cloud Pub/Sub topic using
+// the REST API, one message per event with the event as json. Messages
+// have the attributes verb, namespace and user, and an ordering key per
+// cluster (or per cluster and namespace), so subscriptions with message
+// ordering receive the events of a cluster in order.
+//
+// If PUBSUB_EMULATOR_HOST is set, events are published to the emulator
+// without credentials.
+type PubSub struct {
+	cfg         config.OutputConfig
+	source      Source
+	publishUrl  string
+	httpClient  *http.Client
+	tokenSource oauth2.TokenSource
+}
+
+type pubsubMessage struct {
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+}
+
+func NewPubSub(cfg config.OutputConfig, source Source) (*PubSub, error) {
+
+	switch cfg.PubSub.OrderingKey {
+	case "", "cluster", "namespace", "none":
+	default:
+		return nil, fmt.Errorf("Unknown pubsub ordering_key %q, must be one of cluster, namespace, none", cfg.PubSub.OrderingKey)
+	}
+
+	project := cfg.PubSub.Project
+	if project == "" {
+		project = source.Project
+	}
+	if project == "" || cfg.PubSub.Topic == "" {
+		return nil, fmt.Errorf("Output %s has no pubsub project or topic", cfg.Name)
+	}
+
+	httpClient, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &PubSub{
+		cfg:        cfg,
+		source:     source,
+		httpClient: httpClient,
+	}
+
+	endpoint := cfg.Url
+	if emulatorHost := os.Getenv("PUBSUB_EMULATOR_HOST"); emulatorHost != "" && endpoint == "" {
+		endpoint = "http://" + emulatorHost
+	} else {
+		if endpoint == "" {
+			endpoint = "https://pubsub.googleapis.com"
+		}
+
+		p.tokenSource, err = google.DefaultTokenSource(context.Background(), pubsubScope)
+		if err != nil {
+			return nil, fmt.Errorf("Could not find google credentials for output %s: %v", cfg.Name, err)
+		}
+	}
+
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("Could not parse url %s: %v", endpoint, err)
+	}
+
+	p.publishUrl = fmt.Sprintf("%s/v1/projects/%s/topics/%s:publish",
+		strings.TrimSuffix(endpoint, "/"), url.PathEscape(project), url.PathEscape(cfg.PubSub.Topic))
+
+	return p, nil
+}
+
+func (p *PubSub) Send(auditEvents []*auditv1.Event) error {
+
+	var rejected []*auditv1.Event
+	var lastErr error
+
+	var pending []*auditv1.Event
+	var messages [][]byte
+	for _, auditEvent := range auditEvents {
+		message, err := p.message(auditEvent)
+		if err != nil {
+			rejected = append(rejected, auditEvent)
+			lastErr = err
+			continue
+		}
+		pending = append(pending, auditEvent)
+		messages = append(messages, message)
+	}
+
+	for start := 0; start < len(pending); {
+		// Fill the request up to the limits, a message that is too large
+		// on its own is published alone and rejected by Pub/Sub.
+		end, size := start, len(`{"messages":[]}`)
+		for end < len(pending) && end-start < pubsubMaxMessages {
+			if end > start && size+len(messages[end])+1 > pubsubMaxBytes {
+				break
+			}
+			size += len(messages[end]) + 1
+			end++
+		}
+
+		err := p.publish(messages[start:end])
+		if err == nil {
+			start = end
+			continue
+		}
+
+		// Earlier requests were published, only the remaining events
+		// need to be retried.
+		if !IsPermanent(err) {
+			if start == 0 && len(rejected) == 0 {
+				return err
+			}
+			return &PartialError{Retry: pending[start:], Rejected: len(rejected), RejectedEvents: rejected, Err: err}
+		}
+
+		rejected = append(rejected, pending[start:end]...)
+		lastErr = err
+		start = end
+	}
+
+	if len(rejected) == len(auditEvents) {
+		return lastErr
+	}
+	if len(rejected) > 0 {
+		return &PartialError{Rejected: len(rejected), RejectedEvents: rejected, Err: lastErr}
+	}
+
+	return nil
+}
+
+// message returns the json of the pubsub message of the audit event.
+func (p *PubSub) message(auditEvent *auditv1.Event) ([]byte, error) {
+
+	auditEventJSON, err := json.Marshal(auditEvent)
+	if err != nil {
+		return nil, Permanent(fmt.Errorf("Could not serialize audit event to JSON: %v", err))
+	}
+
+	message, err := json.Marshal(&pubsubMessage{
+		Data:        auditEventJSON,
+		Attributes:  p.attributes(auditEvent),
+		OrderingKey: p.OrderingKey(auditEvent),
+	})
+	if err != nil {
+		return nil, Permanent(fmt.Errorf("Could not serialize pubsub message to JSON: %v", err))
+	}
+
+	return message, nil
+}
+
+// publish sends one publish request with the json of the messages.
+func (p *PubSub) publish(messages [][]byte) error {
+
+	body := &bytes.Buffer{}
+	body.WriteString(`{"messages":[`)
+	body.Write(bytes.Join(messages, []byte(",")))
+	body.WriteString(`]}`)
+
+	req, err := http.NewRequest("POST", p.publishUrl, body)
+	if err != nil {
+		return Permanent(fmt.Errorf("Could not construct http request to %s: %v", p.publishUrl, err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if p.tokenSource != nil {
+		token, err := p.tokenSource.Token()
+		if err != nil {
+			return fmt.Errorf("Could not get google access token: %v", err)
+		}
+		token.SetAuthHeader(req)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Could not publish audit events to %s: %v", p.publishUrl, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	log.Debugf("response from publish: status=%s body=%s:", resp.Status, string(respBody))
+
+	if !isSuccess(p.cfg, resp.StatusCode) {
+		return statusError(resp.StatusCode, fmt.Errorf("Unsuccessful response %s from publish of audit events: %s", resp.Status, string(respBody)))
+	}
+
+	return nil
+}
+
+// attributes returns the message attributes of the audit event, which
+// subscriptions can filter on.
+func (p *PubSub) attributes(auditEvent *auditv1.Event) map[string]string {
+
+	attributes := map[string]string{
+		"verb": auditEvent.Verb,
+		"user": auditEvent.User.Username,
+	}
+	if auditEvent.ObjectRef != nil && auditEvent.ObjectRef.Namespace != "" {
+		attributes["namespace"] = auditEvent.ObjectRef.Namespace
+	}
+
+	return attributes
+}
+
+// OrderingKey returns the ordering key of the audit event. Messages with
+// the same key are delivered in order, so the output sends them with the
+// same worker.
+func (p *PubSub) OrderingKey(auditEvent *auditv1.Event) string {
+	switch p.cfg.PubSub.OrderingKey {
+	case "none":
+		return ""
+	case "namespace":
+		namespace := ""
+		if auditEvent.ObjectRef != nil {
+			namespace = auditEvent.ObjectRef.Namespace
+		}
+		return p.source.Cluster + "/" + namespace
+	default:
+		return p.source.Cluster
+	}
+}
+
+func (p *PubSub) Close() error {
+	return nil
+}
@@ -0,0 +1,142 @@
+package sink_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/sink"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+type pubsubMessage struct {
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes"`
+	OrderingKey string            `json:"orderingKey"`
+}
+
+func TestPubSub(t *testing.T) {
+
+	var path string
+	var messages []pubsubMessage
+	status := http.StatusOK
+
+	// Stands in for the pubsub emulator
+	emulator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		body, _ := ioutil.ReadAll(r.Body)
+		var req struct {
+			Messages []pubsubMessage `json:"messages"`
+		}
+		json.Unmarshal(body, &req)
+		messages = req.Messages
+		w.WriteHeader(status)
+		w.Write([]byte(`{"messageIds": ["1"]}`))
+	}))
+	defer emulator.Close()
+
+	os.Setenv("PUBSUB_EMULATOR_HOST", strings.TrimPrefix(emulator.URL, "http://"))
+	defer os.Unsetenv("PUBSUB_EMULATOR_HOST")
+
+	cfg := testOutputConfig()
+	cfg.Type = "pubsub"
+	cfg.PubSub = config.PubSubConfig{Topic: "k8s-audit", OrderingKey: "cluster"}
+
+	pubsub, err := sink.New(cfg, sink.Source{Project: "my-project", Cluster: "my-cluster"})
+	assert.Nil(t, err)
+
+	auditEvents := testEvents(2, "default")
+	auditEvents[0].User.Username = "alice"
+	assert.Nil(t, pubsub.Send(auditEvents))
+	assert.Equal(t, "/v1/projects/my-project/topics/k8s-audit:publish", path)
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, "my-cluster", messages[0].OrderingKey)
+	assert.Equal(t, map[string]string{"verb": "create", "namespace": "default", "user": "alice"}, messages[0].Attributes)
+
+	var auditEvent auditv1.Event
+	assert.Nil(t, json.Unmarshal(messages[1].Data, &auditEvent))
+	assert.Equal(t, auditEvents[1].AuditID, auditEvent.AuditID)
+
+	status = http.StatusNotFound
+	err = pubsub.Send(auditEvents)
+	assert.NotNil(t, err)
+	assert.True(t, sink.IsPermanent(err))
+
+	status = http.StatusServiceUnavailable
+	err = pubsub.Send(auditEvents)
+	assert.NotNil(t, err)
+	assert.False(t, sink.IsPermanent(err))
+
+	// Any 2xx status is a success, unless success_codes are set
+	status = http.StatusAccepted
+	assert.Nil(t, pubsub.Send(auditEvents))
+
+	cfg.SuccessCodes = []int{200}
+	pubsub, err = sink.New(cfg, sink.Source{Project: "my-project", Cluster: "my-cluster"})
+	assert.Nil(t, err)
+	assert.NotNil(t, pubsub.Send(auditEvents))
+	cfg.SuccessCodes = nil
+
+	cfg.PubSub.OrderingKey = "random"
+	_, err = sink.New(cfg, sink.Source{Project: "my-project"})
+	assert.NotNil(t, err)
+}
+
+func TestPubSubRequestSize(t *testing.T) {
+
+	var requests [][]pubsubMessage
+	status := http.StatusOK
+
+	emulator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var req struct {
+			Messages []pubsubMessage `json:"messages"`
+		}
+		json.Unmarshal(body, &req)
+		requests = append(requests, req.Messages)
+		w.WriteHeader(status)
+		w.Write([]byte(`{"messageIds": ["1"]}`))
+	}))
+	defer emulator.Close()
+
+	os.Setenv("PUBSUB_EMULATOR_HOST", strings.TrimPrefix(emulator.URL, "http://"))
+	defer os.Unsetenv("PUBSUB_EMULATOR_HOST")
+
+	cfg := testOutputConfig()
+	cfg.Type = "pubsub"
+	cfg.PubSub = config.PubSubConfig{Topic: "k8s-audit", OrderingKey: "cluster"}
+
+	pubsub, err := sink.New(cfg, sink.Source{Project: "my-project", Cluster: "my-cluster"})
+	assert.Nil(t, err)
+
+	// With the base64 encoded data, events of 4MB take more than 5MB, so
+	// only one of them fits into a request of at most 10MB.
+	auditEvents := testEvents(5, "default")
+	for _, auditEvent := range auditEvents[:3] {
+		auditEvent.Annotations = map[string]string{"large": strings.Repeat("x", 4*1000*1000)}
+	}
+	assert.Nil(t, pubsub.Send(auditEvents))
+	assert.Equal(t, 3, len(requests))
+	assert.Equal(t, 1, len(requests[0]))
+	assert.Equal(t, 1, len(requests[1]))
+	assert.Equal(t, 3, len(requests[2]))
+
+	// More than 1000 events are published with several requests
+	requests = nil
+	assert.Nil(t, pubsub.Send(testEvents(1500, "default")))
+	assert.Equal(t, 2, len(requests))
+	assert.Equal(t, 1000, len(requests[0]))
+
+	// Only the events of the failed request and later ones are retried
+	requests = nil
+	status = http.StatusServiceUnavailable
+	err = pubsub.Send(auditEvents)
+	assert.False(t, sink.IsPermanent(err))
+	assert.Equal(t, 1, len(requests))
+}
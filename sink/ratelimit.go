@@ -0,0 +1,116 @@
+package sink
+
+import (
+	"sync"
+	"time"
+
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+)
+
+// tokenBucket holds up to burst tokens, refilled at rate tokens per second.
+// Taking more tokens than available is allowed, but the caller must wait
+// until the bucket is refilled before using them.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+
+	if rate <= 0 {
+		return nil
+	}
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// take takes n tokens, and returns how long to wait before using them.
+func (b *tokenBucket) take(n int, now time.Time) time.Duration {
+
+	if b == nil {
+		return 0
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimiter smooths the batches sent by an output to the configured
+// events and bytes per second.
+type rateLimiter struct {
+	output string
+	events *tokenBucket
+	bytes  *tokenBucket
+}
+
+func newRateLimiter(output string, cfg config.RateLimitConfig) *rateLimiter {
+
+	if cfg.EventsPerSecond <= 0 && cfg.BytesPerSecond <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		output: output,
+		events: newTokenBucket(cfg.EventsPerSecond, cfg.BurstEvents),
+		bytes:  newTokenBucket(cfg.BytesPerSecond, cfg.BurstBytes),
+	}
+}
+
+// wait blocks until the batch, whose json is size bytes long (or -1 if
+// not known), may be sent.
+func (r *rateLimiter) wait(batch []*auditv1.Event, size int) {
+
+	if r == nil {
+		return
+	}
+
+	now := time.Now()
+	delay := r.events.take(len(batch), now)
+
+	if r.bytes != nil {
+		if size < 0 {
+			size = 0
+			for _, auditEvent := range batch {
+				size += eventSize(auditEvent)
+			}
+		}
+		if bytesDelay := r.bytes.take(size, now); bytesDelay > delay {
+			delay = bytesDelay
+		}
+	}
+
+	if delay > 0 {
+		promOutputRateLimitWait.WithLabelValues(r.output).Add(delay.Seconds())
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,129 @@
+package sink
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+)
+
+// Sink delivers batches of audit events to a single destination.
+type Sink interface {
+	// Send delivers the batch, returning an error if the batch (or part
+	// of it) could not be delivered. Errors wrapped with Permanent are
+	// not retried, and a *PartialError only retries part of the batch.
+	Send(auditEvents []*auditv1.Event) error
+
+	Close() error
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Permanent marks an error as one that will not go away by retrying the
+// same batch, e.g. a 400 response.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// IsPermanent returns true if the error was wrapped with Permanent.
+func IsPermanent(err error) bool {
+	_, ok := err.(*permanentError)
+	return ok
+}
+
+// PartialError is returned by sinks that delivered only part of a batch.
+// The output only retries the events in Retry. Events that were rejected
+// permanently (e.g. because of a mapping error) are not retried, they are
+// listed in RejectedEvents if the sink knows which ones they are.
+type PartialError struct {
+	Retry          []*auditv1.Event
+	Rejected       int
+	RejectedEvents []*auditv1.Event
+	Err            error
+}
+
+func (e *PartialError) Error() string {
+	return e.Err.Error()
+}
+
+// statusError returns err for an unsuccessful http response, marked as
+// permanent for client errors other than throttling, which won't succeed
+// when retried.
+func statusError(statusCode int, err error) error {
+	if statusCode >= 400 && statusCode < 500 && statusCode != http.StatusTooManyRequests {
+		return Permanent(err)
+	}
+	return err
+}
+
+// isSuccess returns true if the status code of a http response is one of
+// the success_codes of the output, or any 2xx status if there are none.
+func isSuccess(cfg config.OutputConfig, statusCode int) bool {
+
+	if len(cfg.SuccessCodes) == 0 {
+		return statusCode >= 200 && statusCode < 300
+	}
+
+	for _, code := range cfg.SuccessCodes {
+		if statusCode == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RawSink is implemented by sinks that can also keep the raw log entries
+// the audit events were converted from.
+type RawSink interface {
+	SendRaw(timestamp time.Time, entryJSON []byte) error
+}
+
+// OrderedSink is implemented by sinks that keep the events with the same
+// ordering key in order. Outputs send all events with the same key with
+// the same worker, instead of the events of each object.
+type OrderedSink interface {
+	OrderingKey(auditEvent *auditv1.Event) string
+}
+
+// Source identifies where the audit events come from. Sinks use it to
+// fill in fields like the kafka topic or message key.
+type Source struct {
+	Project string
+	Cluster string
+}
+
+// New creates the sink for the type of the output.
+func New(cfg config.OutputConfig, source Source) (Sink, error) {
+	switch cfg.Type {
+	case "webhook":
+		return NewWebhook(cfg, source)
+	case "kafka":
+		return NewKafka(cfg, source)
+	case "splunk":
+		return NewSplunk(cfg, source)
+	case "elasticsearch":
+		return NewElasticsearch(cfg, source)
+	case "loki":
+		return NewLoki(cfg, source)
+	case "otlp":
+		return NewOTLP(cfg, source)
+	case "syslog":
+		return NewSyslog(cfg, source)
+	case "archive":
+		return NewArchive(cfg, source)
+	case "pubsub":
+		return NewPubSub(cfg, source)
+	default:
+		return nil, fmt.Errorf("Unknown type %q for output %s", cfg.Type, cfg.Name)
+	}
+}
@@ -0,0 +1,233 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	splunkEventPath = "/services/collector/event"
+	splunkAckPath   = "/services/collector/ack"
+)
+
+// Splunk sends batches of audit events to a splunk HTTP Event Collector
+// (HEC). With indexer acknowledgement enabled, Send only returns once
+// splunk acknowledged that the batch was indexed.
+type Splunk struct {
+	cfg        config.OutputConfig
+	eventUrl   string
+	ackUrl     string
+	host       string
+	channel    string
+	httpClient *http.Client
+}
+
+// splunkEvent is the HEC envelope of a single audit event.
+type splunkEvent struct {
+	Time       json.Number    `json:"time"`
+	Host       string         `json:"host,omitempty"`
+	Source     string         `json:"source,omitempty"`
+	Sourcetype string         `json:"sourcetype,omitempty"`
+	Index      string         `json:"index,omitempty"`
+	Event      *auditv1.Event `json:"event"`
+}
+
+type splunkResponse struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckID *int64 `json:"ackId"`
+}
+
+type splunkAckRequest struct {
+	Acks []int64 `json:"acks"`
+}
+
+type splunkAckResponse struct {
+	Acks map[string]bool `json:"acks"`
+}
+
+func NewSplunk(cfg config.OutputConfig, source Source) (*Splunk, error) {
+
+	if cfg.Url == "" {
+		return nil, fmt.Errorf("Output %s has no url", cfg.Name)
+	}
+
+	if cfg.Splunk.Token == "" {
+		return nil, fmt.Errorf("Output %s has no splunk token", cfg.Name)
+	}
+
+	// The url can be just the address of the HEC, or the full url of the
+	// event endpoint.
+	eventUrl, err := url.Parse(cfg.Url)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse url %s: %v", cfg.Url, err)
+	}
+	if eventUrl.Path == "" || eventUrl.Path == "/" {
+		eventUrl.Path = splunkEventPath
+	}
+
+	ackUrl := *eventUrl
+	ackUrl.Path = splunkAckPath
+
+	httpClient, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Splunk{
+		cfg:        cfg,
+		eventUrl:   eventUrl.String(),
+		ackUrl:     ackUrl.String(),
+		host:       cfg.Splunk.Host,
+		channel:    cfg.Splunk.Channel,
+		httpClient: httpClient,
+	}
+
+	if s.host == "" {
+		s.host = source.Cluster
+	}
+
+	// Acknowledgements are tracked per channel, which must be a GUID.
+	if cfg.Splunk.Ack && s.channel == "" {
+		s.channel, err = newChannel()
+		if err != nil {
+			return nil, fmt.Errorf("Could not create splunk channel: %v", err)
+		}
+	}
+
+	return s, nil
+}
+
+func newChannel() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	// Random (version 4) uuid
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+func (s *Splunk) Send(auditEvents []*auditv1.Event) error {
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+
+	for _, auditEvent := range auditEvents {
+		err := enc.Encode(&splunkEvent{
+			Time:       splunkTime(auditEvent.StageTimestamp.Time),
+			Host:       s.host,
+			Source:     s.cfg.Splunk.Source,
+			Sourcetype: s.cfg.Splunk.Sourcetype,
+			Index:      s.cfg.Splunk.Index,
+			Event:      auditEvent,
+		})
+		if err != nil {
+			return Permanent(fmt.Errorf("Could not serialize audit event to JSON: %v", err))
+		}
+	}
+
+	var resp splunkResponse
+	if err := s.post(s.eventUrl, body.Bytes(), &resp); err != nil {
+		return err
+	}
+
+	if !s.cfg.Splunk.Ack {
+		return nil
+	}
+
+	if resp.AckID == nil {
+		return Permanent(fmt.Errorf("Response from splunk has no ackId, is indexer acknowledgement enabled for the token?"))
+	}
+
+	return s.waitForAck(*resp.AckID)
+}
+
+// splunkTime returns the time as seconds since the epoch, with
+// millisecond precision.
+func splunkTime(t time.Time) json.Number {
+	return json.Number(strconv.FormatFloat(float64(t.UnixNano()/int64(time.Millisecond))/1000, 'f', 3, 64))
+}
+
+func (s *Splunk) waitForAck(ackID int64) error {
+
+	ackRequest, err := json.Marshal(&splunkAckRequest{Acks: []int64{ackID}})
+	if err != nil {
+		return Permanent(fmt.Errorf("Could not serialize ack request to JSON: %v", err))
+	}
+
+	deadline := time.Now().Add(s.cfg.Splunk.AckTimeout)
+
+	for {
+		var resp splunkAckResponse
+		if err := s.post(s.ackUrl, ackRequest, &resp); err != nil {
+			return err
+		}
+
+		if resp.Acks[strconv.FormatInt(ackID, 10)] {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Splunk did not acknowledge ackId %d within %v", ackID, s.cfg.Splunk.AckTimeout)
+		}
+
+		time.Sleep(s.cfg.Splunk.AckPollInterval)
+	}
+}
+
+func (s *Splunk) post(url string, body []byte, result interface{}) error {
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return Permanent(fmt.Errorf("Could not construct http request to %s: %v", url, err))
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Splunk "+s.cfg.Splunk.Token)
+	if s.channel != "" {
+		req.Header.Set("X-Splunk-Request-Channel", s.channel)
+	}
+	for key, val := range s.cfg.Headers {
+		req.Header.Set(key, val)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Could not POST to %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	log.Debugf("response from post: status=%s body=%s:", resp.Status, string(respBody))
+
+	if !isSuccess(s.cfg, resp.StatusCode) {
+		return statusError(resp.StatusCode, fmt.Errorf("Unsuccessful response %s from POST to %s: %s", resp.Status, url, string(respBody)))
+	}
+
+	if err := json.Unmarshal(respBody, result); err != nil {
+		return fmt.Errorf("Could not parse response from %s: %v", url, err)
+	}
+
+	return nil
+}
+
+func (s *Splunk) Close() error {
+	return nil
+}
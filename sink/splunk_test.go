@@ -0,0 +1,138 @@
+package sink_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/sink"
+)
+
+func testSplunkConfig(url string) config.OutputConfig {
+	cfg := testOutputConfig()
+	cfg.Type = "splunk"
+	cfg.Url = url
+	cfg.Splunk = config.SplunkConfig{
+		Token:           "my-token",
+		Index:           "k8s",
+		Source:          "stackdriver-webhook-bridge",
+		Sourcetype:      "kube:apiserver-audit",
+		AckTimeout:      100 * time.Millisecond,
+		AckPollInterval: time.Millisecond,
+	}
+	return cfg
+}
+
+func TestSplunk(t *testing.T) {
+
+	var received []map[string]interface{}
+	var header http.Header
+	var path string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		path = r.URL.Path
+		body, _ := ioutil.ReadAll(r.Body)
+		received = nil
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			var event map[string]interface{}
+			json.Unmarshal(scanner.Bytes(), &event)
+			received = append(received, event)
+		}
+		w.Write([]byte(`{"text":"Success","code":0}`))
+	}))
+	defer server.Close()
+
+	splunk, err := sink.NewSplunk(testSplunkConfig(server.URL), sink.Source{Project: "my-project", Cluster: "my-cluster"})
+	assert.Nil(t, err)
+
+	assert.Nil(t, splunk.Send(testEvents(2, "default")))
+	assert.Equal(t, "/services/collector/event", path)
+	assert.Equal(t, "Splunk my-token", header.Get("Authorization"))
+	assert.Equal(t, 2, len(received))
+	assert.Equal(t, "my-cluster", received[0]["host"])
+	assert.Equal(t, "stackdriver-webhook-bridge", received[0]["source"])
+	assert.Equal(t, "kube:apiserver-audit", received[0]["sourcetype"])
+	assert.Equal(t, "k8s", received[0]["index"])
+	assert.Equal(t, "default-0", received[0]["event"].(map[string]interface{})["auditID"])
+	assert.Contains(t, received[0], "time")
+}
+
+func TestSplunkAck(t *testing.T) {
+
+	acked := false
+	var channels []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		channels = append(channels, r.Header.Get("X-Splunk-Request-Channel"))
+		switch r.URL.Path {
+		case "/services/collector/event":
+			w.Write([]byte(`{"text":"Success","code":0,"ackId":7}`))
+		case "/services/collector/ack":
+			var req map[string][]int64
+			body, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal(body, &req)
+			assert.Equal(t, []int64{7}, req["acks"])
+			if acked {
+				w.Write([]byte(`{"acks":{"7":true}}`))
+			} else {
+				acked = true
+				w.Write([]byte(`{"acks":{"7":false}}`))
+			}
+		}
+	}))
+	defer server.Close()
+
+	cfg := testSplunkConfig(server.URL + "/services/collector/event")
+	cfg.Splunk.Ack = true
+
+	splunk, err := sink.NewSplunk(cfg, sink.Source{Cluster: "my-cluster"})
+	assert.Nil(t, err)
+
+	assert.Nil(t, splunk.Send(testEvents(2, "default")))
+	assert.Equal(t, 3, len(channels))
+	assert.Regexp(t, "^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$", channels[0])
+	assert.Equal(t, channels[0], channels[2])
+
+	// Never acknowledged
+	acked = false
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/services/collector/event" {
+			w.Write([]byte(`{"text":"Success","code":0,"ackId":8}`))
+		} else {
+			w.Write([]byte(`{"acks":{"8":false}}`))
+		}
+	})
+	err = splunk.Send(testEvents(1, "default"))
+	assert.NotNil(t, err)
+	assert.False(t, sink.IsPermanent(err))
+}
+
+func TestSplunkErrors(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"text":"Invalid token","code":4}`))
+	}))
+	defer server.Close()
+
+	splunk, err := sink.NewSplunk(testSplunkConfig(server.URL), sink.Source{})
+	assert.Nil(t, err)
+
+	err = splunk.Send(testEvents(1, "default"))
+	assert.NotNil(t, err)
+	assert.True(t, sink.IsPermanent(err))
+
+	cfg := testSplunkConfig(server.URL)
+	cfg.Splunk.Token = ""
+	_, err = sink.NewSplunk(cfg, sink.Source{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,228 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// spool keeps the events of an output on disk while it is unavailable, as
+// json lines in <dir>/<output>.jsonl.
+type spool struct {
+	path    string
+	maxSize int64
+
+	mutex sync.Mutex
+	size  int64
+}
+
+func newSpool(dir string, output string, maxSizeMB int) (*spool, error) {
+
+	if dir == "" {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Could not create spool directory %s: %v", dir, err)
+	}
+
+	s := &spool{
+		path:    filepath.Join(dir, output+".jsonl"),
+		maxSize: int64(maxSizeMB) * 1024 * 1024,
+	}
+
+	// Events spooled before a restart are sent once the output is
+	// available, including those of a replay that was interrupted.
+	if info, err := os.Stat(s.path); err == nil {
+		s.size = info.Size()
+	}
+	if _, err := os.Stat(s.replayPath()); err == nil {
+		if err := s.restore(0); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// write appends the events to the spool.
+func (s *spool) write(auditEvents []*auditv1.Event) error {
+
+	var buf []byte
+	for _, auditEvent := range auditEvents {
+		auditEventJSON, err := json.Marshal(auditEvent)
+		if err != nil {
+			return fmt.Errorf("Could not serialize audit event to JSON: %v", err)
+		}
+		buf = append(buf, auditEventJSON...)
+		buf = append(buf, '\n')
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.maxSize > 0 && s.size+int64(len(buf)) > s.maxSize {
+		return fmt.Errorf("Spool %s is full", s.path)
+	}
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Could not open spool %s: %v", s.path, err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(buf); err != nil {
+		return fmt.Errorf("Could not write to spool %s: %v", s.path, err)
+	}
+	s.size += int64(len(buf))
+
+	return nil
+}
+
+// empty returns true if there are no spooled events.
+func (s *spool) empty() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.size == 0
+}
+
+// replay passes the spooled events to send in batches of at most
+// batchSize events, reading them from disk as it goes. The spool file is
+// moved aside first, so events spooled in the meantime go to a new file.
+// If send returns false, the events of that batch and all following ones
+// are put back into the spool, before the events spooled since.
+func (s *spool) replay(batchSize int, send func([]*auditv1.Event) bool) error {
+
+	s.mutex.Lock()
+	if s.size == 0 {
+		s.mutex.Unlock()
+		return nil
+	}
+	if err := os.Rename(s.path, s.replayPath()); err != nil {
+		s.mutex.Unlock()
+		return fmt.Errorf("Could not move spool %s aside: %v", s.path, err)
+	}
+	s.size = 0
+	s.mutex.Unlock()
+
+	file, err := os.Open(s.replayPath())
+	if err != nil {
+		return fmt.Errorf("Could not open spool %s: %v", s.replayPath(), err)
+	}
+	defer file.Close()
+
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+
+	reader := bufio.NewReader(file)
+	var auditEvents []*auditv1.Event
+
+	// The offset of the first event not sent yet.
+	var offset, read int64
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		read += int64(len(line))
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			auditEvent := &auditv1.Event{}
+			if jsonErr := json.Unmarshal(line, auditEvent); jsonErr != nil {
+				log.Warnf("Skipping spooled audit event in %s that can't be parsed: %v", s.replayPath(), jsonErr)
+			} else {
+				auditEvents = append(auditEvents, auditEvent)
+			}
+		}
+
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("Could not read spool %s: %v", s.replayPath(), err)
+		}
+
+		if len(auditEvents) >= batchSize || (err == io.EOF && len(auditEvents) > 0) {
+			if !send(auditEvents) {
+				return s.restore(offset)
+			}
+			auditEvents = nil
+			offset = read
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if err := os.Remove(s.replayPath()); err != nil {
+		return fmt.Errorf("Could not remove spool %s: %v", s.replayPath(), err)
+	}
+
+	return nil
+}
+
+func (s *spool) replayPath() string {
+	return s.path + ".replay"
+}
+
+// restore puts the events of the replay file from offset on back into the
+// spool, before any events spooled since it was moved aside.
+func (s *spool) restore(offset int64) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	replay, err := os.Open(s.replayPath())
+	if err != nil {
+		return fmt.Errorf("Could not open spool %s: %v", s.replayPath(), err)
+	}
+	defer replay.Close()
+
+	if _, err := replay.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("Could not seek in spool %s: %v", s.replayPath(), err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("Could not create %s: %v", tmpPath, err)
+	}
+
+	size, err := io.Copy(tmp, replay)
+	if err == nil {
+		var spooled *os.File
+		if spooled, err = os.Open(s.path); err == nil {
+			var n int64
+			n, err = io.Copy(tmp, spooled)
+			size += n
+			spooled.Close()
+		} else if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Could not put spooled events back into %s: %v", s.path, err)
+	}
+
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("Could not rename %s to %s: %v", tmpPath, s.path, err)
+	}
+	s.size = size
+
+	if err := os.Remove(s.replayPath()); err != nil {
+		return fmt.Errorf("Could not remove spool %s: %v", s.replayPath(), err)
+	}
+
+	return nil
+}
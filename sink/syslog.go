@@ -0,0 +1,386 @@
+package sink
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+)
+
+const (
+	syslogMsgID         = "k8s-audit"
+	syslogVendor        = "Sysdig"
+	syslogProduct       = "stackdriver-webhook-bridge"
+	syslogVersion       = "1.0"
+	syslogWriteTimeout  = 10 * time.Second
+	syslogTimestampForm = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// Syslog severities, see RFC5424 section 6.2.1
+const (
+	syslogSeverityError   = 3
+	syslogSeverityWarning = 4
+	syslogSeverityNotice  = 5
+	syslogSeverityInfo    = 6
+)
+
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// Syslog sends every audit event as an RFC5424 syslog message over udp,
+// tcp or tls. The message is the json of the audit event, or the event in
+// CEF or LEEF format. Over tcp and tls, messages are framed with octet
+// counting (RFC6587/RFC5425).
+type Syslog struct {
+	cfg       config.OutputConfig
+	network   string
+	address   string
+	hostname  string
+	facility  int
+	tlsConfig *tls.Config
+
+	mutex sync.Mutex
+	conn  net.Conn
+}
+
+func NewSyslog(cfg config.OutputConfig, source Source) (*Syslog, error) {
+
+	if cfg.Url == "" {
+		return nil, fmt.Errorf("Output %s has no url", cfg.Name)
+	}
+
+	// e.g. udp://syslog:514, tcp://syslog:601 or tls://syslog:6514
+	u, err := url.Parse(cfg.Url)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse url %s: %v", cfg.Url, err)
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+	default:
+		return nil, fmt.Errorf("Unknown syslog url scheme %q, must be one of udp, tcp, tls", u.Scheme)
+	}
+
+	switch cfg.Syslog.Format {
+	case "rfc5424", "cef", "leef":
+	default:
+		return nil, fmt.Errorf("Unknown syslog format %q, must be one of rfc5424, cef, leef", cfg.Syslog.Format)
+	}
+
+	facility, ok := syslogFacilities[cfg.Syslog.Facility]
+	if !ok {
+		return nil, fmt.Errorf("Unknown syslog facility %q", cfg.Syslog.Facility)
+	}
+
+	s := &Syslog{
+		cfg:      cfg,
+		network:  u.Scheme,
+		address:  u.Host,
+		hostname: cfg.Syslog.Hostname,
+		facility: facility,
+	}
+
+	if s.hostname == "" {
+		s.hostname = source.Cluster
+	}
+	if s.hostname == "" {
+		s.hostname = "-"
+	}
+
+	if u.Scheme == "tls" {
+		tlsCfg := cfg.Syslog.TLS
+		tlsCfg.Enabled = true
+		s.tlsConfig, err = newTLSConfig(tlsCfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// syslogSeverity derives the facility and severity of the message from
+// the response status of the audit event: authentication/authorization
+// failures are logged to authpriv.
+func (s *Syslog) syslogSeverity(auditEvent *auditv1.Event) (int, int) {
+
+	code := int32(0)
+	if auditEvent.ResponseStatus != nil {
+		code = auditEvent.ResponseStatus.Code
+	}
+
+	switch {
+	case code >= 500:
+		return s.facility, syslogSeverityError
+	case code == 401 || code == 403:
+		return syslogFacilities["authpriv"], syslogSeverityWarning
+	case code >= 400:
+		return s.facility, syslogSeverityNotice
+	default:
+		return s.facility, syslogSeverityInfo
+	}
+}
+
+// formatMessage returns the RFC5424 syslog message for the audit event.
+func (s *Syslog) formatMessage(auditEvent *auditv1.Event) (string, error) {
+
+	facility, severity := s.syslogSeverity(auditEvent)
+
+	var msg string
+	switch s.cfg.Syslog.Format {
+	case "cef":
+		msg = formatCEF(auditEvent, severity)
+	case "leef":
+		msg = formatLEEF(auditEvent, severity)
+	default:
+		auditEventJSON, err := json.Marshal(auditEvent)
+		if err != nil {
+			return "", fmt.Errorf("Could not serialize audit event to JSON: %v", err)
+		}
+		msg = string(auditEventJSON)
+	}
+
+	timestamp := "-"
+	if !auditEvent.StageTimestamp.IsZero() {
+		timestamp = auditEvent.StageTimestamp.Time.UTC().Format(syslogTimestampForm)
+	}
+
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	return fmt.Sprintf("<%d>1 %s %s %s - %s - %s",
+		facility*8+severity, timestamp, s.hostname, s.cfg.Syslog.AppName, syslogMsgID, msg), nil
+}
+
+func (s *Syslog) Send(auditEvents []*auditv1.Event) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, auditEvent := range auditEvents {
+		msg, err := s.formatMessage(auditEvent)
+		if err != nil {
+			return Permanent(err)
+		}
+
+		if err := s.write(msg); err != nil {
+			// Reconnect on the next attempt.
+			s.closeConn()
+			return &PartialError{Retry: auditEvents[i:], Err: err}
+		}
+	}
+
+	return nil
+}
+
+func (s *Syslog) write(msg string) error {
+
+	if s.conn == nil {
+		var err error
+		if s.tlsConfig != nil {
+			s.conn, err = tls.DialWithDialer(&net.Dialer{Timeout: syslogWriteTimeout}, "tcp", s.address, s.tlsConfig)
+		} else {
+			s.conn, err = net.DialTimeout(s.network, s.address, syslogWriteTimeout)
+		}
+		if err != nil {
+			return fmt.Errorf("Could not connect to syslog server %s: %v", s.address, err)
+		}
+	}
+
+	if s.network != "udp" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		return fmt.Errorf("Could not write to syslog server %s: %v", s.address, err)
+	}
+
+	return nil
+}
+
+func (s *Syslog) closeConn() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *Syslog) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closeConn()
+	return nil
+}
+
+// CEF and LEEF
+
+type keyValue struct {
+	key string
+	val string
+}
+
+// eventFields returns the fields of the audit event used in CEF and LEEF
+// extensions, leaving out empty values.
+func eventFields(auditEvent *auditv1.Event, names map[string]string) []keyValue {
+
+	fields := []keyValue{
+		{"time", strconv.FormatInt(auditEvent.StageTimestamp.Time.UnixNano()/int64(time.Millisecond), 10)},
+		{"auditID", string(auditEvent.AuditID)},
+		{"user", auditEvent.User.Username},
+		{"verb", auditEvent.Verb},
+		{"uri", auditEvent.RequestURI},
+		{"userAgent", auditEvent.UserAgent},
+	}
+
+	if len(auditEvent.SourceIPs) > 0 {
+		fields = append(fields, keyValue{"sourceIP", auditEvent.SourceIPs[0]})
+	}
+
+	if ref := auditEvent.ObjectRef; ref != nil {
+		fields = append(fields,
+			keyValue{"namespace", ref.Namespace},
+			keyValue{"resource", ref.Resource},
+			keyValue{"name", ref.Name})
+	}
+
+	if auditEvent.ResponseStatus != nil {
+		fields = append(fields, keyValue{"code", strconv.Itoa(int(auditEvent.ResponseStatus.Code))})
+	}
+
+	var result []keyValue
+	for _, field := range fields {
+		if field.val == "" {
+			continue
+		}
+		if name, ok := names[field.key]; ok {
+			result = append(result, keyValue{name, field.val})
+		}
+	}
+
+	return result
+}
+
+// eventName returns an id (e.g. "create:pods") and a name (e.g. "create
+// pods") for the kind of audit event.
+func eventName(auditEvent *auditv1.Event) (string, string) {
+	resource := ""
+	if ref := auditEvent.ObjectRef; ref != nil {
+		resource = ref.Resource
+		if ref.Subresource != "" {
+			resource += "/" + ref.Subresource
+		}
+	}
+	return auditEvent.Verb + ":" + resource, strings.TrimSpace(auditEvent.Verb + " " + resource)
+}
+
+// The CEF extension keys of the audit event fields, with the custom
+// string labels added in formatCEF.
+var cefNames = map[string]string{
+	"time":      "rt",
+	"auditID":   "externalId",
+	"user":      "suser",
+	"verb":      "act",
+	"uri":       "request",
+	"userAgent": "requestClientApplication",
+	"sourceIP":  "src",
+	"namespace": "cs1",
+	"resource":  "cs2",
+	"name":      "cs3",
+	"code":      "outcome",
+}
+
+var cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+var cefValueEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+
+// cefSeverity maps the syslog severity to the 0-10 CEF severity.
+var cefSeverity = map[int]int{
+	syslogSeverityError:   7,
+	syslogSeverityWarning: 5,
+	syslogSeverityNotice:  3,
+	syslogSeverityInfo:    1,
+}
+
+func formatCEF(auditEvent *auditv1.Event, severity int) string {
+
+	signatureID, name := eventName(auditEvent)
+
+	ext := []string{
+		"cs1Label=namespace",
+		"cs2Label=resource",
+		"cs3Label=name",
+	}
+	for _, field := range eventFields(auditEvent, cefNames) {
+		ext = append(ext, field.key+"="+cefValueEscaper.Replace(field.val))
+	}
+
+	// CEF:Version|Device Vendor|Device Product|Device Version|Signature ID|Name|Severity|Extension
+	return fmt.Sprintf("CEF:0|%s|%s|%s|%s|%s|%d|%s",
+		syslogVendor, syslogProduct, syslogVersion,
+		cefHeaderEscaper.Replace(signatureID), cefHeaderEscaper.Replace(name),
+		cefSeverity[severity], strings.Join(ext, " "))
+}
+
+// The LEEF attribute keys of the audit event fields.
+var leefNames = map[string]string{
+	"time":      "devTime",
+	"auditID":   "auditID",
+	"user":      "usrName",
+	"verb":      "action",
+	"uri":       "url",
+	"userAgent": "userAgent",
+	"sourceIP":  "src",
+	"namespace": "namespace",
+	"resource":  "resource",
+	"name":      "resourceName",
+	"code":      "responseCode",
+}
+
+var leefValueEscaper = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+func formatLEEF(auditEvent *auditv1.Event, severity int) string {
+
+	eventID, _ := eventName(auditEvent)
+
+	// devTime is in milliseconds since the epoch, the default without a
+	// devTimeFormat.
+	attrs := []string{
+		fmt.Sprintf("sev=%d", cefSeverity[severity]),
+	}
+	for _, field := range eventFields(auditEvent, leefNames) {
+		attrs = append(attrs, field.key+"="+leefValueEscaper.Replace(field.val))
+	}
+
+	// LEEF:Version|Vendor|Product|Version|EventID|attributes (tab separated)
+	return fmt.Sprintf("LEEF:1.0|%s|%s|%s|%s|%s",
+		syslogVendor, syslogProduct, syslogVersion,
+		strings.Replace(eventID, "|", "_", -1), strings.Join(attrs, "\t"))
+}
@@ -0,0 +1,183 @@
+package sink_test
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/sink"
+	authv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+func testSyslogConfig(url string, format string) config.OutputConfig {
+	cfg := testOutputConfig()
+	cfg.Type = "syslog"
+	cfg.Url = url
+	cfg.Syslog = config.SyslogConfig{
+		Format:   format,
+		Facility: "local0",
+		AppName:  "swb",
+	}
+	return cfg
+}
+
+func testSyslogEvents() []*auditv1.Event {
+	auditEvents := testEvents(2, "default")
+	for _, auditEvent := range auditEvents {
+		auditEvent.StageTimestamp = metav1.NewMicroTime(time.Date(2020, 5, 17, 10, 0, 0, 0, time.UTC))
+		auditEvent.User = authv1.UserInfo{Username: "alice@example.com"}
+		auditEvent.SourceIPs = []string{"10.0.0.1"}
+		auditEvent.ObjectRef.Name = "my-pod"
+	}
+	auditEvents[1].ResponseStatus.Code = 403
+	return auditEvents
+}
+
+func readUDP(t *testing.T, conn net.PacketConn, n int) []string {
+	var msgs []string
+	buf := make([]byte, 65536)
+	for i := 0; i < n; i++ {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		len, _, err := conn.ReadFrom(buf)
+		assert.Nil(t, err)
+		msgs = append(msgs, string(buf[:len]))
+	}
+	return msgs
+}
+
+func TestSyslogUDP(t *testing.T) {
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	syslog, err := sink.NewSyslog(testSyslogConfig("udp://"+conn.LocalAddr().String(), "rfc5424"), sink.Source{Cluster: "my-cluster"})
+	assert.Nil(t, err)
+	defer syslog.Close()
+
+	assert.Nil(t, syslog.Send(testSyslogEvents()))
+	msgs := readUDP(t, conn, 2)
+
+	// local0.info
+	assert.True(t, strings.HasPrefix(msgs[0], `<134>1 2020-05-17T10:00:00.000000Z my-cluster swb - k8s-audit - {"`), msgs[0])
+	assert.Contains(t, msgs[0], `"auditID":"default-0"`)
+
+	// authpriv.warning
+	assert.True(t, strings.HasPrefix(msgs[1], `<84>1 `), msgs[1])
+}
+
+func TestSyslogCEF(t *testing.T) {
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	syslog, err := sink.NewSyslog(testSyslogConfig("udp://"+conn.LocalAddr().String(), "cef"), sink.Source{Cluster: "my-cluster"})
+	assert.Nil(t, err)
+	defer syslog.Close()
+
+	auditEvents := testSyslogEvents()
+	auditEvents[0].UserAgent = "kubectl=1.17|linux"
+
+	assert.Nil(t, syslog.Send(auditEvents))
+	msgs := readUDP(t, conn, 2)
+
+	msg := msgs[0][strings.Index(msgs[0], "CEF:"):]
+	assert.Equal(t, `CEF:0|Sysdig|stackdriver-webhook-bridge|1.0|create:pods|create pods|1|`+
+		`cs1Label=namespace cs2Label=resource cs3Label=name rt=1589709600000 externalId=default-0 suser=alice@example.com `+
+		`act=create requestClientApplication=kubectl\=1.17|linux src=10.0.0.1 cs1=default cs2=pods cs3=my-pod outcome=201`, msg)
+	assert.Contains(t, msgs[1], "|create:pods|create pods|5|")
+}
+
+func TestSyslogLEEF(t *testing.T) {
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	syslog, err := sink.NewSyslog(testSyslogConfig("udp://"+conn.LocalAddr().String(), "leef"), sink.Source{Cluster: "my-cluster"})
+	assert.Nil(t, err)
+	defer syslog.Close()
+
+	assert.Nil(t, syslog.Send(testSyslogEvents()[:1]))
+	msgs := readUDP(t, conn, 1)
+
+	msg := msgs[0][strings.Index(msgs[0], "LEEF:"):]
+	assert.Equal(t, "LEEF:1.0|Sysdig|stackdriver-webhook-bridge|1.0|create:pods|"+
+		"sev=1\tdevTime=1589709600000\tauditID=default-0\tusrName=alice@example.com\taction=create\t"+
+		"src=10.0.0.1\tnamespace=default\tresource=pods\tresourceName=my-pod\tresponseCode=201", msg)
+}
+
+func TestSyslogTCP(t *testing.T) {
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	received := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			for {
+				length, err := reader.ReadString(' ')
+				if err != nil {
+					break
+				}
+				n, _ := strconv.Atoi(strings.TrimSpace(length))
+				buf := make([]byte, n)
+				if _, err := reader.Read(buf); err != nil {
+					break
+				}
+				received <- string(buf)
+			}
+			conn.Close()
+		}
+	}()
+
+	syslog, err := sink.NewSyslog(testSyslogConfig("tcp://"+lis.Addr().String(), "rfc5424"), sink.Source{Cluster: "my-cluster"})
+	assert.Nil(t, err)
+	defer syslog.Close()
+
+	assert.Nil(t, syslog.Send(testSyslogEvents()))
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-received:
+			assert.True(t, strings.HasPrefix(msg, "<"), msg)
+			assert.True(t, strings.HasSuffix(msg, "}"), msg)
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for syslog message")
+		}
+	}
+
+	// Once the server is gone, all events are returned for retrying.
+	lis.Close()
+	syslog.Close()
+	err = syslog.Send(testSyslogEvents())
+	partialErr, ok := err.(*sink.PartialError)
+	assert.True(t, ok)
+	assert.Equal(t, 2, len(partialErr.Retry))
+}
+
+func TestSyslogInvalidConfig(t *testing.T) {
+
+	_, err := sink.NewSyslog(testSyslogConfig("http://syslog:514", "rfc5424"), sink.Source{})
+	assert.NotNil(t, err)
+
+	_, err = sink.NewSyslog(testSyslogConfig("udp://syslog:514", "gelf"), sink.Source{})
+	assert.NotNil(t, err)
+
+	cfg := testSyslogConfig("udp://syslog:514", "rfc5424")
+	cfg.Syslog.Facility = "local9"
+	_, err = sink.NewSyslog(cfg, sink.Source{})
+	assert.NotNil(t, err)
+}
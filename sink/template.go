@@ -0,0 +1,62 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+// templateData is what templates in output settings (e.g. the kafka
+// topic) can refer to:
+//
+//	{{ .Project }}, {{ .Cluster }}, {{ .Namespace }}, {{ .Resource }},
+//	{{ .Verb }}, {{ .User }}, {{ .Time }} (the stage timestamp) and
+//	{{ .Event }}
+type templateData struct {
+	Project   string
+	Cluster   string
+	Namespace string
+	Resource  string
+	Verb      string
+	User      string
+	Time      time.Time
+	Event     *auditv1.Event
+}
+
+func newTemplateData(source Source, auditEvent *auditv1.Event) *templateData {
+
+	data := &templateData{
+		Project: source.Project,
+		Cluster: source.Cluster,
+		Verb:    auditEvent.Verb,
+		User:    auditEvent.User.Username,
+		Time:    auditEvent.StageTimestamp.Time.UTC(),
+		Event:   auditEvent,
+	}
+
+	if auditEvent.ObjectRef != nil {
+		data.Namespace = auditEvent.ObjectRef.Namespace
+		data.Resource = auditEvent.ObjectRef.Resource
+	}
+
+	return data
+}
+
+func parseTemplate(name string, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse template %q: %v", text, err)
+	}
+	return tmpl, nil
+}
+
+func executeTemplate(tmpl *template.Template, data *templateData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("Could not execute template %s: %v", tmpl.Name(), err)
+	}
+	return buf.String(), nil
+}
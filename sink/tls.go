@@ -0,0 +1,190 @@
+package sink
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig creates the tls configuration for an output from its
+// config. It returns nil if tls is not enabled.
+func newTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.MinVersion != "" {
+		version, ok := tlsVersions[cfg.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("Unknown tls min_version %q, must be one of 1.0, 1.1, 1.2, 1.3", cfg.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if cfg.CAFile != "" {
+		ca, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read CA file %s: %v", cfg.CAFile, err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("Could not parse any certificates from CA file %s", cfg.CAFile)
+		}
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load client certificate %s/%s: %v", cfg.CertFile, cfg.KeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// tlsConfigured returns whether any tls option besides enabled is set.
+func tlsConfigured(cfg config.TLSConfig) bool {
+	return cfg.CAFile != "" || cfg.CertFile != "" || cfg.KeyFile != "" ||
+		cfg.ServerName != "" || cfg.InsecureSkipVerify || cfg.MinVersion != ""
+}
+
+// reloadingTransport is a http.RoundTripper with the tls and connection
+// settings of an output. When the CA, certificate or key file changes
+// (e.g. because the certificates were rotated), the tls configuration is
+// loaded again and new connections use it.
+type reloadingTransport struct {
+	cfg   config.TLSConfig
+	http  config.HTTPConfig
+	proxy func(*http.Request) (*url.URL, error)
+
+	mutex     sync.Mutex
+	transport *http.Transport
+	files     []fileVersion
+}
+
+// fileVersion identifies the content of a file by its size and
+// modification time.
+type fileVersion struct {
+	size    int64
+	modTime time.Time
+}
+
+func newReloadingTransport(cfg config.TLSConfig, httpCfg config.HTTPConfig) (*reloadingTransport, error) {
+
+	// Without tls enabled, https urls use tls with the system defaults.
+	if !cfg.Enabled && tlsConfigured(cfg) {
+		return nil, fmt.Errorf("Invalid tls settings: tls.enabled must be set to use ca_file, cert_file, key_file, server_name, insecure_skip_verify or min_version")
+	}
+
+	proxy, err := newProxyFunc(httpCfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &reloadingTransport{cfg: cfg, http: httpCfg, proxy: proxy}
+	t.files = t.fileVersions()
+
+	t.transport, err = t.newTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *reloadingTransport) newTransport() (*http.Transport, error) {
+
+	tlsConfig, err := newTLSConfig(t.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := newTransport(t.http, t.proxy)
+	transport.TLSClientConfig = tlsConfig
+
+	return transport, nil
+}
+
+func (t *reloadingTransport) fileVersions() []fileVersion {
+	var versions []fileVersion
+	for _, path := range []string{t.cfg.CAFile, t.cfg.CertFile, t.cfg.KeyFile} {
+		var version fileVersion
+		if path != "" {
+			if info, err := os.Stat(path); err == nil {
+				version = fileVersion{size: info.Size(), modTime: info.ModTime()}
+			}
+		}
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+// current returns the transport to use, reloading the tls configuration
+// if any of its files changed.
+func (t *reloadingTransport) current() *http.Transport {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.cfg.CAFile == "" && t.cfg.CertFile == "" && t.cfg.KeyFile == "" {
+		return t.transport
+	}
+
+	files := t.fileVersions()
+	changed := false
+	for i := range files {
+		if files[i].size != t.files[i].size || !files[i].modTime.Equal(t.files[i].modTime) {
+			changed = true
+		}
+	}
+	if !changed {
+		return t.transport
+	}
+
+	t.files = files
+
+	// Files may be written one at a time, e.g. the certificate before
+	// the key. Keep using the previous configuration until the new one
+	// can be loaded.
+	transport, err := t.newTransport()
+	if err != nil {
+		log.Warnf("Could not reload tls configuration, using the previous one: %v", err)
+		return t.transport
+	}
+
+	log.Infof("Reloaded tls configuration (ca_file=%s cert_file=%s key_file=%s)", t.cfg.CAFile, t.cfg.CertFile, t.cfg.KeyFile)
+
+	t.transport.CloseIdleConnections()
+	t.transport = transport
+
+	return t.transport
+}
+
+func (t *reloadingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.current().RoundTrip(req)
+}
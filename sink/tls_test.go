@@ -0,0 +1,171 @@
+package sink_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/sink"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert creates a certificate signed by the parent, or a self-signed
+// CA if parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{name},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) write(t *testing.T, certFile string, keyFile string, modTime time.Time) {
+	assert.Nil(t, ioutil.WriteFile(certFile, c.certPEM, 0644))
+	assert.Nil(t, os.Chtimes(certFile, modTime, modTime))
+	if keyFile != "" {
+		assert.Nil(t, ioutil.WriteFile(keyFile, c.keyPEM, 0600))
+		assert.Nil(t, os.Chtimes(keyFile, modTime, modTime))
+	}
+}
+
+func TestWebhookMutualTLS(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "swb-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil)
+	serverCert := newTestCert(t, "falco.example.com", ca)
+	clientCert := newTestCert(t, "swb", ca)
+
+	// The server only accepts client certificates signed by clientCA.
+	var mutex sync.Mutex
+	clientCA := ca
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			pool := x509.NewCertPool()
+			pool.AddCert(clientCA.cert)
+			return &tls.Config{
+				Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.cert.Raw}, PrivateKey: serverCert.key}},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    pool,
+			}, nil
+		},
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(dir, "ca.crt")
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	modTime := time.Now().Add(-time.Minute)
+	ca.write(t, caFile, "", modTime)
+	clientCert.write(t, certFile, keyFile, modTime)
+
+	cfg := testOutputConfig()
+	cfg.Url = server.URL
+	cfg.TLS = config.TLSConfig{
+		Enabled:    true,
+		CAFile:     caFile,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ServerName: "falco.example.com",
+		MinVersion: "1.2",
+	}
+
+	webhook, err := sink.NewWebhook(cfg, sink.Source{})
+	assert.Nil(t, err)
+	assert.Nil(t, webhook.Send(testEvents(1, "default")))
+
+	// Without a client certificate
+	noCert := cfg
+	noCert.TLS.CertFile, noCert.TLS.KeyFile = "", ""
+	other, err := sink.NewWebhook(noCert, sink.Source{})
+	assert.Nil(t, err)
+	assert.NotNil(t, other.Send(testEvents(1, "default")))
+
+	// The client certificate is rotated to one from a new CA, and picked
+	// up without creating the webhook again.
+	newCA := newTestCert(t, "new-ca", nil)
+	mutex.Lock()
+	clientCA = newCA
+	mutex.Unlock()
+	newTestCert(t, "swb", newCA).write(t, certFile, keyFile, time.Now())
+
+	assert.Nil(t, webhook.Send(testEvents(1, "default")))
+
+	// Invalid settings
+	notEnabled := cfg
+	notEnabled.TLS.Enabled = false
+	_, err = sink.NewWebhook(notEnabled, sink.Source{})
+	assert.NotNil(t, err)
+
+	cfg.TLS.MinVersion = "1.4"
+	_, err = sink.NewWebhook(cfg, sink.Source{})
+	assert.NotNil(t, err)
+
+	cfg.TLS.MinVersion = ""
+	cfg.TLS.CAFile = filepath.Join(dir, "missing.crt")
+	_, err = sink.NewWebhook(cfg, sink.Source{})
+	assert.NotNil(t, err)
+}
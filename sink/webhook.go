@@ -0,0 +1,252 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Webhook posts batches of audit events as a json array to a url, which
+// is what the k8s audit webhook of the Sysdig Agent and falco expect.
+//
+// With the cloudevents encoding, events are sent as CloudEvents instead:
+// one request per event in structured or binary content mode, or one
+// request per batch in batch mode.
+type Webhook struct {
+	cfg        config.OutputConfig
+	source     Source
+	httpClient *http.Client
+	auth       *authenticator
+	compressor *bodyCompressor
+}
+
+func NewWebhook(cfg config.OutputConfig, source Source) (*Webhook, error) {
+
+	if cfg.Url == "" {
+		return nil, fmt.Errorf("Output %s has no url", cfg.Name)
+	}
+
+	switch cfg.Encoding {
+	case "", "json":
+	case "cloudevents":
+		switch cfg.CloudEvents.Mode {
+		case "structured", "binary", "batch":
+		default:
+			return nil, fmt.Errorf("Unknown cloudevents mode %q, must be one of structured, binary, batch", cfg.CloudEvents.Mode)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown encoding %q for output %s, must be one of json, cloudevents", cfg.Encoding, cfg.Name)
+	}
+
+	httpClient, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := newAuthenticator(cfg.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid auth settings for output %s: %v", cfg.Name, err)
+	}
+
+	compressor, err := newBodyCompressor(cfg.Name, cfg.Compression, cfg.CompressionThreshold)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Webhook{
+		cfg:        cfg,
+		source:     source,
+		httpClient: httpClient,
+		auth:       auth,
+		compressor: compressor,
+	}, nil
+}
+
+func (w *Webhook) Send(auditEvents []*auditv1.Event) error {
+
+	if w.cfg.Encoding != "cloudevents" {
+		auditEventsJSON, err := json.Marshal(auditEvents)
+		if err != nil {
+			return Permanent(fmt.Errorf("Could not serialize audit events to JSON: %v", err))
+		}
+
+		header := http.Header{}
+		header.Set("Content-Type", "application/json")
+
+		return w.post(auditEventsJSON, header, auditEvents)
+	}
+
+	var cloudEvents []*cloudEvent
+	for _, auditEvent := range auditEvents {
+		cloudEvents = append(cloudEvents, newCloudEvent(auditEvent, w.cfg.CloudEvents.Type, w.source))
+	}
+
+	if w.cfg.CloudEvents.Mode == "batch" {
+		body, err := json.Marshal(cloudEvents)
+		if err != nil {
+			return Permanent(fmt.Errorf("Could not serialize cloud events to JSON: %v", err))
+		}
+
+		header := http.Header{}
+		header.Set("Content-Type", cloudEventsBatchType)
+
+		return w.post(body, header, auditEvents)
+	}
+
+	return w.sendEach(auditEvents, cloudEvents)
+}
+
+// sendEach posts the cloud events one at a time. Events that were rejected
+// are skipped, and on any other error the remaining events are returned
+// for retrying.
+func (w *Webhook) sendEach(auditEvents []*auditv1.Event, cloudEvents []*cloudEvent) error {
+
+	var rejected []*auditv1.Event
+	var lastErr error
+
+	for i, ce := range cloudEvents {
+		body, header, err := encodeCloudEvent(ce, w.cfg.CloudEvents.Mode)
+		if err == nil {
+			err = w.post(body, header, nil)
+		} else {
+			err = Permanent(err)
+		}
+
+		if err == nil {
+			continue
+		}
+
+		if !IsPermanent(err) {
+			return &PartialError{Retry: auditEvents[i:], Rejected: len(rejected), RejectedEvents: rejected, Err: err}
+		}
+
+		rejected = append(rejected, auditEvents[i])
+		lastErr = err
+	}
+
+	if len(rejected) > 0 {
+		return &PartialError{Rejected: len(rejected), RejectedEvents: rejected, Err: lastErr}
+	}
+
+	return nil
+}
+
+// post posts the body. If the body holds a batch of audit events, they
+// are passed along to handle partial failures.
+func (w *Webhook) post(body []byte, header http.Header, auditEvents []*auditv1.Event) error {
+
+	body, encoding, err := w.compressor.compress(body)
+	if err != nil {
+		return Permanent(err)
+	}
+
+	req, err := http.NewRequest("POST", w.cfg.Url, bytes.NewBuffer(body))
+	if err != nil {
+		return Permanent(fmt.Errorf("Could not construct http request to %s: %v", w.cfg.Url, err))
+	}
+
+	req.Header = header
+	for key, val := range w.cfg.Headers {
+		req.Header.Set(key, val)
+	}
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+
+	if err := w.auth.apply(req, body); err != nil {
+		return err
+	}
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Could not POST audit events to %s: %v", w.cfg.Url, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	log.Debugf("response from post: status=%s body=%s:", resp.Status, string(respBody))
+
+	if !isSuccess(w.cfg, resp.StatusCode) {
+		err := fmt.Errorf("Unsuccessful response %s from POST of audit events: %s", resp.Status, string(respBody))
+
+		// The token may have been replaced in the meantime, read it
+		// again and retry.
+		if resp.StatusCode == http.StatusUnauthorized && w.cfg.Auth.BearerTokenFile != "" {
+			w.auth.expireToken()
+			return err
+		}
+
+		return statusError(resp.StatusCode, err)
+	}
+
+	if w.cfg.PartialFailures && auditEvents != nil {
+		return partialFailure(respBody, auditEvents)
+	}
+
+	return nil
+}
+
+// partialResponse is a response body listing the events of the batch
+// which could not be delivered, by their index in the batch, e.g.
+//
+//	{"errors": [{"index": 3, "error": "invalid objectRef", "retryable": false}]}
+type partialResponse struct {
+	Errors []struct {
+		Index     int    `json:"index"`
+		Error     string `json:"error"`
+		Retryable bool   `json:"retryable"`
+	} `json:"errors"`
+}
+
+// partialFailure returns a *PartialError if the response body lists
+// per-event errors, and nil otherwise.
+func partialFailure(respBody []byte, auditEvents []*auditv1.Event) error {
+
+	var resp partialResponse
+	if err := json.Unmarshal(respBody, &resp); err != nil || len(resp.Errors) == 0 {
+		return nil
+	}
+
+	partialErr := &PartialError{}
+	failed := map[int]bool{}
+
+	for _, e := range resp.Errors {
+		if e.Index < 0 || e.Index >= len(auditEvents) || failed[e.Index] {
+			log.Warnf("Ignoring error for unknown event index %d in response: %s", e.Index, e.Error)
+			continue
+		}
+		failed[e.Index] = true
+
+		if e.Retryable {
+			partialErr.Retry = append(partialErr.Retry, auditEvents[e.Index])
+		} else {
+			partialErr.Rejected++
+			partialErr.RejectedEvents = append(partialErr.RejectedEvents, auditEvents[e.Index])
+		}
+
+		if partialErr.Err == nil {
+			partialErr.Err = fmt.Errorf("Could not deliver %s: %s", auditEvents[e.Index].AuditID, e.Error)
+		}
+	}
+
+	if partialErr.Err == nil {
+		return nil
+	}
+
+	partialErr.Err = fmt.Errorf("%d of %d audit events failed, first error: %v", len(failed), len(auditEvents), partialErr.Err)
+
+	return partialErr
+}
+
+func (w *Webhook) Close() error {
+	w.compressor.close()
+	return nil
+}
@@ -0,0 +1,345 @@
+package sink_test
+
+import (
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/config"
+	"github.com/sysdiglabs/stackdriver-webhook-bridge/sink"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+)
+
+func TestWebhook(t *testing.T) {
+
+	var received []auditv1.Event
+	var header http.Header
+	status := http.StatusOK
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ := ioutil.ReadAll(r.Body)
+		received = nil
+		json.Unmarshal(body, &received)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	cfg := testOutputConfig()
+	cfg.Url = server.URL
+	cfg.Headers = map[string]string{"X-Test": "some-value"}
+
+	webhook, err := sink.NewWebhook(cfg, sink.Source{})
+	assert.Nil(t, err)
+
+	assert.Nil(t, webhook.Send(testEvents(2, "default")))
+	assert.Equal(t, 2, len(received))
+	assert.Equal(t, "application/json", header.Get("Content-Type"))
+	assert.Equal(t, "some-value", header.Get("X-Test"))
+
+	status = http.StatusBadRequest
+	err = webhook.Send(testEvents(2, "default"))
+	assert.NotNil(t, err)
+	assert.True(t, sink.IsPermanent(err))
+
+	status = http.StatusServiceUnavailable
+	err = webhook.Send(testEvents(2, "default"))
+	assert.NotNil(t, err)
+	assert.False(t, sink.IsPermanent(err))
+
+	cfg.Url = ""
+	_, err = sink.NewWebhook(cfg, sink.Source{})
+	assert.NotNil(t, err)
+}
+
+func TestWebhookCloudEvents(t *testing.T) {
+
+	var bodies [][]byte
+	var headers []http.Header
+	statuses := []int{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, body)
+		headers = append(headers, r.Header)
+		status := http.StatusOK
+		if len(statuses) > 0 {
+			status = statuses[0]
+			statuses = statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	cfg := testOutputConfig()
+	cfg.Url = server.URL
+	cfg.Encoding = "cloudevents"
+	cfg.CloudEvents = config.CloudEventsConfig{Mode: "structured", Type: "io.k8s.audit.event"}
+
+	source := sink.Source{Project: "my-project", Cluster: "my-cluster"}
+
+	auditEvents := testEvents(2, "default")
+	auditEvents[0].ObjectRef.Name = "my-pod"
+	auditEvents[0].ObjectRef.Subresource = "exec"
+	auditEvents[0].StageTimestamp = metav1.NewMicroTime(time.Date(2020, 5, 17, 10, 0, 0, 0, time.UTC))
+
+	// Structured mode, one request per event
+	webhook, err := sink.NewWebhook(cfg, source)
+	assert.Nil(t, err)
+	assert.Nil(t, webhook.Send(auditEvents))
+	assert.Equal(t, 2, len(bodies))
+	assert.Equal(t, "application/cloudevents+json", headers[0].Get("Content-Type"))
+
+	var ce map[string]interface{}
+	assert.Nil(t, json.Unmarshal(bodies[0], &ce))
+	assert.Equal(t, "1.0", ce["specversion"])
+	assert.Equal(t, "default-0", ce["id"])
+	assert.Equal(t, "io.k8s.audit.event", ce["type"])
+	assert.Equal(t, "//container.googleapis.com/projects/my-project/clusters/my-cluster", ce["source"])
+	assert.Equal(t, "namespaces/default/pods/my-pod/exec", ce["subject"])
+	assert.Equal(t, "2020-05-17T10:00:00Z", ce["time"])
+	assert.Equal(t, "default-0", ce["data"].(map[string]interface{})["auditID"])
+
+	// Binary mode, the audit event is the body
+	bodies, headers = nil, nil
+	cfg.CloudEvents.Mode = "binary"
+	webhook, err = sink.NewWebhook(cfg, source)
+	assert.Nil(t, err)
+	assert.Nil(t, webhook.Send(auditEvents))
+	assert.Equal(t, 2, len(bodies))
+	assert.Equal(t, "application/json", headers[1].Get("Content-Type"))
+	assert.Equal(t, "1.0", headers[1].Get("Ce-Specversion"))
+	assert.Equal(t, "default-1", headers[1].Get("Ce-Id"))
+	assert.Equal(t, "namespaces/default/pods", headers[1].Get("Ce-Subject"))
+	var auditEvent auditv1.Event
+	assert.Nil(t, json.Unmarshal(bodies[1], &auditEvent))
+	assert.Equal(t, types.UID("default-1"), auditEvent.AuditID)
+
+	// A failing request returns the remaining events for retrying
+	bodies, headers = nil, nil
+	statuses = []int{http.StatusOK, http.StatusServiceUnavailable}
+	err = webhook.Send(append(auditEvents, testEvents(1, "other")...))
+	partialErr, ok := err.(*sink.PartialError)
+	assert.True(t, ok)
+	assert.Equal(t, 2, len(partialErr.Retry))
+	assert.Equal(t, 0, partialErr.Rejected)
+	assert.Equal(t, types.UID("default-1"), partialErr.Retry[0].AuditID)
+
+	// Batch mode, one request per batch
+	bodies, headers = nil, nil
+	cfg.CloudEvents.Mode = "batch"
+	webhook, err = sink.NewWebhook(cfg, source)
+	assert.Nil(t, err)
+	assert.Nil(t, webhook.Send(auditEvents))
+	assert.Equal(t, 1, len(bodies))
+	assert.Equal(t, "application/cloudevents-batch+json", headers[0].Get("Content-Type"))
+	var batch []map[string]interface{}
+	assert.Nil(t, json.Unmarshal(bodies[0], &batch))
+	assert.Equal(t, 2, len(batch))
+	assert.Equal(t, "default-1", batch[1]["id"])
+
+	cfg.CloudEvents.Mode = "streaming"
+	_, err = sink.NewWebhook(cfg, source)
+	assert.NotNil(t, err)
+}
+
+func TestWebhookAuth(t *testing.T) {
+
+	var header http.Header
+	var body []byte
+	status := http.StatusOK
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "swb-auth")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	assert.Nil(t, ioutil.WriteFile(tokenFile, []byte("first-token\n"), 0600))
+
+	cfg := testOutputConfig()
+	cfg.Url = server.URL
+	cfg.Auth = config.AuthConfig{
+		BearerTokenFile:      tokenFile,
+		TokenRefreshInterval: time.Hour,
+		HMACSecret:           "my-secret",
+		HMACSignatureHeader:  "X-Swb-Signature",
+		HMACTimestampHeader:  "X-Swb-Timestamp",
+	}
+
+	webhook, err := sink.NewWebhook(cfg, sink.Source{})
+	assert.Nil(t, err)
+
+	assert.Nil(t, webhook.Send(testEvents(1, "default")))
+	assert.Equal(t, "Bearer first-token", header.Get("Authorization"))
+
+	// The signature covers the timestamp and the body
+	timestamp := header.Get("X-Swb-Timestamp")
+	mac := hmac.New(sha256.New, []byte("my-secret"))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), header.Get("X-Swb-Signature"))
+
+	// The token file is read again after a 401, which is retried.
+	assert.Nil(t, ioutil.WriteFile(tokenFile, []byte("second-token"), 0600))
+	status = http.StatusUnauthorized
+	err = webhook.Send(testEvents(1, "default"))
+	assert.NotNil(t, err)
+	assert.False(t, sink.IsPermanent(err))
+
+	status = http.StatusOK
+	assert.Nil(t, webhook.Send(testEvents(1, "default")))
+	assert.Equal(t, "Bearer second-token", header.Get("Authorization"))
+
+	// Basic auth
+	cfg.Auth = config.AuthConfig{Username: "swb", Password: "secret"}
+	webhook, err = sink.NewWebhook(cfg, sink.Source{})
+	assert.Nil(t, err)
+	assert.Nil(t, webhook.Send(testEvents(1, "default")))
+	assert.Equal(t, "", header.Get("X-Swb-Signature"))
+	assert.Equal(t, "Basic c3diOnNlY3JldA==", header.Get("Authorization"))
+
+	// Invalid settings
+	cfg.Auth = config.AuthConfig{BearerToken: "token", Username: "swb"}
+	_, err = sink.NewWebhook(cfg, sink.Source{})
+	assert.NotNil(t, err)
+
+	cfg.Auth = config.AuthConfig{BearerTokenFile: filepath.Join(dir, "missing")}
+	_, err = sink.NewWebhook(cfg, sink.Source{})
+	assert.NotNil(t, err)
+}
+
+func TestWebhookCompression(t *testing.T) {
+
+	var header http.Header
+	var received []auditv1.Event
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+
+		var reader io.Reader = r.Body
+		switch r.Header.Get("Content-Encoding") {
+		case "gzip":
+			reader, _ = gzip.NewReader(r.Body)
+		case "zstd":
+			decoder, _ := zstd.NewReader(r.Body)
+			defer decoder.Close()
+			reader = decoder
+		}
+
+		body, _ := ioutil.ReadAll(reader)
+		received = nil
+		json.Unmarshal(body, &received)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	cfg := testOutputConfig()
+	cfg.Url = server.URL
+	cfg.CompressionThreshold = 500
+
+	for _, compression := range []string{"gzip", "zstd"} {
+		cfg.Compression = compression
+		webhook, err := sink.NewWebhook(cfg, sink.Source{})
+		assert.Nil(t, err)
+
+		// Below the threshold
+		assert.Nil(t, webhook.Send(testEvents(1, "default")))
+		assert.Equal(t, "", header.Get("Content-Encoding"))
+		assert.Equal(t, 1, len(received))
+
+		assert.Nil(t, webhook.Send(testEvents(10, "default")))
+		assert.Equal(t, compression, header.Get("Content-Encoding"))
+		assert.Equal(t, 10, len(received))
+
+		assert.Nil(t, webhook.Close())
+	}
+
+	cfg.Compression = "brotli"
+	_, err := sink.NewWebhook(cfg, sink.Source{})
+	assert.NotNil(t, err)
+}
+
+func TestWebhookSuccessCodes(t *testing.T) {
+
+	status := http.StatusAccepted
+	respBody := ""
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(respBody))
+	}))
+	defer server.Close()
+
+	cfg := testOutputConfig()
+	cfg.Url = server.URL
+
+	webhook, err := sink.NewWebhook(cfg, sink.Source{})
+	assert.Nil(t, err)
+
+	// Any 2xx by default
+	assert.Nil(t, webhook.Send(testEvents(2, "default")))
+	status = http.StatusNoContent
+	assert.Nil(t, webhook.Send(testEvents(2, "default")))
+
+	// Only the configured codes
+	cfg.SuccessCodes = []int{200, 204}
+	webhook, err = sink.NewWebhook(cfg, sink.Source{})
+	assert.Nil(t, err)
+	assert.Nil(t, webhook.Send(testEvents(2, "default")))
+	status = http.StatusAccepted
+	assert.NotNil(t, webhook.Send(testEvents(2, "default")))
+
+	// Per-event errors
+	cfg.SuccessCodes = nil
+	cfg.PartialFailures = true
+	webhook, err = sink.NewWebhook(cfg, sink.Source{})
+	assert.Nil(t, err)
+
+	auditEvents := testEvents(4, "default")
+	status = http.StatusOK
+	respBody = `{"errors": [{"index": 1, "error": "invalid", "retryable": false}, {"index": 3, "error": "throttled", "retryable": true}]}`
+	err = webhook.Send(auditEvents)
+	partialErr, ok := err.(*sink.PartialError)
+	assert.True(t, ok)
+	assert.Equal(t, 1, partialErr.Rejected)
+	assert.Equal(t, auditEvents[3:], partialErr.Retry)
+
+	// Unsuccessful responses fail the whole batch
+	status = http.StatusInternalServerError
+	err = webhook.Send(auditEvents)
+	assert.NotNil(t, err)
+	_, ok = err.(*sink.PartialError)
+	assert.False(t, ok)
+	status = http.StatusOK
+
+	// Responses without errors
+	respBody = `{"errors": []}`
+	assert.Nil(t, webhook.Send(auditEvents))
+	respBody = `accepted`
+	assert.Nil(t, webhook.Send(auditEvents))
+
+	cfg.SuccessCodes = []int{42}
+	_, err = sink.NewWebhook(cfg, sink.Source{})
+	assert.NotNil(t, err)
+}